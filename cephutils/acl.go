@@ -0,0 +1,81 @@
+package cephutils
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// Object ownership. Owner is principal id of uploader, ACL grants read access to others.
+// Objects w/o owner (anonymous or stored before ownership was introduced) are not restricted
+const (
+	ownerAttrName = "OWNER"
+	aclAttrName   = "ACL"
+)
+
+// Canned ACLs. Private objects are accessed by owner only
+const (
+	ACLPrivate    = "private"
+	ACLGroupRead  = "group-read"  // Readable by authenticated principals of owner tenant
+	ACLPublicRead = "public-read" // Readable by anyone having access to tenant, incl. anonymous clients
+)
+
+// Check canned ACL name, empty stands for private
+func ValidateACL(acl string) error {
+	switch acl {
+	case "", ACLPrivate, ACLGroupRead, ACLPublicRead:
+		return nil
+	}
+
+	return fmt.Errorf("Unknown ACL '%s'", acl)
+}
+
+// Save owner and ACL attributes
+func (o *RadosObj) syncACL() error {
+	oid := o.Oid.String()
+	if o.Owner != "" {
+		if err := o.ioctx.SetXattr(oid, ownerAttrName, []byte(o.Owner)); err != nil {
+			return err
+		}
+	}
+	if o.ACL != "" {
+		if err := o.ioctx.SetXattr(oid, aclAttrName, []byte(o.ACL)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Change object ACL
+func (o *RadosObj) SetACL(acl string) error {
+	if err := ValidateACL(acl); err != nil {
+		return err
+	}
+	if o.pack == "" {
+		o.ACL = acl
+		return o.ioctx.SetXattr(o.Oid.String(), aclAttrName, []byte(acl))
+	}
+
+	cookie, err := lockPacks(o.ioctx)
+	if err != nil {
+		return err
+	}
+	defer unlockPacks(o.ioctx, cookie)
+
+	oid := o.Oid.String()
+	pack, entry, err := findPacked(o.ioctx, oid)
+	if err != nil {
+		return err
+	}
+	entry.ACL = acl
+	raw, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	if err = o.ioctx.SetOmap(pack, map[string][]byte{oid: raw}); err != nil {
+		return err
+	}
+	o.ACL = acl
+
+	return nil
+}
@@ -0,0 +1,23 @@
+package cephutils
+
+import "testing"
+
+func TestValidateACL(t *testing.T) {
+	tests := []struct {
+		acl string
+		ok  bool
+	}{
+		{"", true},
+		{ACLPrivate, true},
+		{ACLGroupRead, true},
+		{ACLPublicRead, true},
+		{"public-read-write", false},
+		{"Private", false},
+	}
+
+	for _, tt := range tests {
+		if err := ValidateACL(tt.acl); (err == nil) != tt.ok {
+			t.Errorf("ValidateACL(%q) = %v", tt.acl, err)
+		}
+	}
+}
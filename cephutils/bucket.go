@@ -0,0 +1,182 @@
+package cephutils
+
+import (
+	"encoding/json"
+	"github.com/ceph/go-ceph/rados"
+	"github.com/satori/go.uuid"
+	"sort"
+	"time"
+)
+
+// S3 buckets. Bucket index object within meta pool and tenant namespace maps object key -> BucketEntry
+const bucketIndexPrefix = "dfscache.bucket."
+
+// Lock of bucket index taken by read-modify-write operations on its entries
+const bucketIndexLockName = "dfscache.bucket"
+
+type BucketEntry struct {
+	Pool        string        `json:"pool"`
+	Oid         uuid.UUID     `json:"oid"`
+	Size        uint64        `json:"size"`
+	ETag        string        `json:"etag"`
+	ContentType string        `json:"content_type"`
+	Modified    int64         `json:"modified"`
+	TTL         time.Duration `json:"ttl"`
+}
+
+type BucketIndex struct {
+	conn  *rados.Conn
+	ioctx *rados.IOContext
+	name  string
+}
+
+// Check if bucket entry object is expired
+func (e *BucketEntry) Expired() bool {
+	return time.Duration(time.Now().UTC().Unix()) > e.TTL
+}
+
+// Open bucket index of tenant namespace
+func (s *Storage) OpenBucketIndex(namespace, bucket string) (*BucketIndex, error) {
+	conn, err := s.NewRadosConn()
+	if err != nil {
+		return nil, err
+	}
+
+	ioctx, err := GetIoctx(conn, s.MetaPool())
+	if err != nil {
+		conn.Shutdown()
+		return nil, err
+	}
+	ioctx.SetNamespace(namespace)
+
+	return &BucketIndex{conn: conn, ioctx: ioctx, name: bucketIndexPrefix + bucket}, nil
+}
+
+// Must be called on operations finish w/ bucket index
+func (b *BucketIndex) Close() {
+	b.ioctx.Destroy()
+	b.conn.Shutdown()
+}
+
+// Bucket entry by key, nil if not found
+func (b *BucketIndex) Get(key string) (*BucketEntry, error) {
+	// Omap keys are sorted, so key itself goes first among keys it prefixes
+	values, err := b.ioctx.GetOmapValues(b.name, "", key, 1)
+	if err != nil {
+		// Bucket index is not created yet
+		return nil, nil
+	}
+
+	raw, ok := values[key]
+	if !ok {
+		return nil, nil
+	}
+
+	entry := new(BucketEntry)
+	if err = json.Unmarshal(raw, entry); err != nil {
+		return nil, err
+	}
+
+	return entry, nil
+}
+
+// Register object under key, replacing previous one
+func (b *BucketIndex) Put(key string, entry *BucketEntry) error {
+	raw, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	return b.ioctx.SetOmap(b.name, map[string][]byte{key: raw})
+}
+
+// Unregister key
+func (b *BucketIndex) Remove(key string) error {
+	return b.ioctx.RmOmapKeys(b.name, []string{key})
+}
+
+// Run read-modify-write operation on bucket index under its lock
+func (b *BucketIndex) withLock(f func() error) error {
+	cookie, err := lockObject(b.ioctx, b.name, bucketIndexLockName)
+	if err != nil {
+		return err
+	}
+	defer unlockObject(b.ioctx, b.name, bucketIndexLockName, cookie)
+
+	return f()
+}
+
+// Register object under key atomically, returns replaced entry, nil if there was none
+func (b *BucketIndex) Swap(key string, entry *BucketEntry) (*BucketEntry, error) {
+	var prev *BucketEntry
+	err := b.withLock(func() (err error) {
+		if prev, err = b.Get(key); err != nil {
+			return err
+		}
+		return b.Put(key, entry)
+	})
+
+	return prev, err
+}
+
+// Unregister key atomically, returns removed entry, nil if there was none
+func (b *BucketIndex) Take(key string) (*BucketEntry, error) {
+	var prev *BucketEntry
+	err := b.withLock(func() (err error) {
+		if prev, err = b.Get(key); err != nil || prev == nil {
+			return err
+		}
+		return b.Remove(key)
+	})
+
+	return prev, err
+}
+
+// Unregister key if it still refers to given object, e.g. one removed by GC
+func (b *BucketIndex) RemoveStale(key string, oid uuid.UUID) error {
+	return b.withLock(func() error {
+		e, err := b.Get(key)
+		if err != nil || e == nil || e.Oid != oid {
+			return err
+		}
+		return b.Remove(key)
+	})
+}
+
+// Up to max bucket keys w/ prefix after given key, in lexicographical order. Expired entries are skipped
+func (b *BucketIndex) List(prefix, startAfter string, max int) ([]string, map[string]*BucketEntry, error) {
+	entries := make(map[string]*BucketEntry)
+	var keys []string
+
+	for len(keys) < max {
+		values, err := b.ioctx.GetOmapValues(b.name, startAfter, prefix, int64(max))
+		if err != nil || len(values) == 0 {
+			// Missing bucket index means empty bucket
+			break
+		}
+
+		var batch []string
+		for key := range values {
+			batch = append(batch, key)
+		}
+		sort.Strings(batch)
+
+		for _, key := range batch {
+			entry := new(BucketEntry)
+			if err = json.Unmarshal(values[key], entry); err != nil {
+				return nil, nil, err
+			}
+			if entry.Expired() {
+				continue
+			}
+			entries[key] = entry
+			keys = append(keys, key)
+			if len(keys) == max {
+				break
+			}
+		}
+		startAfter = batch[len(batch)-1]
+	}
+
+	return keys, entries, nil
+}
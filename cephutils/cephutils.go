@@ -2,41 +2,66 @@ package cephutils
 
 import (
 	"bufio"
+	"bytes"
+	"crypto/md5"
 	"encoding/binary"
 	"fmt"
+	"github.com/GrvHldr/dfscache/logger"
 	"github.com/ceph/go-ceph/rados"
 	"github.com/satori/go.uuid"
+	"hash"
 	"io"
-	"time"
 	"sync"
-	"github.com/GrvHldr/dfscache/config"
+	"time"
 )
 
 const (
-	ttlAttrName      = "TTL"
-	fnameArrtName    = "FILENAME"
-	radosObjLockName = "lock"
+	ttlAttrName       = "TTL"
+	fnameArrtName     = "FILENAME"
+	placementAttrName = "PLACEMENT"
+	radosObjLockName  = "lock"
 )
 
 type BaseRadosObj struct {
-	Pool     string        `json:"pool"`
-	Oid      uuid.UUID     `json:"oid"`
-	Size     uint64        `json:"size"`
-	TTL      time.Duration `json:"exparation"`
-	FileName string        `json:"file_name"`
+	Pool      string            `json:"pool"`
+	Oid       uuid.UUID         `json:"oid"`
+	Key       string            `json:"key,omitempty"`
+	Size      uint64            `json:"size"`
+	TTL       time.Duration     `json:"exparation"`
+	FileName  string            `json:"file_name"`
+	Placement string            `json:"placement"`
+	Checksum  string            `json:"checksum"`
+	Modified  int64             `json:"modified"`
+	Meta      map[string]string `json:"meta,omitempty"`
+	Owner     string            `json:"owner,omitempty"`
+	ACL       string            `json:"acl,omitempty"`
+	Namespace string            `json:"-"`
 }
 
 type RadosObj struct {
 	BaseRadosObj
+	storage      *Storage
 	conn         *rados.Conn
 	ioctx        *rados.IOContext
 	bytesWritten uint64
 	bytesRead    uint64
+	packed       bool         // Object is buffered to be appended into pack
+	packBuf      bytes.Buffer // Packed object data until committed
+	pack         string       // Pack name object is stored within
+	packOffset   uint64       // Object data offset within pack
+	partial      bool         // Resumable upload is not finished
+	uploadLength uint64       // Resumable upload total length
+	hash         hash.Hash    // Content checksum of data written so far
+	// Multipart upload is not completed
+	multipartPending bool
+	// Parts of completed multipart upload
+	parts []manifestPart
 }
 
 type LockRadosObj struct {
 	sync.Mutex
 	RadosObj
+	Aborted bool // Upload session is aborted, nothing is written anymore. Guarded by mutex
 }
 
 type UriRadosObj struct {
@@ -44,29 +69,68 @@ type UriRadosObj struct {
 	Uri string `json:"uri"`
 }
 
+// New Rados object options
+type ObjOptions struct {
+	FileName  string
+	Size      uint64        // Declared object size, 0 if unknown
+	Placement string        // Placement class hint, empty to choose by size
+	Namespace string        // Tenant RADOS namespace
+	TTL       time.Duration // Object lifetime, 0 for CEPH_OPTIONS.OBJECT_TTL
+	NoPacking bool          // Object is written by offsets and can't be packed
+	Meta      map[string]string
+	Key       string // Client-chosen key, object is switched to by KeyedUpload
+	Owner     string // Uploading principal id, empty for objects stored before ownership was introduced
+	ACL       string // Canned ACL, private if empty
+}
+
+// Object expiration time for given lifetime, 0 for CEPH_OPTIONS.OBJECT_TTL
+func (s *Storage) expiration(ttl time.Duration) time.Duration {
+	if ttl == 0 {
+		ttl = time.Duration(s.opts.OBJECT_TTL) * time.Second
+	}
+
+	return time.Duration(time.Now().UTC().Add(ttl).Unix())
+}
+
 // Instantiate new Rados obj w/ defaults
-func NewRadosObj(fname string) (*RadosObj, error) {
+func (s *Storage) NewRadosObj(opts ObjOptions) (*RadosObj, error) {
+	placement, prefix, err := s.SelectPlacement(opts.Size, opts.Placement)
+	if err != nil {
+		return nil, err
+	}
+
 	newOid := uuid.NewV4()
-	pool := config.Config.CEPH_OPTIONS.POOL_NAMES_PREFIX + newOid.String()[:2]
-	conn, err := NewRadosConn()
+	pool := shardPool(prefix, newOid)
+	conn, err := s.NewRadosConn()
 	if err != nil {
 		return nil, err
 	}
 
 	ioctx, err := GetIoctx(conn, pool)
 	if err != nil {
+		conn.Shutdown()
 		return nil, err
 	}
+	ioctx.SetNamespace(opts.Namespace)
 
 	return &RadosObj{
 		BaseRadosObj: BaseRadosObj{
-			Pool:     pool,
-			Oid:      newOid,
-			TTL:      time.Duration(time.Now().UTC().Add(time.Duration(config.Config.CEPH_OPTIONS.OBJECT_TTL) * time.Second).Unix()),
-			FileName: fname,
+			Pool:      pool,
+			Oid:       newOid,
+			Key:       opts.Key,
+			TTL:       s.expiration(opts.TTL),
+			FileName:  opts.FileName,
+			Placement: placement,
+			Meta:      opts.Meta,
+			Owner:     opts.Owner,
+			ACL:       opts.ACL,
+			Namespace: opts.Namespace,
 		},
-		conn:  conn,
-		ioctx: ioctx,
+		storage: s,
+		conn:    conn,
+		ioctx:   ioctx,
+		packed:  !opts.NoPacking && s.packable(opts.Size),
+		hash:    md5.New(),
 	}, nil
 }
 
@@ -79,23 +143,53 @@ func NewUriRadosObj(o BaseRadosObj) *UriRadosObj {
 }
 
 // Retrieve Rados object from Ceph storage
-func ExistingRadosObj(pool string, oid uuid.UUID) (obj *RadosObj, err error) {
-	conn, err := NewRadosConn()
+func (s *Storage) ExistingRadosObj(pool, namespace string, oid uuid.UUID) (obj *RadosObj, err error) {
+	conn, err := s.NewRadosConn()
 	if err != nil {
 		return nil, err
 	}
 
-	ioctx, err := GetIoctx(conn, pool)
+	start := time.Now()
+	ioctx, err := conn.OpenIOContext(pool)
+	s.observe("open", start, err)
 	if err != nil {
 		conn.Shutdown()
 		return nil, err
 	}
+	ioctx.SetNamespace(namespace)
 
 	stat, err := ioctx.Stat(oid.String())
 	if err != nil {
-		ioctx.Destroy()
-		conn.Shutdown()
-		return
+		// Small object may be stored within pack
+		pack, entry, perr := findPacked(ioctx, oid.String())
+		if perr != nil {
+			ioctx.Destroy()
+			conn.Shutdown()
+			return
+		}
+
+		obj = &RadosObj{
+			BaseRadosObj: BaseRadosObj{
+				Pool:      pool,
+				Oid:       oid,
+				Size:      entry.Length,
+				TTL:       entry.TTL,
+				FileName:  entry.FileName,
+				Placement: entry.Placement,
+				Checksum:  entry.Checksum,
+				Modified:  entry.Modified,
+				Meta:      entry.Meta,
+				Owner:     entry.Owner,
+				ACL:       entry.ACL,
+				Namespace: namespace,
+			},
+			storage:    s,
+			conn:       conn,
+			ioctx:      ioctx,
+			pack:       pack,
+			packOffset: entry.Offset,
+		}
+		return obj, nil
 	}
 
 	ttl, err := GetObjTTL(ioctx, oid.String())
@@ -112,16 +206,41 @@ func ExistingRadosObj(pool string, oid uuid.UUID) (obj *RadosObj, err error) {
 		return
 	}
 
+	// Objects stored before placement classes were introduced have no attribute
+	placement, err := GetObjPlacement(ioctx, oid.String())
+	if err != nil {
+		placement, err = DefaultPlacement, nil
+	}
+
 	obj = &RadosObj{
 		BaseRadosObj: BaseRadosObj{
-			Pool:     pool,
-			Oid:      oid,
-			Size:     stat.Size,
-			TTL:      ttl,
-			FileName: fname,
+			Pool:      pool,
+			Oid:       oid,
+			Size:      stat.Size,
+			TTL:       ttl,
+			FileName:  fname,
+			Placement: placement,
+			Namespace: namespace,
 		},
-		conn:  conn,
-		ioctx: ioctx,
+		storage: s,
+		conn:    conn,
+		ioctx:   ioctx,
+	}
+	obj.loadChecksum()
+	if err = obj.loadMeta(); err != nil {
+		obj.Destroy()
+		return nil, err
+	}
+
+	// Resumable upload in progress
+	if length, perr := getObjUploadLength(ioctx, oid.String()); perr == nil {
+		obj.partial, obj.uploadLength = true, length
+		obj.loadHashState()
+	}
+
+	if err = obj.loadMultipart(); err != nil {
+		obj.Destroy()
+		return nil, err
 	}
 
 	return
@@ -133,13 +252,15 @@ func (o *RadosObj) Destroy() {
 	o.conn.Shutdown()
 }
 
-// Sync object attributes to Ceph storage
+// Sync object attributes to Ceph storage.
+// Packed object is appended to pack along with its attributes
 func (o *RadosObj) SyncAttributes() error {
-	// Save TTL
-	buf := make([]byte, 10)
-	binary.LittleEndian.PutUint64(buf, uint64(o.TTL))
+	if o.packed {
+		return o.commitPack()
+	}
 
-	if err := o.ioctx.SetXattr(o.Oid.String(), ttlAttrName, buf); err != nil {
+	// Save TTL
+	if err := setObjTTL(o.ioctx, o.Oid.String(), o.TTL); err != nil {
 		return err
 	}
 
@@ -148,32 +269,89 @@ func (o *RadosObj) SyncAttributes() error {
 		return err
 	}
 
+	// Save placement class
+	if err := o.ioctx.SetXattr(o.Oid.String(), placementAttrName, []byte(o.Placement)); err != nil {
+		return err
+	}
+
+	if err := o.syncChecksum(); err != nil {
+		return err
+	}
+
+	// Save client key
+	if o.Key != "" {
+		if err := o.ioctx.SetXattr(o.Oid.String(), keyAttrName, []byte(o.Key)); err != nil {
+			return err
+		}
+	}
+
+	if err := o.syncACL(); err != nil {
+		return err
+	}
+
+	return o.syncMeta()
+}
+
+// Finish object upload: sync attributes and account storage usage
+func (o *RadosObj) Commit() error {
+	o.finalizeChecksum()
+	start := time.Now()
+	err := o.SyncAttributes()
+	o.storage.observe("commit", start, err)
+	if err != nil {
+		return err
+	}
+
+	if err := o.storage.updateUsage(o.conn, o.Namespace, o.Pool, int64(o.Size), 1); err != nil {
+		logger.Log.Errorf("Can't update usage of %s: %s", o.Oid, err)
+	}
+
+	if err := o.addToIndexes(); err != nil {
+		logger.Log.Errorf("Can't index %s: %s", o.Oid, err)
+	}
+
 	return nil
 }
 
+// Discard partially uploaded object data
+func (o *RadosObj) Abort() {
+	if o.packed {
+		o.packBuf.Reset()
+		return
+	}
+
+	if o.bytesWritten > 0 {
+		if err := o.ioctx.Delete(o.Oid.String()); err != nil {
+			logger.Log.Errorf("Can't delete partial object %s: %s", o.Oid, err)
+		}
+	}
+}
+
 func (o *RadosObj) WriteFromReader(rd io.Reader) (uint64, error) {
 	o.LockRados()
 	defer o.UnlockRados()
 
 	o.bytesWritten = 0
 	bufrw := bufio.NewReadWriter(
-		bufio.NewReaderSize(rd, config.Config.CEPH_OPTIONS.RW_BUFFER_SIZE),
-		bufio.NewWriterSize(o, config.Config.CEPH_OPTIONS.RW_BUFFER_SIZE),
+		bufio.NewReaderSize(rd, o.storage.opts.RW_BUFFER_SIZE),
+		bufio.NewWriterSize(o, o.storage.opts.RW_BUFFER_SIZE),
 	)
 	written, err := io.Copy(bufrw.Writer, bufrw.Reader)
 	if err != nil {
 		return 0, err
 	}
-	bufrw.Writer.Flush()
+	if err = bufrw.Writer.Flush(); err != nil {
+		return 0, err
+	}
+
+	o.Size = uint64(written)
 
 	// Save attributes
-	err = o.SyncAttributes()
+	err = o.Commit()
 	if err != nil {
 		return 0, err
 	}
 
-	o.Size = uint64(written)
-
 	return o.Size, nil
 }
 
@@ -204,22 +382,40 @@ func (o *RadosObj) ReadToWriter(wr io.Writer, off, len int64) (uint64, error) {
 func (o *RadosObj) Write(p []byte) (n int, err error) {
 	oid := o.Oid.String()
 
+	if o.packed {
+		if uint64(o.packBuf.Len()+len(p)) <= o.storage.opts.PACK_THRESHOLD {
+			n, err = o.packBuf.Write(p)
+			o.bytesWritten += uint64(n)
+			o.hashContent(p[:n])
+			return
+		}
+		// Declared size was wrong, store standalone object
+		if err = o.unpack(); err != nil {
+			return
+		}
+	}
+
+	start := time.Now()
 	if o.bytesWritten == 0 {
 		err = o.ioctx.WriteFull(oid, p)
+		o.storage.observe("write", start, err)
 		if err == nil {
 			n = len(p)
 			o.bytesWritten += uint64(n)
+			o.hashContent(p)
 			return
 		}
 		return
 	}
 
 	err = o.ioctx.Write(oid, p, o.bytesWritten)
+	o.storage.observe("write", start, err)
 	if err != nil {
 		return
 	}
 	n = len(p)
 	o.bytesWritten += uint64(n)
+	o.hashContent(p)
 
 	return
 }
@@ -234,25 +430,40 @@ func (o *RadosObj) ReadProgress() uint64 {
 
 // Reader interface implementation
 func (o *RadosObj) Read(p []byte) (n int, err error) {
-	oid := o.Oid.String()
-
-	n, err = o.ioctx.Read(oid, p, o.bytesRead)
-	if err != nil {
-		return
-	}
+	n, err = o.ReadAt(p, int64(o.bytesRead))
 	o.bytesRead += uint64(n)
 
-	if n == 0 {
-		err = io.EOF
-	}
-
 	return
 }
 
 // ReaderAt interface implementation
 func (o *RadosObj) ReadAt(p []byte, off int64) (n int, err error) {
+	if o.pack != "" {
+		// Packed object: read within its boundaries only
+		if uint64(off) >= o.Size {
+			return 0, io.EOF
+		}
+		short := uint64(off)+uint64(len(p)) > o.Size
+		if short {
+			p = p[:o.Size-uint64(off)]
+		}
+		start := time.Now()
+		n, err = o.ioctx.Read(o.pack, p, o.packOffset+uint64(off))
+		o.storage.observe("read", start, err)
+		if err == nil && (n == 0 || short) {
+			err = io.EOF
+		}
+		return
+	}
+
+	if o.parts != nil {
+		return o.readParts(p, off)
+	}
+
 	oid := o.Oid.String()
+	start := time.Now()
 	n, err = o.ioctx.Read(oid, p, uint64(off))
+	o.storage.observe("read", start, err)
 	if err != nil {
 		return
 	}
@@ -265,6 +476,12 @@ func (o *RadosObj) ReadAt(p []byte, off int64) (n int, err error) {
 
 // Lock Rados object
 func (o *RadosObj) LockRados() error {
+	if o.packed || o.pack != "" {
+		// Packed objects are guarded by packs lock
+		return nil
+	}
+
+	start := time.Now()
 	ret, err := o.ioctx.LockExclusive(
 		o.Oid.String(),
 		radosObjLockName,
@@ -273,6 +490,7 @@ func (o *RadosObj) LockRados() error {
 		0,
 		nil,
 	)
+	o.storage.observe("lock", start, err)
 	if err != nil {
 		return err
 	}
@@ -286,28 +504,69 @@ func (o *RadosObj) LockRados() error {
 
 // Unlock Rados object
 func (o *RadosObj) UnlockRados() error {
+	if o.packed || o.pack != "" {
+		return nil
+	}
+
 	_, err := o.ioctx.Unlock(o.Oid.String(), radosObjLockName, radosObjLockName)
 	return err
 }
 
 // Unregister object from Ceph storage
 func (o *RadosObj) Delete() error {
+	var err error
 	oid := o.Oid.String()
-	if IsObjectLocked(o.ioctx, oid) {
+	start := time.Now()
+	if o.pack != "" {
+		err = o.deletePacked()
+	} else if IsObjectLocked(o.ioctx, oid) {
 		return fmt.Errorf("Object %s is locked", oid)
+	} else if o.parts != nil || o.multipartPending {
+		if err = o.deleteParts(); err == nil {
+			err = o.ioctx.Delete(oid)
+		}
+	} else {
+		err = o.ioctx.Delete(oid)
+	}
+	o.storage.observe("delete", start, err)
+	if err != nil {
+		return err
+	}
+
+	// Unfinished uploads are not accounted
+	if o.IsPartial() {
+		return nil
+	}
+
+	if err = o.storage.updateUsage(o.conn, o.Namespace, o.Pool, -int64(o.Size), -1); err != nil {
+		logger.Log.Errorf("Can't update usage of %s: %s", o.Oid, err)
 	}
 
-	return o.ioctx.Delete(o.Oid.String())
+	if err = o.removeFromIndexes(); err != nil {
+		logger.Log.Errorf("Can't unindex %s: %s", o.Oid, err)
+	}
+	if o.Key != "" {
+		if err = o.releaseKey(); err != nil {
+			logger.Log.Errorf("Can't release key of %s: %s", o.Oid, err)
+		}
+	}
+
+	return nil
 }
 
 // New connection to Ceph cluster
-func NewRadosConn() (*rados.Conn, error) {
-	conn, err := rados.NewConn()
+func (s *Storage) NewRadosConn() (conn *rados.Conn, err error) {
+	start := time.Now()
+	defer func() {
+		s.observe("connect", start, err)
+	}()
+
+	conn, err = rados.NewConn()
 	if err != nil {
 		return nil, fmt.Errorf("Unable to create new connection: ", err)
 	}
 
-	if err = conn.ReadConfigFile(config.Config.CEPH_OPTIONS.CONFIG_FILE); err != nil {
+	if err = conn.ReadConfigFile(s.opts.CONFIG_FILE); err != nil {
 		return nil, fmt.Errorf("Can't read default config file: ", err)
 	}
 
@@ -357,12 +616,23 @@ func GetObjTTL(ioctx *rados.IOContext, oid string) (time.Duration, error) {
 // Get object FileName attribute
 func GetObjFileName(ioctx *rados.IOContext, oid string) (string, error) {
 	buf := make([]byte, 255)
-	_, err := ioctx.GetXattr(oid, fnameArrtName, buf)
+	n, err := ioctx.GetXattr(oid, fnameArrtName, buf)
 	if err != nil {
 		return "", err
 	}
 
-	return string(buf), nil
+	return string(buf[:n]), nil
+}
+
+// Get object placement class attribute
+func GetObjPlacement(ioctx *rados.IOContext, oid string) (string, error) {
+	buf := make([]byte, 255)
+	n, err := ioctx.GetXattr(oid, placementAttrName, buf)
+	if err != nil {
+		return "", err
+	}
+
+	return string(buf[:n]), nil
 }
 
 // Check if object is locked
@@ -373,3 +643,12 @@ func IsObjectLocked(ioctx *rados.IOContext, oid string) bool {
 	}
 	return lock.NumLockers != 0
 }
+
+// Check if object is locked. Packed objects are guarded by packs lock and never locked individually
+func (o *RadosObj) IsLocked() bool {
+	if o.packed || o.pack != "" {
+		return false
+	}
+
+	return IsObjectLocked(o.ioctx, o.Oid.String())
+}
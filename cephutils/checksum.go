@@ -0,0 +1,109 @@
+package cephutils
+
+import (
+	"crypto/md5"
+	"encoding"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"time"
+)
+
+// Content checksum (MD5) and upload time, used as download cache validators
+const (
+	checksumAttrName  = "CHECKSUM"   // Hex encoded content MD5
+	modifiedAttrName  = "MTIME"      // Upload time, unix seconds
+	hashStateAttrName = "HASH_STATE" // Checksum state of unfinished resumable upload
+)
+
+// Account written data in content checksum
+func (o *RadosObj) hashContent(p []byte) {
+	if o.hash != nil {
+		o.hash.Write(p)
+	}
+}
+
+// Fix content checksum and upload time on upload finish.
+// Checksum stays unknown if some data was written w/o hashing
+func (o *RadosObj) finalizeChecksum() {
+	if o.Checksum == "" && o.hash != nil {
+		o.Checksum = hex.EncodeToString(o.hash.Sum(nil))
+	}
+	o.Modified = time.Now().UTC().Unix()
+}
+
+// Save checksum and upload time attributes
+func (o *RadosObj) syncChecksum() error {
+	oid := o.Oid.String()
+	if o.Checksum != "" {
+		if err := o.ioctx.SetXattr(oid, checksumAttrName, []byte(o.Checksum)); err != nil {
+			return err
+		}
+	}
+
+	if o.Modified != 0 {
+		buf := make([]byte, 8)
+		binary.LittleEndian.PutUint64(buf, uint64(o.Modified))
+		if err := o.ioctx.SetXattr(oid, modifiedAttrName, buf); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Load checksum and upload time attributes. Objects stored before checksums were introduced have none
+func (o *RadosObj) loadChecksum() {
+	oid := o.Oid.String()
+	buf := make([]byte, 64)
+	if n, err := o.ioctx.GetXattr(oid, checksumAttrName, buf); err == nil {
+		o.Checksum = string(buf[:n])
+	}
+
+	if n, err := o.ioctx.GetXattr(oid, modifiedAttrName, buf); err == nil && n == 8 {
+		o.Modified = int64(binary.LittleEndian.Uint64(buf[:n]))
+	}
+}
+
+// Save checksum state of resumable upload along w/ offset it corresponds to,
+// so upload may be continued by any instance
+func (o *RadosObj) saveHashState() error {
+	if o.hash == nil {
+		return nil
+	}
+
+	state, err := o.hash.(encoding.BinaryMarshaler).MarshalBinary()
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, 8, 8+len(state))
+	binary.LittleEndian.PutUint64(buf, o.bytesWritten)
+
+	return o.ioctx.SetXattr(o.Oid.String(), hashStateAttrName, append(buf, state...))
+}
+
+// Restore checksum state of resumable upload. Checksum is not computed if state doesn't match upload offset
+func (o *RadosObj) loadHashState() {
+	buf := make([]byte, 256)
+	n, err := o.ioctx.GetXattr(o.Oid.String(), hashStateAttrName, buf)
+	if err != nil || n < 8 || binary.LittleEndian.Uint64(buf) != o.Size {
+		return
+	}
+
+	hash := md5.New()
+	if err = hash.(encoding.BinaryUnmarshaler).UnmarshalBinary(buf[8:n]); err != nil {
+		return
+	}
+	o.hash = hash
+}
+
+// Checksum of multipart object: MD5 of concatenated binary part MD5s, suffixed w/ parts count
+func multipartChecksum(partSums []string) string {
+	hash := md5.New()
+	for _, sum := range partSums {
+		raw, _ := hex.DecodeString(sum)
+		hash.Write(raw)
+	}
+
+	return fmt.Sprintf("%s-%d", hex.EncodeToString(hash.Sum(nil)), len(partSums))
+}
@@ -0,0 +1,269 @@
+package cephutils
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/GrvHldr/dfscache/logger"
+	"github.com/ceph/go-ceph/rados"
+	"github.com/satori/go.uuid"
+	"math"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Secondary indexes. Per tenant index objects within meta pool map file name and indexed metadata
+// (CEPH_OPTIONS.INDEXED_META_KEYS) to objects. Omap key is "<escaped term>/<inverted upload time><oid>",
+// so versions of the same term are sorted latest first. Term is query escaped, so it never contains
+// separator, and omap keys stay printable since librados takes them as C strings
+const (
+	indexNamePrefix   = "dfscache.index."
+	nameIndexName     = indexNamePrefix + "name"
+	metaIndexName     = indexNamePrefix + "meta"
+	indexKeySeparator = "/"
+	MaxIndexVersions  = 1000
+)
+
+type IndexEntry struct {
+	Pool     string        `json:"pool"`
+	Oid      uuid.UUID     `json:"oid"`
+	Modified int64         `json:"modified"`
+	TTL      time.Duration `json:"ttl"`
+}
+
+// Expiring omap value of index or bucket index
+type expiringEntry struct {
+	TTL time.Duration `json:"ttl"`
+}
+
+// Omap key prefix of term versions
+func indexTerm(term string) string {
+	return url.QueryEscape(term) + indexKeySeparator
+}
+
+// Check if omap key is version of term, not of another term it is prefix of
+func isIndexKeyOf(key, term string) bool {
+	prefix := indexTerm(term)
+	return strings.HasPrefix(key, prefix) && !strings.Contains(key[len(prefix):], indexKeySeparator)
+}
+
+func indexKey(term string, modified int64, oid uuid.UUID) string {
+	return fmt.Sprintf("%s%016x%s", indexTerm(term), uint64(math.MaxInt64-modified), oid)
+}
+
+func metaTerm(key, value string) string {
+	return key + "=" + value
+}
+
+// Check if metadata key is indexed
+func (s *Storage) IsIndexedMeta(key string) bool {
+	for _, k := range s.opts.INDEXED_META_KEYS {
+		if k == key {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Index keys of object by index object name
+func (o *RadosObj) indexKeys() map[string][]string {
+	keys := make(map[string][]string)
+	if o.Modified == 0 {
+		// Objects stored before indexes were introduced
+		return keys
+	}
+
+	if o.FileName != "" {
+		keys[nameIndexName] = append(keys[nameIndexName], indexKey(o.FileName, o.Modified, o.Oid))
+	}
+	for key, value := range o.Meta {
+		if o.storage.IsIndexedMeta(key) {
+			keys[metaIndexName] = append(keys[metaIndexName], indexKey(metaTerm(key, value), o.Modified, o.Oid))
+		}
+	}
+
+	return keys
+}
+
+// Index context of object namespace
+func (o *RadosObj) indexIoctx() (*rados.IOContext, error) {
+	ioctx, err := GetIoctx(o.conn, o.storage.MetaPool())
+	if err != nil {
+		return nil, err
+	}
+	ioctx.SetNamespace(o.Namespace)
+
+	return ioctx, nil
+}
+
+// Register committed object in secondary indexes
+func (o *RadosObj) addToIndexes() error {
+	keys := o.indexKeys()
+	if len(keys) == 0 {
+		return nil
+	}
+
+	entry, err := json.Marshal(IndexEntry{Pool: o.Pool, Oid: o.Oid, Modified: o.Modified, TTL: o.TTL})
+	if err != nil {
+		return err
+	}
+
+	ioctx, err := o.indexIoctx()
+	if err != nil {
+		return err
+	}
+	defer ioctx.Destroy()
+
+	for index, indexKeys := range keys {
+		pairs := make(map[string][]byte)
+		for _, key := range indexKeys {
+			pairs[key] = entry
+		}
+		if err = ioctx.SetOmap(index, pairs); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Unregister deleted object from secondary indexes
+func (o *RadosObj) removeFromIndexes() error {
+	keys := o.indexKeys()
+	if len(keys) == 0 {
+		return nil
+	}
+
+	ioctx, err := o.indexIoctx()
+	if err != nil {
+		return err
+	}
+	defer ioctx.Destroy()
+
+	for index, indexKeys := range keys {
+		if err = ioctx.RmOmapKeys(index, indexKeys); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Live objects indexed by term, latest first. Only latest one unless all versions requested
+func (s *Storage) lookupIndex(namespace, index, term string, all bool) ([]IndexEntry, error) {
+	conn, err := s.NewRadosConn()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Shutdown()
+
+	ioctx, err := GetIoctx(conn, s.MetaPool())
+	if err != nil {
+		return nil, err
+	}
+	defer ioctx.Destroy()
+	ioctx.SetNamespace(namespace)
+
+	values, err := ioctx.GetOmapValues(index, "", indexTerm(term), MaxIndexVersions)
+	if err != nil {
+		// Index is not created yet
+		return nil, nil
+	}
+
+	var keys []string
+	for key := range values {
+		if isIndexKeyOf(key, term) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	now := time.Duration(time.Now().UTC().Unix())
+	var entries []IndexEntry
+	for _, key := range keys {
+		var entry IndexEntry
+		if err = json.Unmarshal(values[key], &entry); err != nil {
+			return nil, err
+		}
+		if entry.TTL < now {
+			continue
+		}
+		entries = append(entries, entry)
+		if !all {
+			break
+		}
+	}
+
+	return entries, nil
+}
+
+// Objects w/ given file name within tenant namespace, latest first
+func (s *Storage) LookupByName(namespace, filename string, all bool) ([]IndexEntry, error) {
+	return s.lookupIndex(namespace, nameIndexName, filename, all)
+}
+
+// Objects w/ given indexed metadata value within tenant namespace, latest first
+func (s *Storage) LookupByMeta(namespace, key, value string, all bool) ([]IndexEntry, error) {
+	if !s.IsIndexedMeta(key) {
+		return nil, fmt.Errorf("Metadata key '%s' is not indexed", key)
+	}
+
+	return s.lookupIndex(namespace, metaIndexName, metaTerm(key, value), all)
+}
+
+// Remove expired entries from secondary and bucket indexes of all tenant namespaces
+func (s *Storage) PruneIndexes(conn *rados.Conn) error {
+	ioctx, err := GetIoctx(conn, s.MetaPool())
+	if err != nil {
+		return err
+	}
+	defer ioctx.Destroy()
+
+	objctx, err := GetIoctx(conn, s.MetaPool())
+	if err != nil {
+		return err
+	}
+	defer objctx.Destroy()
+
+	ioctx.SetNamespace(rados.AllNamespaces)
+	iter, err := ioctx.Iter()
+	if err != nil {
+		return err
+	}
+	defer iter.Close()
+
+	now := time.Duration(time.Now().UTC().Unix())
+	for iter.Next() {
+		oid := iter.Value()
+		if !strings.HasPrefix(oid, indexNamePrefix) && !strings.HasPrefix(oid, bucketIndexPrefix) {
+			continue
+		}
+		objctx.SetNamespace(iter.Namespace())
+
+		values, err := objctx.GetAllOmapValues(oid, "", "", 1000)
+		if err != nil {
+			logger.Log.Errorf("Can't read index %s: %s", oid, err)
+			continue
+		}
+
+		var expired []string
+		for key, raw := range values {
+			var entry expiringEntry
+			if err = json.Unmarshal(raw, &entry); err == nil && entry.TTL < now {
+				expired = append(expired, key)
+			}
+		}
+		if len(expired) == 0 {
+			continue
+		}
+		if err = objctx.RmOmapKeys(oid, expired); err != nil {
+			logger.Log.Errorf("Can't prune index %s: %s", oid, err)
+			continue
+		}
+		logger.Log.Infof("Pruned %d expired entries from index %s", len(expired), oid)
+	}
+
+	return iter.Err()
+}
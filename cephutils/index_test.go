@@ -0,0 +1,47 @@
+package cephutils
+
+import (
+	"github.com/satori/go.uuid"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestIndexKey(t *testing.T) {
+	oid := uuid.FromStringOrNil("6ba7b810-9dad-11d1-80b4-00c04fd430c8")
+	terms := []string{"foo", "foobar", "foo/bar", "foo%2Fbar", "foo bar", "foo+bar", "x=1", "x=10", "отчёт.pdf"}
+
+	for _, term := range terms {
+		key := indexKey(term, 1500000000, oid)
+		if strings.Contains(key, "\x00") {
+			t.Errorf("indexKey(%q) = %q contains NUL", term, key)
+		}
+		for _, other := range terms {
+			if got := isIndexKeyOf(key, other); got != (term == other) {
+				t.Errorf("isIndexKeyOf(indexKey(%q), %q) = %v", term, other, got)
+			}
+			// Omap listing is filtered by prefix, so prefix of one term must never match another
+			if term != other && strings.HasPrefix(key, indexTerm(other)) {
+				t.Errorf("indexKey(%q) = %q has prefix of term %q", term, key, other)
+			}
+		}
+	}
+}
+
+func TestIndexKeyOrder(t *testing.T) {
+	oid := uuid.FromStringOrNil("6ba7b810-9dad-11d1-80b4-00c04fd430c8")
+	keys := []string{
+		indexKey("foo", 100, oid),
+		indexKey("foo", 300, oid),
+		indexKey("foo", 200, oid),
+	}
+	sort.Strings(keys)
+
+	want := []string{indexKey("foo", 300, oid), indexKey("foo", 200, oid), indexKey("foo", 100, oid)}
+	for i := range keys {
+		if keys[i] != want[i] {
+			t.Errorf("Versions aren't sorted latest first: %q", keys)
+			break
+		}
+	}
+}
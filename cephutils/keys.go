@@ -0,0 +1,243 @@
+package cephutils
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/GrvHldr/dfscache/logger"
+	"github.com/ceph/go-ceph/rados"
+	"github.com/satori/go.uuid"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Client-chosen object keys. Per tenant key index within meta pool maps key to object currently stored under it,
+// key itself is kept in object attribute as well. Objects stored before key index was introduced have
+// deterministic name-based UUID (v5) of key within dfscache namespace
+const (
+	keyAttrName     = "KEY"
+	keyIndexName    = indexNamePrefix + "key"
+	keysLockObjName = "dfscache.keys"
+	MaxKeyLength    = 1024
+)
+
+var keyNamespace = uuid.FromStringOrNil("8c1a4f5e-3b7d-4f2a-9e61-d5b0c2a7f943")
+
+var (
+	ErrKeyExists = errors.New("Key already exists")
+	ErrKeyLocked = errors.New("Key is locked by another operation")
+)
+
+// OID of object stored under client key before key index was introduced, also names key lock
+func KeyOid(key string) uuid.UUID {
+	return uuid.NewV5(keyNamespace, key)
+}
+
+// Check client key: up to MaxKeyLength bytes of UTF-8 w/o control characters
+func ValidateKey(key string) error {
+	if key == "" || len(key) > MaxKeyLength {
+		return fmt.Errorf("Key length must be within 1..%d", MaxKeyLength)
+	}
+	if !utf8.ValidString(key) {
+		return fmt.Errorf("Key must be UTF-8 encoded")
+	}
+	if strings.IndexFunc(key, func(r rune) bool { return r < 0x20 || r == 0x7f }) >= 0 {
+		return fmt.Errorf("Key must not contain control characters")
+	}
+
+	return nil
+}
+
+// Current object under client key within tenant namespace, nil if there's none
+func readKeyEntry(ioctx *rados.IOContext, key string) (*IndexEntry, error) {
+	// Omap filter is prefix match, exact key is the first one of matching keys
+	values, err := ioctx.GetOmapValues(keyIndexName, "", key, 1)
+	if err != nil {
+		// Index is not created yet
+		return nil, nil
+	}
+	raw, ok := values[key]
+	if !ok {
+		return nil, nil
+	}
+
+	entry := new(IndexEntry)
+	if err = json.Unmarshal(raw, entry); err != nil {
+		return nil, err
+	}
+
+	return entry, nil
+}
+
+// Object stored under client key within tenant namespace
+func (s *Storage) KeyedRadosObj(namespace, key string) (*RadosObj, error) {
+	conn, err := s.NewRadosConn()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Shutdown()
+
+	ioctx, err := GetIoctx(conn, s.MetaPool())
+	if err != nil {
+		return nil, err
+	}
+	defer ioctx.Destroy()
+	ioctx.SetNamespace(namespace)
+
+	entry, err := readKeyEntry(ioctx, key)
+	if err != nil {
+		return nil, err
+	}
+	if entry == nil {
+		// Objects stored before key index was introduced
+		return s.FindRadosObj(namespace, KeyOid(key))
+	}
+
+	return s.ExistingRadosObj(entry.Pool, namespace, entry.Oid)
+}
+
+// Upload under client key. Content is written to object of its own and key is switched to it once upload
+// is finished, so object previously stored under key stays intact until then
+type KeyedUpload struct {
+	*RadosObj
+	overwrite  bool
+	canReplace func(existing *RadosObj) error
+}
+
+// Start upload of given length under client key. Existing object may be replaced if overwrite is allowed
+// and canReplace accepts it, ErrKeyExists is returned otherwise. Both are checked under keys lock now
+// and once again on finish. Unfinished upload expires after timeout
+func (s *Storage) NewKeyedRadosObj(opts ObjOptions, length uint64, overwrite bool, canReplace func(existing *RadosObj) error, timeout time.Duration) (*KeyedUpload, error) {
+	if err := ValidateKey(opts.Key); err != nil {
+		return nil, err
+	}
+	opts.NoPacking = true
+
+	obj, err := s.NewRadosObj(opts)
+	if err != nil {
+		return nil, err
+	}
+	u := &KeyedUpload{RadosObj: obj, overwrite: overwrite, canReplace: canReplace}
+
+	err = u.withKeyLock(func(ioctx *rados.IOContext) error {
+		existing, err := u.replaceable(ioctx)
+		if existing != nil {
+			existing.Destroy()
+		}
+		return err
+	})
+	if err != nil {
+		obj.Destroy()
+		return nil, err
+	}
+
+	if err = obj.StartResumable(length, timeout); err != nil {
+		obj.Destroy()
+		return nil, err
+	}
+
+	return u, nil
+}
+
+// Run f under lock of upload key
+func (u *KeyedUpload) withKeyLock(f func(ioctx *rados.IOContext) error) error {
+	ioctx, err := u.indexIoctx()
+	if err != nil {
+		return err
+	}
+	defer ioctx.Destroy()
+
+	lockName := KeyOid(u.Key).String()
+	cookie, err := lockObject(ioctx, keysLockObjName, lockName)
+	if err != nil {
+		return ErrKeyLocked
+	}
+	defer unlockObject(ioctx, keysLockObjName, lockName, cookie)
+
+	return f(ioctx)
+}
+
+// Live object currently under upload key, if any, and error if it may not be replaced. Keys lock must be held
+func (u *KeyedUpload) replaceable(ioctx *rados.IOContext) (*RadosObj, error) {
+	var existing *RadosObj
+	entry, err := readKeyEntry(ioctx, u.Key)
+	if err != nil {
+		return nil, err
+	}
+	if entry != nil {
+		existing, err = u.storage.ExistingRadosObj(entry.Pool, u.Namespace, entry.Oid)
+	} else {
+		existing, err = u.storage.FindRadosObj(u.Namespace, KeyOid(u.Key))
+	}
+	if err != nil {
+		// Key is free
+		return nil, nil
+	}
+
+	if existing.TTL < time.Duration(time.Now().UTC().Unix()) || existing.IsPartial() {
+		// Expired, or unfinished upload of the time before key index
+		return existing, nil
+	}
+	if !u.overwrite {
+		return existing, ErrKeyExists
+	}
+	if u.canReplace != nil {
+		if err = u.canReplace(existing); err != nil {
+			return existing, err
+		}
+	}
+
+	return existing, nil
+}
+
+// Finish upload and switch key to uploaded object, object previously stored under key is deleted.
+// Uploaded object is deleted if key may not be switched anymore
+func (u *KeyedUpload) Finish(ttl time.Duration) error {
+	err := u.withKeyLock(func(ioctx *rados.IOContext) error {
+		existing, err := u.replaceable(ioctx)
+		if existing != nil {
+			defer existing.Destroy()
+		}
+		if err != nil {
+			return err
+		}
+
+		if err = u.FinishResumable(ttl); err != nil {
+			return err
+		}
+		entry, err := json.Marshal(IndexEntry{Pool: u.Pool, Oid: u.Oid, Modified: u.Modified, TTL: u.TTL})
+		if err != nil {
+			return err
+		}
+		if err = ioctx.SetOmap(keyIndexName, map[string][]byte{u.Key: entry}); err != nil {
+			return err
+		}
+
+		// Key is switched already, object being read is left to expire
+		if existing != nil {
+			existing.Key = ""
+			if err = existing.Delete(); err != nil {
+				logger.Log.Errorf("Can't delete replaced object %s: %s", existing.Oid, err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		u.Delete()
+	}
+
+	return err
+}
+
+// Remove key index entry of deleted object, unless key is switched to other object already
+func (o *RadosObj) releaseKey() error {
+	u := &KeyedUpload{RadosObj: o}
+	return u.withKeyLock(func(ioctx *rados.IOContext) error {
+		entry, err := readKeyEntry(ioctx, o.Key)
+		if err != nil || entry == nil || entry.Oid != o.Oid {
+			return err
+		}
+		return ioctx.RmOmapKeys(keyIndexName, []string{o.Key})
+	})
+}
@@ -0,0 +1,42 @@
+package cephutils
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateKey(t *testing.T) {
+	tests := []struct {
+		key string
+		ok  bool
+	}{
+		{"builds/main/app.tar.gz", true},
+		{"отчёт 2017.pdf", true},
+		{strings.Repeat("k", MaxKeyLength), true},
+		{"", false},
+		{strings.Repeat("k", MaxKeyLength+1), false},
+		{"bad\xffutf8", false},
+		{"line\nbreak", false},
+		{"tab\tkey", false},
+		{"del\x7f", false},
+	}
+
+	for _, tt := range tests {
+		if err := ValidateKey(tt.key); (err == nil) != tt.ok {
+			t.Errorf("ValidateKey(%q) = %v", tt.key, err)
+		}
+	}
+}
+
+func TestKeyOid(t *testing.T) {
+	a, b := KeyOid("builds/app.tar.gz"), KeyOid("builds/app.tar.gz")
+	if a != b {
+		t.Errorf("KeyOid is not stable: %s != %s", a, b)
+	}
+	if a.Version() != 5 {
+		t.Errorf("KeyOid version = %d, want 5", a.Version())
+	}
+	if KeyOid("builds/app.tar") == a {
+		t.Error("KeyOid of different keys collide")
+	}
+}
@@ -0,0 +1,306 @@
+package cephutils
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"github.com/ceph/go-ceph/rados"
+	"github.com/satori/go.uuid"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Objects listing. Listing cursor keeps pool, RADOS listing position (PG hash) and number of entries
+// already passed at that position, so listing may be continued by any instance
+const packListBatch = 100
+
+var ErrInvalidCursor = errors.New("Invalid cursor")
+
+type ListFilter struct {
+	Prefix        string        // File name prefix
+	ExpiresAfter  time.Duration // Expiration window, unix seconds, 0 if not limited
+	ExpiresBefore time.Duration
+	MetaKey       string                     // Metadata key objects must have
+	MetaValue     string                     // Metadata value, empty for any
+	Access        func(o *BaseRadosObj) bool // Access check, nil if not restricted
+}
+
+type listCursor struct {
+	Pool      string `json:"p"`
+	Token     uint32 `json:"t"`
+	Skip      int    `json:"s"`
+	PackAfter string `json:"k,omitempty"` // Last listed packed object
+}
+
+func (f *ListFilter) match(o *BaseRadosObj) bool {
+	if f.Prefix != "" && !strings.HasPrefix(o.FileName, f.Prefix) {
+		return false
+	}
+	if f.ExpiresAfter > 0 && o.TTL < f.ExpiresAfter {
+		return false
+	}
+	if f.ExpiresBefore > 0 && o.TTL > f.ExpiresBefore {
+		return false
+	}
+	if f.MetaKey != "" {
+		value, ok := o.Meta[f.MetaKey]
+		if !ok || (f.MetaValue != "" && value != f.MetaValue) {
+			return false
+		}
+	}
+	if f.Access != nil && !f.Access(o) {
+		return false
+	}
+
+	return true
+}
+
+func decodeCursor(s string) (*listCursor, error) {
+	c := new(listCursor)
+	if s == "" {
+		return c, nil
+	}
+
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	if err = json.Unmarshal(raw, c); err != nil {
+		return nil, ErrInvalidCursor
+	}
+
+	return c, nil
+}
+
+func (c *listCursor) encode() string {
+	raw, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(raw)
+}
+
+// Pools of all placement classes existing in cluster, in listing order
+func (s *Storage) cachePools(conn *rados.Conn) ([]string, error) {
+	pools, err := conn.ListPools()
+	if err != nil {
+		return nil, err
+	}
+
+	var result []string
+	for _, pool := range pools {
+		if s.IsCachePool(pool) && pool != s.MetaPool() {
+			result = append(result, pool)
+		}
+	}
+	sort.Strings(result)
+
+	return result, nil
+}
+
+// List up to limit live objects of namespace within pool, or all dfscache pools if pool is empty.
+// Returns next page cursor, empty when listing is finished
+func (s *Storage) ListObjects(namespace, pool string, filter ListFilter, cursor string, limit int) ([]BaseRadosObj, string, error) {
+	cur, err := decodeCursor(cursor)
+	if err != nil {
+		return nil, "", err
+	}
+
+	conn, err := s.NewRadosConn()
+	if err != nil {
+		return nil, "", err
+	}
+	defer conn.Shutdown()
+
+	pools := []string{pool}
+	if pool == "" {
+		if pools, err = s.cachePools(conn); err != nil {
+			return nil, "", err
+		}
+	}
+
+	start := 0
+	if cur.Pool != "" {
+		start = sort.SearchStrings(pools, cur.Pool)
+		if start == len(pools) || pools[start] != cur.Pool {
+			return nil, "", ErrInvalidCursor
+		}
+	}
+
+	var result []BaseRadosObj
+	for _, p := range pools[start:] {
+		c := &listCursor{Pool: p}
+		if p == cur.Pool {
+			c = cur
+		}
+		more, err := listPool(conn, namespace, c, &filter, limit, &result)
+		if err != nil {
+			return nil, "", err
+		}
+		if more {
+			return result, c.encode(), nil
+		}
+	}
+
+	return result, "", nil
+}
+
+// List pool objects from cursor position. Returns true and updates cursor if limit is reached
+func listPool(conn *rados.Conn, namespace string, c *listCursor, filter *ListFilter, limit int, result *[]BaseRadosObj) (bool, error) {
+	ioctx, err := conn.OpenIOContext(c.Pool)
+	if err != nil {
+		return false, err
+	}
+	defer ioctx.Destroy()
+	ioctx.SetNamespace(namespace)
+
+	iter, err := ioctx.Iter()
+	if err != nil {
+		return false, err
+	}
+	defer iter.Close()
+
+	token, skip, seen := c.Token, c.Skip, 0
+	if token != 0 || skip != 0 {
+		iter.Seek(rados.IterToken(token))
+	}
+
+	for iter.Next() {
+		if t := uint32(iter.Token()); t != token {
+			token, skip, seen = t, 0, 0
+		}
+		if seen < skip {
+			seen++
+			continue
+		}
+
+		oid := iter.Value()
+		if oid == packIndexName {
+			more, err := listPacked(ioctx, namespace, c, filter, limit, result)
+			if err != nil {
+				return false, err
+			}
+			if more {
+				c.Token, c.Skip = token, seen
+				return true, nil
+			}
+			c.PackAfter = ""
+		} else if obj := listedObj(ioctx, c.Pool, namespace, oid); obj != nil && filter.match(obj) {
+			if len(*result) == limit {
+				c.Token, c.Skip = token, seen
+				return true, nil
+			}
+			*result = append(*result, *obj)
+		}
+		seen++
+	}
+
+	return false, iter.Err()
+}
+
+// Description of live standalone object, nil for internal objects and unfinished or expired uploads
+func listedObj(ioctx *rados.IOContext, pool, namespace, oid string) *BaseRadosObj {
+	if IsPackObject(oid) || IsPartObject(oid) {
+		return nil
+	}
+	id, err := uuid.FromString(oid)
+	if err != nil {
+		return nil
+	}
+
+	attrs, err := ioctx.ListXattrs(oid)
+	if err != nil {
+		return nil
+	}
+	if _, ok := attrs[uploadLengthAttrName]; ok {
+		return nil
+	}
+	if _, ok := attrs[multipartAttrName]; ok {
+		return nil
+	}
+	ttl, ok := attrs[ttlAttrName]
+	if !ok || len(ttl) < 8 {
+		return nil
+	}
+
+	obj := &BaseRadosObj{
+		Pool:      pool,
+		Oid:       id,
+		Key:       string(attrs[keyAttrName]),
+		TTL:       time.Duration(binary.LittleEndian.Uint64(ttl)),
+		FileName:  string(attrs[fnameArrtName]),
+		Placement: string(attrs[placementAttrName]),
+		Checksum:  string(attrs[checksumAttrName]),
+		Meta:      metaFromAttrs(attrs),
+		Owner:     string(attrs[ownerAttrName]),
+		ACL:       string(attrs[aclAttrName]),
+		Namespace: namespace,
+	}
+	if obj.TTL < time.Duration(time.Now().UTC().Unix()) {
+		// Expired, to be removed by GC
+		return nil
+	}
+	if obj.Placement == "" {
+		obj.Placement = DefaultPlacement
+	}
+	if mtime, ok := attrs[modifiedAttrName]; ok && len(mtime) == 8 {
+		obj.Modified = int64(binary.LittleEndian.Uint64(mtime))
+	}
+
+	if manifest, ok := attrs[manifestAttrName]; ok && len(manifest) == 8 {
+		obj.Size = binary.LittleEndian.Uint64(manifest)
+	} else if stat, err := ioctx.Stat(oid); err == nil {
+		obj.Size = stat.Size
+	} else {
+		return nil
+	}
+
+	return obj
+}
+
+// List live packed objects of pool after cursor packed object. Returns true and updates cursor if limit is reached
+func listPacked(ioctx *rados.IOContext, namespace string, c *listCursor, filter *ListFilter, limit int, result *[]BaseRadosObj) (bool, error) {
+	now := time.Duration(time.Now().UTC().Unix())
+	for {
+		index, err := ioctx.GetOmapValues(packIndexName, c.PackAfter, "", packListBatch)
+		if err != nil {
+			return false, err
+		}
+		if len(index) == 0 {
+			return false, nil
+		}
+
+		var oids []string
+		for oid := range index {
+			oids = append(oids, oid)
+		}
+		sort.Strings(oids)
+
+		for _, oid := range oids {
+			_, entry, err := findPacked(ioctx, oid)
+			id, ierr := uuid.FromString(oid)
+			if err == nil && ierr == nil && entry.TTL >= now {
+				obj := &BaseRadosObj{
+					Pool:      c.Pool,
+					Oid:       id,
+					Size:      entry.Length,
+					TTL:       entry.TTL,
+					FileName:  entry.FileName,
+					Placement: entry.Placement,
+					Checksum:  entry.Checksum,
+					Modified:  entry.Modified,
+					Meta:      entry.Meta,
+					Owner:     entry.Owner,
+					ACL:       entry.ACL,
+					Namespace: namespace,
+				}
+				if filter.match(obj) {
+					if len(*result) == limit {
+						return true, nil
+					}
+					*result = append(*result, *obj)
+				}
+			}
+			c.PackAfter = oid
+		}
+	}
+}
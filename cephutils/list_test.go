@@ -0,0 +1,63 @@
+package cephutils
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestListCursor(t *testing.T) {
+	cursors := []*listCursor{
+		{},
+		{Pool: "dfscache.small.1", Token: 42, Skip: 3},
+		{Pool: "dfscache.large.2", Token: 0xffffffff, PackAfter: "6ba7b810-9dad-11d1-80b4-00c04fd430c8"},
+	}
+
+	for _, c := range cursors {
+		got, err := decodeCursor(c.encode())
+		if err != nil {
+			t.Errorf("decodeCursor(%+v) error = %s", c, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, c) {
+			t.Errorf("decodeCursor = %+v, want %+v", got, c)
+		}
+	}
+
+	if c, err := decodeCursor(""); err != nil || !reflect.DeepEqual(c, &listCursor{}) {
+		t.Errorf("Empty cursor = %+v, %v, want listing start", c, err)
+	}
+	for _, s := range []string{"not base64!", "bm90IGpzb24", "eyJ0IjotMX0"} {
+		if _, err := decodeCursor(s); err != ErrInvalidCursor {
+			t.Errorf("decodeCursor(%q) error = %v, want %v", s, err, ErrInvalidCursor)
+		}
+	}
+}
+
+func TestListFilterMatch(t *testing.T) {
+	o := &BaseRadosObj{FileName: "build-42.tar", TTL: 1000, Meta: map[string]string{"branch": "main"}}
+
+	tests := []struct {
+		name   string
+		filter ListFilter
+		want   bool
+	}{
+		{"no filter", ListFilter{}, true},
+		{"prefix", ListFilter{Prefix: "build-"}, true},
+		{"other prefix", ListFilter{Prefix: "test-"}, false},
+		{"expires after", ListFilter{ExpiresAfter: 500}, true},
+		{"expires too early", ListFilter{ExpiresAfter: 2000}, false},
+		{"expires before", ListFilter{ExpiresBefore: 2000}, true},
+		{"expires too late", ListFilter{ExpiresBefore: 500}, false},
+		{"meta key", ListFilter{MetaKey: "branch"}, true},
+		{"meta value", ListFilter{MetaKey: "branch", MetaValue: "main"}, true},
+		{"other meta value", ListFilter{MetaKey: "branch", MetaValue: "dev"}, false},
+		{"missing meta key", ListFilter{MetaKey: "commit"}, false},
+		{"access denied", ListFilter{Access: func(*BaseRadosObj) bool { return false }}, false},
+	}
+
+	for _, tt := range tests {
+		if got := tt.filter.match(o); got != tt.want {
+			t.Errorf("%s: match = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
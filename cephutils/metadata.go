@@ -0,0 +1,78 @@
+package cephutils
+
+import (
+	"fmt"
+	"strings"
+)
+
+// User metadata, stored as "META.<key>" object attributes
+const (
+	metaAttrPrefix  = "META."
+	MaxMetaKeys     = 32
+	MaxMetaKeyLen   = 64
+	MaxMetaValueLen = 1024
+)
+
+// Check user metadata keys and values. Keys are lowercase letters, digits, '-' and '_'
+func ValidateMeta(meta map[string]string) error {
+	if len(meta) > MaxMetaKeys {
+		return fmt.Errorf("Too many metadata keys, max %d", MaxMetaKeys)
+	}
+
+	for key, value := range meta {
+		if key == "" || len(key) > MaxMetaKeyLen {
+			return fmt.Errorf("Invalid metadata key '%s'", key)
+		}
+		for _, c := range key {
+			if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+				return fmt.Errorf("Invalid metadata key '%s'", key)
+			}
+		}
+		if len(value) > MaxMetaValueLen {
+			return fmt.Errorf("Metadata value of '%s' is too long", key)
+		}
+	}
+
+	return nil
+}
+
+// Save user metadata attributes
+func (o *RadosObj) syncMeta() error {
+	for key, value := range o.Meta {
+		if err := o.ioctx.SetXattr(o.Oid.String(), metaAttrPrefix+key, []byte(value)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// User metadata from object attributes
+func metaFromAttrs(attrs map[string][]byte) map[string]string {
+	var meta map[string]string
+	for name, value := range attrs {
+		if !strings.HasPrefix(name, metaAttrPrefix) {
+			continue
+		}
+		if meta == nil {
+			meta = make(map[string]string)
+		}
+		meta[strings.TrimPrefix(name, metaAttrPrefix)] = string(value)
+	}
+
+	return meta
+}
+
+// Load user metadata, client key and ownership attributes
+func (o *RadosObj) loadMeta() error {
+	attrs, err := o.ioctx.ListXattrs(o.Oid.String())
+	if err != nil {
+		return err
+	}
+	o.Meta = metaFromAttrs(attrs)
+	o.Key = string(attrs[keyAttrName])
+	o.Owner = string(attrs[ownerAttrName])
+	o.ACL = string(attrs[aclAttrName])
+
+	return nil
+}
@@ -0,0 +1,386 @@
+package cephutils
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/ceph/go-ceph/rados"
+	"io"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Multipart uploads.
+// Parts are stored as separate Rados objects "<oid>.part.<number>" next to manifest object <oid>.
+// Manifest omap keeps uploaded parts, manifest object is assembled logically from parts on read.
+const (
+	multipartAttrName = "MULTIPART" // Upload is not completed yet
+	manifestAttrName  = "MANIFEST"  // Completed upload, holds total size
+	partNameInfix     = ".part."
+	MaxPartNumber     = 10000
+)
+
+type partInfo struct {
+	Size uint64 `json:"size"`
+	ETag string `json:"etag"`
+}
+
+// Part of completed multipart object
+type manifestPart struct {
+	name   string
+	offset uint64
+	size   uint64
+}
+
+// Part listed by client to complete multipart upload
+type CompletedPart struct {
+	Number int    `json:"part"`
+	ETag   string `json:"etag"`
+}
+
+func partName(oid string, number int) string {
+	return fmt.Sprintf("%s%s%05d", oid, partNameInfix, number)
+}
+
+func partKey(number int) string {
+	return fmt.Sprintf("%05d", number)
+}
+
+// Check if oid is multipart upload part
+func IsPartObject(oid string) bool {
+	return strings.Contains(oid, partNameInfix)
+}
+
+// Check if oid is unfinished resumable or multipart upload, or part of the latter.
+// Usage accounts such uploads once they are completed
+func IsPendingUpload(ioctx *rados.IOContext, oid string) bool {
+	isPart := IsPartObject(oid)
+	if isPart {
+		oid = oid[:strings.Index(oid, partNameInfix)]
+	}
+
+	attrs, err := ioctx.ListXattrs(oid)
+	if err != nil {
+		// Part of missing manifest is leftover of aborted upload
+		return isPart
+	}
+	_, resumable := attrs[uploadLengthAttrName]
+	_, multipart := attrs[multipartAttrName]
+
+	return resumable || multipart
+}
+
+// Check if object is multipart upload which is not completed yet
+func (o *RadosObj) IsMultipartPending() bool {
+	return o.multipartPending
+}
+
+// Create manifest object for new multipart upload, incomplete upload expires after timeout
+func (o *RadosObj) StartMultipart(timeout time.Duration) error {
+	oid := o.Oid.String()
+	if err := o.ioctx.WriteFull(oid, []byte{}); err != nil {
+		return err
+	}
+
+	o.TTL = time.Duration(time.Now().UTC().Add(timeout).Unix())
+	if err := o.SyncAttributes(); err != nil {
+		return err
+	}
+
+	if err := o.ioctx.SetXattr(oid, multipartAttrName, []byte{1}); err != nil {
+		return err
+	}
+	o.multipartPending = true
+
+	return nil
+}
+
+// Set object expiration attribute
+func setObjTTL(ioctx *rados.IOContext, oid string, ttl time.Duration) error {
+	buf := make([]byte, 10)
+	binary.LittleEndian.PutUint64(buf, uint64(ttl))
+
+	return ioctx.SetXattr(oid, ttlAttrName, buf)
+}
+
+// Store upload part, part uploaded again replaces previous one. Returns part size and ETag (MD5)
+func (o *RadosObj) WritePart(number int, rd io.Reader) (uint64, string, error) {
+	if number < 1 || number > MaxPartNumber {
+		return 0, "", fmt.Errorf("Part number must be within 1..%d", MaxPartNumber)
+	}
+
+	name := partName(o.Oid.String(), number)
+	size, etag, err := o.writePart(name, rd)
+	if err != nil {
+		// Partially written part would never expire
+		o.ioctx.Delete(name)
+		return 0, "", err
+	}
+
+	info, err := json.Marshal(partInfo{Size: size, ETag: etag})
+	if err != nil {
+		return 0, "", err
+	}
+	if err = o.ioctx.SetOmap(o.Oid.String(), map[string][]byte{partKey(number): info}); err != nil {
+		return 0, "", err
+	}
+
+	return size, etag, nil
+}
+
+// Stream part data into Rados object
+func (o *RadosObj) writePart(name string, rd io.Reader) (uint64, string, error) {
+	hash := md5.New()
+	buf := make([]byte, o.storage.opts.RW_BUFFER_SIZE)
+	var size uint64
+	for {
+		n, rerr := io.ReadFull(rd, buf)
+		if n > 0 || size == 0 {
+			var err error
+			if size == 0 {
+				err = o.ioctx.WriteFull(name, buf[:n])
+			} else {
+				err = o.ioctx.Write(name, buf[:n], size)
+			}
+			if err != nil {
+				return 0, "", err
+			}
+			hash.Write(buf[:n])
+			size += uint64(n)
+		}
+		if rerr == io.EOF || rerr == io.ErrUnexpectedEOF {
+			break
+		}
+		if rerr != nil {
+			return 0, "", rerr
+		}
+	}
+
+	// Part expires along with incomplete upload
+	if err := setObjTTL(o.ioctx, name, o.TTL); err != nil {
+		return 0, "", err
+	}
+
+	return size, hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// Uploaded parts of multipart upload
+func (o *RadosObj) uploadedParts() (map[int]partInfo, error) {
+	values, err := o.ioctx.GetAllOmapValues(o.Oid.String(), "", "", 1000)
+	if err != nil {
+		return nil, err
+	}
+
+	parts := make(map[int]partInfo)
+	for key, raw := range values {
+		var number int
+		if _, err = fmt.Sscanf(key, "%d", &number); err != nil {
+			continue
+		}
+		var info partInfo
+		if err = json.Unmarshal(raw, &info); err != nil {
+			return nil, err
+		}
+		parts[number] = info
+	}
+
+	return parts, nil
+}
+
+// Total size of uploaded parts but given one, which is replaced by its new upload
+func (o *RadosObj) PendingPartsSize(except int) (uint64, error) {
+	uploaded, err := o.uploadedParts()
+	if err != nil {
+		return 0, err
+	}
+
+	var total uint64
+	for number, info := range uploaded {
+		if number != except {
+			total += info.Size
+		}
+	}
+
+	return total, nil
+}
+
+// Total size of parts listed by client, validating them against uploaded ones
+func (o *RadosObj) MultipartSize(list []CompletedPart) (uint64, error) {
+	if len(list) == 0 {
+		return 0, fmt.Errorf("No parts listed")
+	}
+
+	uploaded, err := o.uploadedParts()
+	if err != nil {
+		return 0, err
+	}
+
+	var total uint64
+	for i, p := range list {
+		if i > 0 && p.Number <= list[i-1].Number {
+			return 0, fmt.Errorf("Parts must be listed in ascending order")
+		}
+		info, ok := uploaded[p.Number]
+		if !ok {
+			return 0, fmt.Errorf("Part %d is not uploaded", p.Number)
+		}
+		if p.ETag != "" && strings.Trim(p.ETag, `"`) != info.ETag {
+			return 0, fmt.Errorf("Part %d ETag mismatch", p.Number)
+		}
+		total += info.Size
+	}
+
+	return total, nil
+}
+
+// Complete multipart upload: object is assembled from listed parts, other uploaded parts are discarded.
+// Object gets its lifetime (0 for CEPH_OPTIONS.OBJECT_TTL) and becomes available
+func (o *RadosObj) CompleteMultipart(list []CompletedPart, ttl time.Duration) error {
+	total, err := o.MultipartSize(list)
+	if err != nil {
+		return err
+	}
+
+	uploaded, err := o.uploadedParts()
+	if err != nil {
+		return err
+	}
+
+	oid := o.Oid.String()
+	o.TTL = o.storage.expiration(ttl)
+	listed := make(map[int]bool)
+	var offset uint64
+	var sums []string
+	o.parts = nil
+	for _, p := range list {
+		listed[p.Number] = true
+		sums = append(sums, uploaded[p.Number].ETag)
+		name := partName(oid, p.Number)
+		if err = setObjTTL(o.ioctx, name, o.TTL); err != nil {
+			return err
+		}
+		o.parts = append(o.parts, manifestPart{name: name, offset: offset, size: uploaded[p.Number].Size})
+		offset += uploaded[p.Number].Size
+	}
+
+	var unlisted []string
+	for number := range uploaded {
+		if !listed[number] {
+			o.ioctx.Delete(partName(oid, number))
+			unlisted = append(unlisted, partKey(number))
+		}
+	}
+	if len(unlisted) > 0 {
+		if err = o.ioctx.RmOmapKeys(oid, unlisted); err != nil {
+			return err
+		}
+	}
+
+	buf := make([]byte, 8)
+	binary.LittleEndian.PutUint64(buf, total)
+	if err = o.ioctx.SetXattr(oid, manifestAttrName, buf); err != nil {
+		return err
+	}
+
+	o.Size = total
+	o.Checksum = multipartChecksum(sums)
+	if err = o.Commit(); err != nil {
+		return err
+	}
+
+	if err = o.ioctx.RmXattr(oid, multipartAttrName); err != nil {
+		return err
+	}
+	o.multipartPending = false
+
+	return nil
+}
+
+// Delete all uploaded parts of object
+func (o *RadosObj) deleteParts() error {
+	uploaded, err := o.uploadedParts()
+	if err != nil {
+		return err
+	}
+
+	for number := range uploaded {
+		if err = o.ioctx.Delete(partName(o.Oid.String(), number)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Load multipart upload state of existing object
+func (o *RadosObj) loadMultipart() error {
+	oid := o.Oid.String()
+	buf := make([]byte, 8)
+	if _, err := o.ioctx.GetXattr(oid, multipartAttrName, buf); err == nil {
+		o.multipartPending = true
+		return nil
+	}
+
+	if _, err := o.ioctx.GetXattr(oid, manifestAttrName, buf); err != nil {
+		// Regular object
+		return nil
+	}
+	o.Size = binary.LittleEndian.Uint64(buf)
+
+	uploaded, err := o.uploadedParts()
+	if err != nil {
+		return err
+	}
+
+	var numbers []int
+	for number := range uploaded {
+		numbers = append(numbers, number)
+	}
+	sort.Ints(numbers)
+
+	var offset uint64
+	for _, number := range numbers {
+		size := uploaded[number].Size
+		o.parts = append(o.parts, manifestPart{name: partName(oid, number), offset: offset, size: size})
+		offset += size
+	}
+
+	return nil
+}
+
+// ReaderAt implementation for object assembled from parts
+func (o *RadosObj) readParts(p []byte, off int64) (n int, err error) {
+	pos := uint64(off)
+	for _, part := range o.parts {
+		if n == len(p) {
+			break
+		}
+		if pos >= part.offset+part.size {
+			continue
+		}
+
+		chunk := p[n:]
+		if left := part.offset + part.size - pos; uint64(len(chunk)) > left {
+			chunk = chunk[:left]
+		}
+		read, err := o.ioctx.Read(part.name, chunk, pos-part.offset)
+		n += read
+		pos += uint64(read)
+		if err != nil {
+			return n, err
+		}
+		if read < len(chunk) {
+			// Part is shorter than expected
+			return n, io.ErrUnexpectedEOF
+		}
+	}
+
+	if n < len(p) {
+		err = io.EOF
+	}
+
+	return
+}
@@ -0,0 +1,314 @@
+package cephutils
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/GrvHldr/dfscache/logger"
+	"github.com/ceph/go-ceph/rados"
+	"github.com/satori/go.uuid"
+	"strings"
+	"time"
+)
+
+// Small objects packing.
+// Objects under CEPH_OPTIONS.PACK_THRESHOLD are appended into shared pack objects of the same pool.
+// Every pack keeps omap index oid -> packEntry, pool wide index object maps oid -> pack name.
+const (
+	packIndexName   = "dfscache.packs"
+	packNamePrefix  = "dfscache.pack."
+	packCurrentAttr = "CURRENT"
+	packLockName    = "packlock"
+)
+
+type packEntry struct {
+	Offset    uint64            `json:"offset"`
+	Length    uint64            `json:"length"`
+	TTL       time.Duration     `json:"ttl"`
+	FileName  string            `json:"file_name"`
+	Placement string            `json:"placement"`
+	Checksum  string            `json:"checksum"`
+	Modified  int64             `json:"modified"`
+	Meta      map[string]string `json:"meta,omitempty"`
+	Owner     string            `json:"owner,omitempty"`
+	ACL       string            `json:"acl,omitempty"`
+}
+
+// Check if object of declared size should be packed
+func (s *Storage) packable(size uint64) bool {
+	threshold := s.opts.PACK_THRESHOLD
+	return threshold > 0 && size > 0 && size <= threshold
+}
+
+// Check if oid is internal packing object
+func IsPackObject(oid string) bool {
+	return oid == packIndexName || strings.HasPrefix(oid, packNamePrefix)
+}
+
+// Take pool wide packing lock
+func lockPacks(ioctx *rados.IOContext) (string, error) {
+	return lockObject(ioctx, packIndexName, packLockName)
+}
+
+// Release pool wide packing lock
+func unlockPacks(ioctx *rados.IOContext, cookie string) {
+	unlockObject(ioctx, packIndexName, packLockName, cookie)
+}
+
+// Current pack name to append to, rolls new pack if current is full
+func (s *Storage) currentPack(ioctx *rados.IOContext, length uint64) (string, uint64, error) {
+	buf := make([]byte, 255)
+	n, err := ioctx.GetXattr(packIndexName, packCurrentAttr, buf)
+	if err == nil && n > 0 {
+		pack := string(buf[:n])
+		stat, err := ioctx.Stat(pack)
+		if err == nil && stat.Size+length <= s.opts.PACK_MAX_SIZE {
+			return pack, stat.Size, nil
+		}
+	}
+
+	pack := packNamePrefix + uuid.NewV4().String()
+	if err = ioctx.SetXattr(packIndexName, packCurrentAttr, []byte(pack)); err != nil {
+		return "", 0, err
+	}
+
+	return pack, 0, nil
+}
+
+// Append buffered object data into pack and register it in indexes
+func (o *RadosObj) commitPack() error {
+	cookie, err := lockPacks(o.ioctx)
+	if err != nil {
+		return err
+	}
+	defer unlockPacks(o.ioctx, cookie)
+
+	data := o.packBuf.Bytes()
+	pack, offset, err := o.storage.currentPack(o.ioctx, uint64(len(data)))
+	if err != nil {
+		return err
+	}
+
+	if err = o.ioctx.Append(pack, data); err != nil {
+		return err
+	}
+
+	entry, err := json.Marshal(packEntry{
+		Offset:    offset,
+		Length:    uint64(len(data)),
+		TTL:       o.TTL,
+		FileName:  o.FileName,
+		Placement: o.Placement,
+		Checksum:  o.Checksum,
+		Modified:  o.Modified,
+		Meta:      o.Meta,
+		Owner:     o.Owner,
+		ACL:       o.ACL,
+	})
+	if err != nil {
+		return err
+	}
+
+	oid := o.Oid.String()
+	if err = o.ioctx.SetOmap(pack, map[string][]byte{oid: entry}); err != nil {
+		return err
+	}
+	if err = o.ioctx.SetOmap(packIndexName, map[string][]byte{oid: []byte(pack)}); err != nil {
+		return err
+	}
+
+	o.pack, o.packOffset = pack, offset
+	o.packBuf.Reset()
+
+	return nil
+}
+
+// Move buffered data to standalone Rados object when it outgrows packing threshold
+func (o *RadosObj) unpack() error {
+	o.packed = false
+	if o.packBuf.Len() == 0 {
+		return nil
+	}
+
+	if err := o.ioctx.WriteFull(o.Oid.String(), o.packBuf.Bytes()); err != nil {
+		return err
+	}
+	o.bytesWritten = uint64(o.packBuf.Len())
+	o.packBuf.Reset()
+
+	return nil
+}
+
+// Look up packed object entry
+func findPacked(ioctx *rados.IOContext, oid string) (string, *packEntry, error) {
+	index, err := ioctx.GetOmapValues(packIndexName, "", oid, 1)
+	if err != nil {
+		return "", nil, err
+	}
+	pack, ok := index[oid]
+	if !ok {
+		return "", nil, fmt.Errorf("Object %s not found", oid)
+	}
+
+	entries, err := ioctx.GetOmapValues(string(pack), "", oid, 1)
+	if err != nil {
+		return "", nil, err
+	}
+	raw, ok := entries[oid]
+	if !ok {
+		return "", nil, fmt.Errorf("Object %s not found in pack %s", oid, pack)
+	}
+
+	entry := new(packEntry)
+	if err = json.Unmarshal(raw, entry); err != nil {
+		return "", nil, err
+	}
+
+	return string(pack), entry, nil
+}
+
+// Unregister packed object. Space is reclaimed by compaction
+func (o *RadosObj) deletePacked() error {
+	cookie, err := lockPacks(o.ioctx)
+	if err != nil {
+		return err
+	}
+	defer unlockPacks(o.ioctx, cookie)
+
+	oid := o.Oid.String()
+	if err = o.ioctx.RmOmapKeys(o.pack, []string{oid}); err != nil {
+		return err
+	}
+
+	return o.ioctx.RmOmapKeys(packIndexName, []string{oid})
+}
+
+// Remove expired packed objects within pool and compact packs with enough dead space.
+// Returns usage of live packed objects
+func (s *Storage) CollectPacks(ioctx *rados.IOContext) (usage Usage, err error) {
+	if _, err = ioctx.Stat(packIndexName); err != nil {
+		// No packs within pool
+		return usage, nil
+	}
+
+	cookie, err := lockPacks(ioctx)
+	if err != nil {
+		return
+	}
+	defer unlockPacks(ioctx, cookie)
+
+	index, err := ioctx.GetAllOmapValues(packIndexName, "", "", 1000)
+	if err != nil {
+		return
+	}
+
+	packs := make(map[string]bool)
+	for _, pack := range index {
+		packs[string(pack)] = true
+	}
+
+	now := time.Duration(time.Now().UTC().Unix())
+	for pack := range packs {
+		entries, err := ioctx.GetAllOmapValues(pack, "", "", 1000)
+		if err != nil {
+			logger.Log.Errorf("Can't read pack %s index: %s", pack, err)
+			continue
+		}
+
+		live := make(map[string]*packEntry)
+		var expired []string
+		var liveBytes uint64
+		for oid, raw := range entries {
+			entry := new(packEntry)
+			if err = json.Unmarshal(raw, entry); err != nil {
+				logger.Log.Errorf("Invalid pack %s entry %s: %s", pack, oid, err)
+				continue
+			}
+			if now > entry.TTL {
+				expired = append(expired, oid)
+				continue
+			}
+			live[oid] = entry
+			liveBytes += entry.Length
+		}
+		usage.Bytes += liveBytes
+		usage.Objects += uint64(len(live))
+
+		if len(expired) > 0 {
+			if err = ioctx.RmOmapKeys(pack, expired); err != nil {
+				logger.Log.Errorf("Can't remove expired entries from pack %s: %s", pack, err)
+				continue
+			}
+			if err = ioctx.RmOmapKeys(packIndexName, expired); err != nil {
+				logger.Log.Errorf("Can't remove expired entries from packs index: %s", err)
+				continue
+			}
+			logger.Log.Infof("Deleted %d packed objects from %s", len(expired), pack)
+		}
+
+		stat, err := ioctx.Stat(pack)
+		if err != nil || stat.Size == 0 {
+			continue
+		}
+		// Packs w/o live objects are always removed
+		ratio := s.opts.PACK_COMPACT_RATIO
+		dead := float64(stat.Size-liveBytes) / float64(stat.Size)
+		if liveBytes > 0 && (ratio <= 0 || dead < ratio) {
+			continue
+		}
+
+		if err = compactPack(ioctx, pack, live); err != nil {
+			logger.Log.Errorf("Can't compact pack %s: %s", pack, err)
+			continue
+		}
+		logger.Log.Infof("Compacted pack %s: %d live objects, %d bytes reclaimed", pack, len(live), stat.Size-liveBytes)
+	}
+
+	return usage, nil
+}
+
+// Copy live entries of pack to new pack and delete old one. Packs lock must be held
+func compactPack(ioctx *rados.IOContext, pack string, live map[string]*packEntry) error {
+	newPack := packNamePrefix + uuid.NewV4().String()
+	entries := make(map[string][]byte)
+	index := make(map[string][]byte)
+
+	var offset uint64
+	for oid, entry := range live {
+		data := make([]byte, entry.Length)
+		n, err := ioctx.Read(pack, data, entry.Offset)
+		if err != nil {
+			return err
+		}
+		if err = ioctx.Append(newPack, data[:n]); err != nil {
+			return err
+		}
+
+		entry.Offset = offset
+		offset += uint64(n)
+		raw, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		entries[oid] = raw
+		index[oid] = []byte(newPack)
+	}
+
+	if len(live) > 0 {
+		if err := ioctx.SetOmap(newPack, entries); err != nil {
+			return err
+		}
+		if err := ioctx.SetOmap(packIndexName, index); err != nil {
+			return err
+		}
+	}
+
+	buf := make([]byte, 255)
+	n, err := ioctx.GetXattr(packIndexName, packCurrentAttr, buf)
+	if err == nil && string(buf[:n]) == pack {
+		if err = ioctx.SetXattr(packIndexName, packCurrentAttr, []byte(newPack)); err != nil {
+			return err
+		}
+	}
+
+	return ioctx.Delete(pack)
+}
@@ -0,0 +1,76 @@
+package cephutils
+
+import (
+	"fmt"
+	"github.com/satori/go.uuid"
+	"strings"
+)
+
+// Placement class used when no rule matches, stores objects in CEPH_OPTIONS.POOL_NAMES_PREFIX pools
+const DefaultPlacement = "default"
+
+// Choose placement class by client hint or by declared object size (0 if unknown).
+// Returns class name and pool names prefix
+func (s *Storage) SelectPlacement(size uint64, hint string) (string, string, error) {
+	rules := s.opts.PLACEMENT
+
+	if hint != "" {
+		if hint == DefaultPlacement {
+			return DefaultPlacement, s.opts.POOL_NAMES_PREFIX, nil
+		}
+		for _, r := range rules {
+			if r.NAME == hint {
+				return r.NAME, r.POOL_NAMES_PREFIX, nil
+			}
+		}
+		return "", "", fmt.Errorf("Unknown placement class '%s'", hint)
+	}
+
+	if size > 0 {
+		for _, r := range rules {
+			if size >= r.MIN_SIZE && (r.MAX_SIZE == 0 || size <= r.MAX_SIZE) {
+				return r.NAME, r.POOL_NAMES_PREFIX, nil
+			}
+		}
+	}
+
+	return DefaultPlacement, s.opts.POOL_NAMES_PREFIX, nil
+}
+
+// Pool names prefixes of all placement classes
+func (s *Storage) PoolPrefixes() []string {
+	prefixes := []string{s.opts.POOL_NAMES_PREFIX}
+	for _, r := range s.opts.PLACEMENT {
+		prefixes = append(prefixes, r.POOL_NAMES_PREFIX)
+	}
+
+	return prefixes
+}
+
+// Check if pool belongs to any placement class
+func (s *Storage) IsCachePool(pool string) bool {
+	for _, prefix := range s.PoolPrefixes() {
+		if strings.HasPrefix(pool, prefix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Pool name for object within placement class
+func shardPool(prefix string, oid uuid.UUID) string {
+	return prefix + oid.String()[:2]
+}
+
+// Retrieve Rados object when pool is unknown: look through pools of all placement classes
+func (s *Storage) FindRadosObj(namespace string, oid uuid.UUID) (obj *RadosObj, err error) {
+	for _, prefix := range s.PoolPrefixes() {
+		obj, err = s.ExistingRadosObj(shardPool(prefix, oid), namespace, oid)
+		if err == nil {
+			return
+		}
+	}
+
+	return nil, fmt.Errorf("Object %s not found: %s", oid, err)
+}
@@ -0,0 +1,122 @@
+package cephutils
+
+import (
+	"bufio"
+	"encoding/binary"
+	"github.com/ceph/go-ceph/rados"
+	"io"
+	"time"
+)
+
+// Resumable uploads state is kept in object attributes, so upload may be resumed by any instance.
+// Partial object has upload length attribute, its size is current upload offset
+const uploadLengthAttrName = "UPLOAD_LENGTH"
+
+// Get resumable upload length attribute
+func getObjUploadLength(ioctx *rados.IOContext, oid string) (uint64, error) {
+	buf := make([]byte, 8)
+	_, err := ioctx.GetXattr(oid, uploadLengthAttrName, buf)
+	if err != nil {
+		return 0, err
+	}
+
+	return binary.LittleEndian.Uint64(buf), nil
+}
+
+// Check if object upload (resumable or multipart) is not finished yet
+func (o *RadosObj) IsPartial() bool {
+	return o.partial || o.multipartPending
+}
+
+// Check if object is resumable upload in progress
+func (o *RadosObj) IsResumable() bool {
+	return o.partial
+}
+
+// Resumable upload total length
+func (o *RadosObj) UploadLength() uint64 {
+	return o.uploadLength
+}
+
+// Reload resumable upload state (offset, length and checksum state) from storage.
+// Must be called under object lock, since state may be changed by another instance meanwhile
+func (o *RadosObj) ReloadResumable() error {
+	oid := o.Oid.String()
+	stat, err := o.ioctx.Stat(oid)
+	if err != nil {
+		return err
+	}
+	o.Size = stat.Size
+
+	length, err := getObjUploadLength(o.ioctx, oid)
+	if err != nil {
+		// Upload is finished meanwhile
+		o.partial = false
+		return nil
+	}
+	o.partial, o.uploadLength, o.hash = true, length, nil
+	o.loadHashState()
+
+	return nil
+}
+
+// Create empty object for resumable upload of given length, unfinished upload expires after timeout
+func (o *RadosObj) StartResumable(length uint64, timeout time.Duration) error {
+	oid := o.Oid.String()
+	if err := o.ioctx.WriteFull(oid, []byte{}); err != nil {
+		return err
+	}
+
+	o.TTL = time.Duration(time.Now().UTC().Add(timeout).Unix())
+	if err := o.SyncAttributes(); err != nil {
+		return err
+	}
+
+	buf := make([]byte, 8)
+	binary.LittleEndian.PutUint64(buf, length)
+	if err := o.ioctx.SetXattr(oid, uploadLengthAttrName, buf); err != nil {
+		return err
+	}
+	o.partial, o.uploadLength = true, length
+
+	return o.saveHashState()
+}
+
+// Append data to resumable upload at offset, up to upload length.
+// Data received before read error is kept so upload may be resumed
+func (o *RadosObj) WriteResumable(rd io.Reader, offset uint64, timeout time.Duration) (uint64, error) {
+	o.bytesWritten = offset
+	wr := bufio.NewWriterSize(o, o.storage.opts.RW_BUFFER_SIZE)
+	written, err := io.Copy(wr, io.LimitReader(rd, int64(o.uploadLength-offset)))
+	if ferr := wr.Flush(); err == nil {
+		err = ferr
+	}
+	o.Size = o.bytesWritten
+
+	// Prolong unfinished upload lifetime
+	o.TTL = time.Duration(time.Now().UTC().Add(timeout).Unix())
+	if terr := setObjTTL(o.ioctx, o.Oid.String(), o.TTL); err == nil {
+		err = terr
+	}
+	if herr := o.saveHashState(); err == nil {
+		err = herr
+	}
+
+	return uint64(written), err
+}
+
+// Finish resumable upload: object gets its lifetime (0 for CEPH_OPTIONS.OBJECT_TTL) and becomes available
+func (o *RadosObj) FinishResumable(ttl time.Duration) error {
+	o.TTL = o.storage.expiration(ttl)
+	if err := o.Commit(); err != nil {
+		return err
+	}
+
+	if err := o.ioctx.RmXattr(o.Oid.String(), uploadLengthAttrName); err != nil {
+		return err
+	}
+	o.ioctx.RmXattr(o.Oid.String(), hashStateAttrName)
+	o.partial = false
+
+	return nil
+}
@@ -0,0 +1,46 @@
+package cephutils
+
+import (
+	"github.com/GrvHldr/dfscache/config"
+	"sync"
+	"time"
+)
+
+// Ceph storage backend: cluster config file, placement classes, packing, indexing and quota settings.
+// Objects keep storage they were created or retrieved by, so servers w/ different settings may share process
+type Storage struct {
+	opts config.CephConfig
+
+	observersMu sync.RWMutex
+	observers   []Observer
+}
+
+// Observer of RADOS operations: connect, open, read, write, commit, delete and lock.
+// Called w/ operation name, its duration and error
+type Observer func(op string, d time.Duration, err error)
+
+func NewStorage(opts config.CephConfig) *Storage {
+	return &Storage{opts: opts}
+}
+
+// Storage settings
+func (s *Storage) Options() config.CephConfig {
+	return s.opts
+}
+
+// Report RADOS operations to observer. Storage shared by several servers reports to all of them
+func (s *Storage) AddObserver(fn Observer) {
+	s.observersMu.Lock()
+	defer s.observersMu.Unlock()
+
+	s.observers = append(s.observers, fn)
+}
+
+func (s *Storage) observe(op string, start time.Time, err error) {
+	s.observersMu.RLock()
+	defer s.observersMu.RUnlock()
+
+	for _, fn := range s.observers {
+		fn(op, time.Since(start), err)
+	}
+}
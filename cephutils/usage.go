@@ -0,0 +1,329 @@
+package cephutils
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/GrvHldr/dfscache/logger"
+	"github.com/ceph/go-ceph/rados"
+	"github.com/satori/go.uuid"
+	"io"
+	"strings"
+	"time"
+)
+
+// Storage usage accounting.
+// Every usage record of tenant namespace or pool is kept in its own object within meta pool and locked separately,
+// so writers of different tenants and pools don't contend. Records are updated incrementally on upload/delete
+// and reconciled by Garbage Collector walk. Names of records are registered in omap of usage object
+const (
+	usageObjName      = "dfscache.usage"
+	usageRecordPrefix = usageObjName + "."
+	usageLockName     = "usagelock"
+	objLockDuration   = 30 * time.Second
+	objLockRetries    = 100
+	objLockRetryWait  = 50 * time.Millisecond
+	tenantUsagePrefix = "tenant."
+	poolUsagePrefix   = "pool."
+)
+
+type Usage struct {
+	Bytes   uint64 `json:"bytes"`
+	Objects uint64 `json:"objects"`
+}
+
+// Usage accumulated by storage walk, keyed by usage record name
+type UsageTally map[string]Usage
+
+// Quota exceeded on upload
+type QuotaError struct {
+	Scope string
+}
+
+func (e *QuotaError) Error() string {
+	return fmt.Sprintf("Storage quota exceeded for %s", e.Scope)
+}
+
+// Pool keeping dfscache service objects
+func (s *Storage) MetaPool() string {
+	if pool := s.opts.META_POOL; pool != "" {
+		return pool
+	}
+
+	return s.opts.POOL_NAMES_PREFIX + "meta"
+}
+
+func tenantUsageKey(namespace string) string {
+	return tenantUsagePrefix + namespace
+}
+
+func poolUsageKey(pool string) string {
+	return poolUsagePrefix + pool
+}
+
+// Account object of given size stored within tenant namespace and pool
+func (t UsageTally) Add(namespace, pool string, size, objects uint64) {
+	for _, key := range []string{tenantUsageKey(namespace), poolUsageKey(pool)} {
+		u := t[key]
+		u.Bytes += size
+		u.Objects += objects
+		t[key] = u
+	}
+}
+
+// Take exclusive lock on Rados object, waiting for other holders
+func lockObject(ioctx *rados.IOContext, oid, name string) (string, error) {
+	cookie := uuid.NewV4().String()
+	for i := 0; i < objLockRetries; i++ {
+		ret, err := ioctx.LockExclusive(oid, name, cookie, name, objLockDuration, nil)
+		if err == nil && ret == 0 {
+			return cookie, nil
+		}
+		time.Sleep(objLockRetryWait)
+	}
+
+	return "", fmt.Errorf("Can't lock %s", oid)
+}
+
+// Release Rados object lock taken by lockObject
+func unlockObject(ioctx *rados.IOContext, oid, name, cookie string) {
+	if _, err := ioctx.Unlock(oid, name, cookie); err != nil {
+		logger.Log.Errorf("Can't unlock %s: %s", oid, err)
+	}
+}
+
+// Read usage record, zero usage if missing
+func readUsage(ioctx *rados.IOContext, key string) (Usage, error) {
+	var u Usage
+	buf := make([]byte, 256)
+	n, err := ioctx.Read(usageRecordPrefix+key, buf, 0)
+	if err == rados.RadosErrorNotFound {
+		return u, nil
+	}
+	if err != nil || n == 0 {
+		return u, err
+	}
+
+	return u, json.Unmarshal(buf[:n], &u)
+}
+
+// Write usage record under its lock, value is computed of current one
+func writeUsage(ioctx *rados.IOContext, key string, update func(Usage) Usage) error {
+	oid := usageRecordPrefix + key
+	cookie, err := lockObject(ioctx, oid, usageLockName)
+	if err != nil {
+		return err
+	}
+	defer unlockObject(ioctx, oid, usageLockName, cookie)
+
+	u, err := readUsage(ioctx, key)
+	if err != nil {
+		return err
+	}
+	raw, err := json.Marshal(update(u))
+	if err != nil {
+		return err
+	}
+	if err = ioctx.WriteFull(oid, raw); err != nil {
+		return err
+	}
+
+	// Register record for reconciliation, setting omap key is atomic
+	return ioctx.SetOmap(usageObjName, map[string][]byte{key: nil})
+}
+
+// Read usage of tenant namespace and placement class, summed over all pools of class
+func (s *Storage) GetUsage(conn *rados.Conn, namespace, placement string) (tenant Usage, class Usage, err error) {
+	ioctx, err := GetIoctx(conn, s.MetaPool())
+	if err != nil {
+		return
+	}
+	defer ioctx.Destroy()
+
+	if tenant, err = readUsage(ioctx, tenantUsageKey(namespace)); err != nil {
+		return
+	}
+
+	pools, err := conn.ListPools()
+	if err != nil {
+		return
+	}
+	for _, pool := range pools {
+		if !s.isClassPool(pool, placement) {
+			continue
+		}
+		u, perr := readUsage(ioctx, poolUsageKey(pool))
+		if perr != nil {
+			return tenant, class, perr
+		}
+		class.Bytes += u.Bytes
+		class.Objects += u.Objects
+	}
+
+	return
+}
+
+// Apply usage delta to tenant namespace and pool records. Records are locked one by one
+func (s *Storage) updateUsage(conn *rados.Conn, namespace, pool string, bytes, objects int64) error {
+	ioctx, err := GetIoctx(conn, s.MetaPool())
+	if err != nil {
+		return err
+	}
+	defer ioctx.Destroy()
+
+	apply := func(v uint64, delta int64) uint64 {
+		if delta < 0 && uint64(-delta) > v {
+			return 0
+		}
+		return uint64(int64(v) + delta)
+	}
+
+	for _, key := range []string{tenantUsageKey(namespace), poolUsageKey(pool)} {
+		err = writeUsage(ioctx, key, func(u Usage) Usage {
+			u.Bytes = apply(u.Bytes, bytes)
+			u.Objects = apply(u.Objects, objects)
+			return u
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Replace usage records with values counted by storage walk
+func (s *Storage) ReconcileUsage(conn *rados.Conn, tally UsageTally) error {
+	ioctx, err := GetIoctx(conn, s.MetaPool())
+	if err != nil {
+		return err
+	}
+	defer ioctx.Destroy()
+
+	// Records not seen by walk are reset
+	existing, err := ioctx.GetAllOmapValues(usageObjName, "", "", 1000)
+	if err != nil {
+		existing = map[string][]byte{}
+	}
+
+	records := make(map[string]Usage)
+	for key := range existing {
+		records[key] = Usage{}
+	}
+	for key, u := range tally {
+		records[key] = u
+	}
+
+	for key, u := range records {
+		u := u
+		if err = writeUsage(ioctx, key, func(Usage) Usage { return u }); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Check if pool is shard pool of placement class
+func (s *Storage) isClassPool(pool, placement string) bool {
+	prefix := s.opts.POOL_NAMES_PREFIX
+	if placement != DefaultPlacement {
+		for _, r := range s.opts.PLACEMENT {
+			if r.NAME == placement {
+				prefix = r.POOL_NAMES_PREFIX
+			}
+		}
+	}
+
+	// Shard pool name is prefix and two characters of OID, prefixes of classes may overlap
+	return len(pool) == len(prefix)+len(shardPool("", uuid.Nil)) && strings.HasPrefix(pool, prefix)
+}
+
+// Quota of placement class, limits all pools of class together
+func (s *Storage) poolQuota(placement string) (uint64, uint64) {
+	for _, r := range s.opts.PLACEMENT {
+		if r.NAME == placement && (r.QUOTA_BYTES > 0 || r.QUOTA_OBJECTS > 0) {
+			return r.QUOTA_BYTES, r.QUOTA_OBJECTS
+		}
+	}
+
+	return s.opts.POOL_QUOTA_BYTES, s.opts.POOL_QUOTA_OBJECTS
+}
+
+// Upload content reader failing w/ QuotaError once content exceeds bytes left within quota
+type quotaReader struct {
+	rd    io.Reader
+	left  uint64
+	scope string
+}
+
+func (q *quotaReader) Read(p []byte) (int, error) {
+	// One byte over quota is read to tell content exceeding quota from content filling it up
+	if uint64(len(p)) > q.left+1 {
+		p = p[:q.left+1]
+	}
+	n, err := q.rd.Read(p)
+	if uint64(n) > q.left {
+		return int(q.left), &QuotaError{Scope: q.scope}
+	}
+	q.left -= uint64(n)
+
+	return n, err
+}
+
+// Limit upload content to bytes left within tenant (0 - unlimited) and pool byte quotas,
+// so quota is enforced on content actually written rather than on declared size.
+// Reserved bytes are taken by upload already but not accounted in usage yet, e.g. pending multipart parts
+func (o *RadosObj) QuotaReader(rd io.Reader, tenantBytes, reserved uint64) (io.Reader, error) {
+	poolBytes, _ := o.storage.poolQuota(o.Placement)
+	if tenantBytes == 0 && poolBytes == 0 {
+		return rd, nil
+	}
+
+	tenant, class, err := o.storage.GetUsage(o.conn, o.Namespace, o.Placement)
+	if err != nil {
+		return nil, err
+	}
+
+	q := &quotaReader{rd: rd, left: ^uint64(0)}
+	left := func(u Usage, quota uint64, scope string) {
+		if quota == 0 {
+			return
+		}
+		var n uint64
+		if used := u.Bytes + reserved; used < quota {
+			n = quota - used
+		}
+		if n < q.left {
+			q.left, q.scope = n, scope
+		}
+	}
+	left(tenant, tenantBytes, "tenant")
+	left(class, poolBytes, "placement "+o.Placement)
+
+	return q, nil
+}
+
+// Check if new object of given size fits tenant (0 - unlimited) and pool quotas
+func (o *RadosObj) CheckQuota(size, tenantBytes, tenantObjects uint64) error {
+	poolBytes, poolObjects := o.storage.poolQuota(o.Placement)
+	if tenantBytes == 0 && tenantObjects == 0 && poolBytes == 0 && poolObjects == 0 {
+		return nil
+	}
+
+	tenant, class, err := o.storage.GetUsage(o.conn, o.Namespace, o.Placement)
+	if err != nil {
+		return err
+	}
+
+	exceeds := func(u Usage, quotaBytes, quotaObjects uint64) bool {
+		return quotaBytes > 0 && u.Bytes+size > quotaBytes || quotaObjects > 0 && u.Objects+1 > quotaObjects
+	}
+	if exceeds(tenant, tenantBytes, tenantObjects) {
+		return &QuotaError{Scope: "tenant"}
+	}
+	if exceeds(class, poolBytes, poolObjects) {
+		return &QuotaError{Scope: "placement " + o.Placement}
+	}
+
+	return nil
+}
@@ -0,0 +1,48 @@
+package cephutils
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func TestQuotaReader(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		left    uint64
+		oneByte bool
+		exceeds bool
+		read    int
+	}{
+		{"empty", "", 0, false, false, 0},
+		{"under quota", "hello", 10, false, false, 5},
+		{"fills quota", "hello", 5, false, false, 5},
+		{"exceeds quota", "hello world", 5, false, true, 5},
+		{"exceeds by one byte", "hello!", 5, false, true, 5},
+		{"no bytes left", "hello", 0, false, true, 0},
+		{"one byte reads, fills quota", "hello", 5, true, false, 5},
+		{"one byte reads, exceeds quota", "hello world", 5, true, true, 5},
+	}
+
+	for _, tt := range tests {
+		rd := strings.NewReader(tt.content)
+		q := &quotaReader{rd: rd, left: tt.left, scope: "tenant"}
+		if tt.oneByte {
+			q.rd = iotest.OneByteReader(rd)
+		}
+
+		got, err := ioutil.ReadAll(q)
+		qerr, isQuota := err.(*QuotaError)
+		if tt.exceeds && (!isQuota || qerr.Scope != "tenant") {
+			t.Errorf("%s: error = %v, want tenant quota error", tt.name, err)
+		}
+		if !tt.exceeds && err != nil {
+			t.Errorf("%s: error = %v", tt.name, err)
+		}
+		if len(got) != tt.read || string(got) != tt.content[:tt.read] {
+			t.Errorf("%s: read %q, want %q", tt.name, got, tt.content[:tt.read])
+		}
+	}
+}
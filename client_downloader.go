@@ -1,3 +1,5 @@
+// +build ignore
+
 // ZeroMQ client example
 
 package main
@@ -1,3 +1,5 @@
+// +build ignore
+
 package main
 
 import (
@@ -18,10 +20,12 @@ func main() {
 		PRIVATE_CLIENT_KEY = "qlBVy1z/?5PA&4w(hF7F&qOH{0yz.@0&9z!ZK2yL"
 	)
 
-	var filename string
+	var filename, placement, acl string
 	var offset int64
 
 	flag.StringVar(&filename, "file_name", "", "File name to upload")
+	flag.StringVar(&placement, "placement", "", "Placement class name (optional)")
+	flag.StringVar(&acl, "acl", "", "Object ACL: private, group-read or public-read (optional)")
 	flag.Parse()
 
 	if filename == "" {
@@ -64,7 +68,13 @@ func main() {
 	logger.Log.Info("Sending filename:", fileBasename, "; size:", fileStat.Size())
 
 	// Send initial header
-	_, err = dealer.SendMessage(fileBasename, bFileSize)
+	if acl != "" {
+		_, err = dealer.SendMessage(fileBasename, bFileSize, placement, acl)
+	} else if placement != "" {
+		_, err = dealer.SendMessage(fileBasename, bFileSize, placement)
+	} else {
+		_, err = dealer.SendMessage(fileBasename, bFileSize)
+	}
 	if err != nil {
 		logger.Log.Error(err)
 		return
@@ -74,7 +84,7 @@ func main() {
 	if parts[0] == "ACK" {
 		logger.Log.Info("Established connection, OID:", parts[1])
 	} else {
-		logger.Log.Error("Can't establish ZMQ connection")
+		logger.Log.Error("Can't establish ZMQ connection:", parts[1:])
 		return
 	}
 
@@ -2,12 +2,13 @@ package config
 
 import (
 	"encoding/json"
+	"fmt"
 	"github.com/GrvHldr/dfscache/logger"
 	"os"
 	"strconv"
 )
 
-type zmqConfig struct {
+type ZmqConfig struct {
 	LISTEN_DOWNLOAD       string
 	LISTEN_UPLOAD         string
 	DOWNLOAD_PIPELINE     int
@@ -15,28 +16,121 @@ type zmqConfig struct {
 	Z85_PUBLIC_KEY        string
 	Z85_PRIVATE_KEY       string
 	Z85_PUBLIC_CLIENT_KEY string
+	MAX_UPLOAD_SIZE       uint64
+	ADMIN_CLIENT_KEYS     []string
 }
 
-type httpConfig struct {
+type HttpConfig struct {
 	LISTEN                         string
-	MAX_MEMORY_FORM_PARSE          int64
 	HTTP_UPLOAD_CONTENT_FIELD_NAME string
 	CERT_FILE                      string
 	CERT_KEY_FILE                  string
+	MAX_UPLOAD_SIZE                uint64
+	RESUMABLE_UPLOAD_TIMEOUT       int
+	MULTIPART_UPLOAD_TIMEOUT       int
+	SIGNING_KEYS                   []SigningKey
+	SIGNED_URL_TTL                 int
+	REQUIRE_SIGNED_DOWNLOADS       bool
+	API_KEYS_FILE                  string
+	JWT_HS256_SECRET               string
+	JWT_RS256_PUBLIC_KEY_FILE      string
+	ANONYMOUS_SCOPES               []string
+	CLIENT_AUTH                    string
+	CLIENT_CA_FILE                 string
+	CLIENT_CRL_FILE                string
+	CLIENT_CERTS                   []ClientCert
+	TLS_MIN_VERSION                string
+	TLS_CIPHER_SUITES              []string
+	CERTIFICATES                   []CertPair
+	CERT_RELOAD_INTERVAL           int
+	PLAINTEXT                      bool
 }
 
-type cephConfig struct {
-	CONFIG_FILE       string
+// Additional server certificate selected by SNI
+type CertPair struct {
+	CERT_FILE     string
+	CERT_KEY_FILE string
+}
+
+// Client certificate subject common name or SAN mapped to principal
+type ClientCert struct {
+	SUBJECT string
+	NAME    string
+	TENANT  string
+	SCOPES  []string
+}
+
+// Download URLs signing key. First configured key signs, all of them verify
+type SigningKey struct {
+	KEY_ID string
+	SECRET string
+}
+
+type PlacementRule struct {
+	NAME              string
 	POOL_NAMES_PREFIX string
-	OBJECT_TTL        int
-	GC_RUN_INTERVAL   int
-	RW_BUFFER_SIZE    int
+	MIN_SIZE          uint64
+	MAX_SIZE          uint64
+	QUOTA_BYTES       uint64
+	QUOTA_OBJECTS     uint64
+}
+
+type CephConfig struct {
+	CONFIG_FILE        string
+	POOL_NAMES_PREFIX  string
+	OBJECT_TTL         int
+	GC_RUN_INTERVAL    int
+	RW_BUFFER_SIZE     int
+	PLACEMENT          []PlacementRule
+	PACK_THRESHOLD     uint64
+	PACK_MAX_SIZE      uint64
+	PACK_COMPACT_RATIO float64
+	META_POOL          string
+	POOL_QUOTA_BYTES   uint64
+	POOL_QUOTA_OBJECTS uint64
+	INDEXED_META_KEYS  []string
+}
+
+type TenantConfig struct {
+	NAME            string
+	NAMESPACE       string
+	HTTP_USERS      map[string]string
+	ZMQ_CLIENT_KEYS []string
+	OBJECT_TTL      int
+	MAX_OBJECT_SIZE uint64
+	QUOTA_BYTES     uint64
+	QUOTA_OBJECTS   uint64
+}
+
+type S3AccessKey struct {
+	ACCESS_KEY string
+	SECRET_KEY string
+	TENANT     string
 }
 
-type serverConfig struct {
-	CEPH_OPTIONS cephConfig
-	ZMQ_OPTIONS  zmqConfig
-	HTTP_OPTIONS httpConfig
+type S3Bucket struct {
+	NAME      string
+	TENANT    string
+	PLACEMENT string
+}
+
+type S3Config struct {
+	LISTEN      string
+	REGION      string
+	ACCESS_KEYS []S3AccessKey
+	BUCKETS     []S3Bucket
+}
+
+type ServerConfig struct {
+	CEPH_OPTIONS     CephConfig
+	ZMQ_OPTIONS      ZmqConfig
+	HTTP_OPTIONS     HttpConfig
+	S3_OPTIONS       S3Config
+	TENANTS          []TenantConfig
+	DEFAULT_TENANT   string
+	SHUTDOWN_TIMEOUT int    // Seconds given to in-flight requests and uploads on shutdown
+	SHUTDOWN_DRAIN   int    // Seconds HTTP listeners keep serving after readiness is withdrawn
+	HEALTH_LISTEN    string // Plain HTTP listener of health probes, for instances w/o HTTP API
 }
 
 type SetFlagString struct {
@@ -89,16 +183,29 @@ func (f *SetFlagInt64) Set(s string) error {
 	return err
 }
 
-var Config = new(serverConfig)
+// Configuration of server binaries. Embedded servers get their own configuration, see dfscache.Server
+var Config = new(ServerConfig)
 
-func Initialize(cfgFile string) {
+// Load server configuration from JSON file
+func Load(cfgFile string) (*ServerConfig, error) {
 	fd, err := os.Open(cfgFile)
 	if err != nil {
-		logger.Log.Fatal("Can't open config file:", err)
+		return nil, fmt.Errorf("Can't open config file: %s", err)
 	}
+	defer fd.Close()
 
-	decoder := json.NewDecoder(fd)
-	if err = decoder.Decode(Config); err != nil {
-		logger.Log.Fatal("Configuration error:", err)
+	cfg := new(ServerConfig)
+	if err = json.NewDecoder(fd).Decode(cfg); err != nil {
+		return nil, fmt.Errorf("Configuration error: %s", err)
+	}
+
+	return cfg, nil
+}
+
+func Initialize(cfgFile string) {
+	cfg, err := Load(cfgFile)
+	if err != nil {
+		logger.Log.Fatal(err)
 	}
+	Config = cfg
 }
@@ -0,0 +1,110 @@
+// Package dfscache embeds dfscache servers into Go programs.
+//
+// Server binaries serve_all_in_one.go, serve_http.go, serve_zmq.go and start_gc.go are built from this
+// directory file by file, e.g. `go install serve_http.go`
+package dfscache
+
+import (
+	"context"
+	"github.com/GrvHldr/dfscache/cephutils"
+	"github.com/GrvHldr/dfscache/config"
+	"github.com/GrvHldr/dfscache/server"
+	"net/http"
+)
+
+// Server options, same as JSON configuration of server binaries
+type Options = config.ServerConfig
+
+// Ceph storage backend
+type Storage = cephutils.Storage
+
+// Load options from JSON configuration file
+func LoadOptions(cfgFile string) (*Options, error) {
+	return config.Load(cfgFile)
+}
+
+// Ceph storage backend of CEPH_OPTIONS
+func NewCephStorage(opts config.CephConfig) *Storage {
+	return cephutils.NewStorage(opts)
+}
+
+// Embedded server. Components are enabled by options: HTTP and S3 APIs by HTTP_OPTIONS.LISTEN
+// and S3_OPTIONS.LISTEN, ZMQ downloader and uploader by ZMQ_OPTIONS.LISTEN_DOWNLOAD and
+// ZMQ_OPTIONS.LISTEN_UPLOAD, Garbage Collector by CEPH_OPTIONS.GC_RUN_INTERVAL
+type Server struct {
+	srv     *server.Server
+	started bool
+	done    chan struct{}
+}
+
+// New server of options and storage backend, storage is made of opts.CEPH_OPTIONS if nil
+func New(opts *Options, storage *Storage) (*Server, error) {
+	srv, err := server.New(opts, storage)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Server{srv: srv, done: make(chan struct{})}, nil
+}
+
+// HTTP API handler. Serves requests without HTTP listener, e.g. mounted into another router
+func (s *Server) Handler() http.Handler {
+	return s.srv.Handler()
+}
+
+// Bind enabled components and serve them in background until ctx is done or Shutdown is called
+func (s *Server) Start(ctx context.Context) error {
+	if err := s.srv.Start(s.components()...); err != nil {
+		return err
+	}
+	s.started = true
+
+	go func() {
+		s.srv.Wait()
+		close(s.done)
+	}()
+	go func() {
+		select {
+		case <-ctx.Done():
+			s.srv.Shutdown()
+		case <-s.done:
+		}
+	}()
+
+	return nil
+}
+
+// Stop components and wait for in-flight requests and uploads to finish, or ctx to be done
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.srv.Shutdown()
+	if !s.started {
+		return nil
+	}
+
+	select {
+	case <-s.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (s *Server) components() []server.Component {
+	opts := s.srv.Options()
+
+	var components []server.Component
+	if opts.HTTP_OPTIONS.LISTEN != "" {
+		components = append(components, server.HTTP)
+	}
+	if opts.ZMQ_OPTIONS.LISTEN_DOWNLOAD != "" {
+		components = append(components, server.ZMQDownloader)
+	}
+	if opts.ZMQ_OPTIONS.LISTEN_UPLOAD != "" {
+		components = append(components, server.ZMQUploader)
+	}
+	if opts.CEPH_OPTIONS.GC_RUN_INTERVAL > 0 {
+		components = append(components, server.GC)
+	}
+
+	return components
+}
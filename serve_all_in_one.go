@@ -1,9 +1,12 @@
+// +build ignore
+
 package main
 
 import (
 	"flag"
 	"github.com/GrvHldr/dfscache/server"
 	"github.com/GrvHldr/dfscache/config"
+	"github.com/GrvHldr/dfscache/logger"
 )
 
 func init() {
@@ -14,15 +17,10 @@ func init() {
 }
 
 func main() {
-	//ZMQ downloader server
-	go server.BindZMqDownloader()
-
-	//ZMQ uploader server
-	go server.BindZMqUploader()
-
-	// Run GC
-	go server.GarbageCollector()
-
-	// Run HTTP server
-	server.Run()
+	srv, err := server.New(config.Config, nil)
+	if err != nil {
+		logger.Log.Fatal(err)
+	}
+	// ZMQ downloader and uploader, GC and HTTP server run until SIGTERM or SIGINT
+	srv.Serve(server.ZMQDownloader, server.ZMQUploader, server.GC, server.HTTP)
 }
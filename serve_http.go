@@ -1,20 +1,23 @@
+// +build ignore
+
 package main
 
 import (
 	"flag"
 	"github.com/GrvHldr/dfscache/server"
 	"github.com/GrvHldr/dfscache/config"
+	"github.com/GrvHldr/dfscache/logger"
 )
 
 func init() {
 	var cfgfile string
 	var listen, contentFieldName, certFile, certKey config.SetFlagString
-	var maxmem config.SetFlagInt64
+	var maxUpload config.SetFlagInt64
 
 	flag.StringVar(&cfgfile, "config", "config.json", "Server JSON config file name")
 	flag.Var(&listen, "http_listen", "Listen HTTP on specified address. E.g: '0.0.0.0:8080'")
 	flag.Var(&contentFieldName, "post_content_field_name", "Specify POST multipart form field name")
-	flag.Var(&maxmem, "max_mem_usage", "Max memory usage on POST multipart form data")
+	flag.Var(&maxUpload, "max_upload_size", "Max upload size in bytes, 0 - unlimited")
 	flag.Var(&certFile, "cert_file", "x509 public key file path")
 	flag.Var(&certKey, "cert_key", "x509 private key file path")
 	flag.Parse()
@@ -26,8 +29,8 @@ func init() {
 	if contentFieldName.IsSet {
 		config.Config.HTTP_OPTIONS.HTTP_UPLOAD_CONTENT_FIELD_NAME = contentFieldName.Val
 	}
-	if maxmem.IsSet {
-		config.Config.HTTP_OPTIONS.MAX_MEMORY_FORM_PARSE = maxmem.Val
+	if maxUpload.IsSet {
+		config.Config.HTTP_OPTIONS.MAX_UPLOAD_SIZE = uint64(maxUpload.Val)
 	}
 	if certFile.IsSet {
 		config.Config.HTTP_OPTIONS.CERT_FILE = certFile.Val
@@ -38,5 +41,9 @@ func init() {
 }
 
 func main() {
-	server.Run()
+	srv, err := server.New(config.Config, nil)
+	if err != nil {
+		logger.Log.Fatal(err)
+	}
+	srv.Serve(server.HTTP)
 }
@@ -1,21 +1,26 @@
+// +build ignore
+
 package main
 
 import (
 	"flag"
 	"github.com/GrvHldr/dfscache/server"
 	"github.com/GrvHldr/dfscache/config"
+	"github.com/GrvHldr/dfscache/logger"
 )
 
 func init() {
 	var cfgfile string
 	var listenUpload, listenDownload config.SetFlagString
 	var pipeline, workers config.SetFlagInt
+	var maxUpload config.SetFlagInt64
 
 	flag.StringVar(&cfgfile, "config", "config.json", "Server JSON config file name")
 	flag.Var(&listenUpload, "listen_uploader", "Listen ZMQ uploader on specified address. E.g: 'tcp://0.0.0.0:5555'")
 	flag.Var(&listenDownload, "listen_downloader", "Listen ZMQ downloader on specified address. E.g: 'tcp://0.0.0.0:6666'")
 	flag.Var(&pipeline, "download_pipeline", "Downloader pipeline buffer size")
 	flag.Var(&workers, "uploader_workers_num", "Number of uploader workers")
+	flag.Var(&maxUpload, "max_upload_size", "Max upload size in bytes, 0 - unlimited")
 	flag.Parse()
 	config.Initialize(cfgfile)
 
@@ -31,12 +36,16 @@ func init() {
 	if workers.IsSet {
 		config.Config.ZMQ_OPTIONS.NUM_UPLOAD_WORKERS = workers.Val
 	}
+	if maxUpload.IsSet {
+		config.Config.ZMQ_OPTIONS.MAX_UPLOAD_SIZE = uint64(maxUpload.Val)
+	}
 }
 
 func main() {
-	//ZMQ downloader server
-	go server.BindZMqDownloader()
-
-	//ZMQ uploader server
-	server.BindZMqUploader()
+	srv, err := server.New(config.Config, nil)
+	if err != nil {
+		logger.Log.Fatal(err)
+	}
+	// ZMQ downloader and uploader servers run until SIGTERM or SIGINT
+	srv.Serve(server.ZMQDownloader, server.ZMQUploader)
 }
@@ -0,0 +1,131 @@
+package server
+
+import (
+	"encoding/json"
+	"github.com/GrvHldr/dfscache/cephutils"
+	"github.com/GrvHldr/dfscache/logger"
+	"github.com/julienschmidt/httprouter"
+	"net/http"
+)
+
+// Object access control, shared by HTTP and ZMQ. Owner reads and modifies object, others read it
+// if object ACL grants that. Admins bypass ACLs
+const (
+	aclHeader      = "X-Dfscache-Acl"
+	anonymousOwner = "anonymous" // Owner of anonymous uploads, no principal modifies them but admins
+	s3OwnerPrefix  = "s3:"       // Owner of S3 API uploads is access key
+)
+
+type aclRequest struct {
+	ACL string `json:"acl"`
+}
+
+func (p *principal) isAdmin() bool {
+	for _, s := range p.Scopes {
+		if s == scopeAdmin {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Check if principal may download object. Objects stored before ownership was introduced are readable by anyone
+func (p *principal) canRead(o *cephutils.BaseRadosObj) bool {
+	if p.Signed || o.Owner == "" || p.canModify(o) {
+		return true
+	}
+
+	switch o.ACL {
+	case cephutils.ACLPublicRead:
+		return true
+	case cephutils.ACLGroupRead:
+		return !p.Anonymous
+	}
+
+	return false
+}
+
+// Check if principal may delete object, change its ACL or continue its upload. Objects w/o owner are modified by admins only
+func (p *principal) canModify(o *cephutils.BaseRadosObj) bool {
+	return p.isAdmin() || o.Owner != "" && o.Owner == p.ID
+}
+
+// Principal of ZMQ client identified by CURVE public key (Z85 encoded), nil if key is unknown
+func (srv *Server) zmqPrincipal(key string) *principal {
+	t := srv.tenants.ByCurveKey(key)
+	if t == nil {
+		return nil
+	}
+
+	p := &principal{Name: key, ID: "curve:" + key, Tenant: t, Scopes: userScopes}
+	for _, k := range srv.cfg.ZMQ_OPTIONS.ADMIN_CLIENT_KEYS {
+		if k == key {
+			p.Scopes = []string{scopeAdmin}
+		}
+	}
+
+	return p
+}
+
+// Owner and ACL of object uploaded by request. Anonymous uploads are public-read unless ACL is set,
+// since their uploader can't be told from other anonymous clients
+func requestOwnership(r *http.Request) (owner, acl string, err error) {
+	acl = r.Header.Get(aclHeader)
+	if err = cephutils.ValidateACL(acl); err != nil {
+		return
+	}
+	if p := principalFromContext(r); p != nil {
+		owner = p.ID
+	}
+	if owner == "" {
+		owner = anonymousOwner
+		if acl == "" {
+			acl = cephutils.ACLPublicRead
+		}
+	}
+
+	return
+}
+
+// Check request principal access to object, responds w/ 403 if access is denied
+func checkAccess(w http.ResponseWriter, r *http.Request, o *cephutils.RadosObj, modify bool) bool {
+	p := principalFromContext(r)
+	if modify && p.canModify(&o.BaseRadosObj) || !modify && p.canRead(&o.BaseRadosObj) {
+		return true
+	}
+
+	http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+	return false
+}
+
+// Change object ACL
+func (srv *Server) serveObjectACL(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	obj, err, rc := srv.retrieveRadosObj(tenantFromContext(r), p)
+	if err != nil {
+		http.Error(w, err.Error(), rc)
+		return
+	}
+	defer obj.Destroy()
+
+	if !checkAccess(w, r, obj, true) {
+		return
+	}
+
+	req := new(aclRequest)
+	if err = json.NewDecoder(r.Body).Decode(req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err = cephutils.ValidateACL(req.ACL); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err = obj.SetACL(req.ACL); err != nil {
+		logger.Log.Error(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	srv.writeObjectJSON(w, r, obj)
+}
@@ -0,0 +1,78 @@
+package server
+
+import (
+	"github.com/GrvHldr/dfscache/cephutils"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPrincipalObjectAccess(t *testing.T) {
+	owner := &principal{ID: "user:alice", Scopes: userScopes}
+	other := &principal{ID: "user:bob", Scopes: userScopes}
+	admin := &principal{ID: "key:ops", Scopes: []string{scopeAdmin}}
+	anonymous := &principal{Anonymous: true}
+	signed := &principal{Anonymous: true, Signed: true}
+
+	tests := []struct {
+		name       string
+		p          *principal
+		owner, acl string
+		read, mod  bool
+	}{
+		{"owner private", owner, "user:alice", cephutils.ACLPrivate, true, true},
+		{"other private", other, "user:alice", "", false, false},
+		{"other group-read", other, "user:alice", cephutils.ACLGroupRead, true, false},
+		{"other public-read", other, "user:alice", cephutils.ACLPublicRead, true, false},
+		{"admin private", admin, "user:alice", cephutils.ACLPrivate, true, true},
+		{"anonymous private", anonymous, "user:alice", cephutils.ACLPrivate, false, false},
+		{"anonymous group-read", anonymous, "user:alice", cephutils.ACLGroupRead, false, false},
+		{"anonymous public-read", anonymous, "user:alice", cephutils.ACLPublicRead, true, false},
+		{"signed private", signed, "user:alice", cephutils.ACLPrivate, true, false},
+		{"other unowned", other, "", "", true, false},
+		{"anonymous unowned", anonymous, "", "", true, false},
+		{"admin unowned", admin, "", "", true, true},
+		{"anonymous anonymous upload", anonymous, anonymousOwner, cephutils.ACLPublicRead, true, false},
+		{"other s3 upload", other, s3OwnerPrefix + "AKIA", "", false, false},
+	}
+
+	for _, tt := range tests {
+		o := &cephutils.BaseRadosObj{Owner: tt.owner, ACL: tt.acl}
+		if got := tt.p.canRead(o); got != tt.read {
+			t.Errorf("%s: canRead = %v, want %v", tt.name, got, tt.read)
+		}
+		if got := tt.p.canModify(o); got != tt.mod {
+			t.Errorf("%s: canModify = %v, want %v", tt.name, got, tt.mod)
+		}
+	}
+}
+
+func TestRequestOwnership(t *testing.T) {
+	tests := []struct {
+		acl        string
+		p          *principal
+		owner, got string
+		ok         bool
+	}{
+		{"", &principal{ID: "user:alice"}, "user:alice", "", true},
+		{cephutils.ACLPublicRead, &principal{ID: "user:alice"}, "user:alice", cephutils.ACLPublicRead, true},
+		{"", &principal{Anonymous: true}, anonymousOwner, cephutils.ACLPublicRead, true},
+		{cephutils.ACLGroupRead, &principal{Anonymous: true}, anonymousOwner, cephutils.ACLGroupRead, true},
+		{"public-read-write", &principal{ID: "user:alice"}, "", "", false},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodPost, "/upload", nil)
+		r.Header.Set(aclHeader, tt.acl)
+		r = withPrincipal(r, tt.p)
+
+		owner, acl, err := requestOwnership(r)
+		if tt.ok != (err == nil) {
+			t.Errorf("requestOwnership(%q) error = %v", tt.acl, err)
+			continue
+		}
+		if tt.ok && (owner != tt.owner || acl != tt.got) {
+			t.Errorf("requestOwnership(%q) = %q, %q, want %q, %q", tt.acl, owner, acl, tt.owner, tt.got)
+		}
+	}
+}
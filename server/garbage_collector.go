@@ -1,70 +1,166 @@
 package server
 
 import (
+	"fmt"
 	"github.com/GrvHldr/dfscache/cephutils"
 	"github.com/GrvHldr/dfscache/logger"
-	"github.com/GrvHldr/dfscache/config"
 	"github.com/ceph/go-ceph/rados"
 	"time"
 )
 
-// Goroutine looking for expired objects in storage and deletes outdated
-func GarbageCollector() {
-	conn, err := cephutils.NewRadosConn()
+// Connect Garbage Collector to storage, returns loop looking for expired objects and deleting outdated
+func (srv *Server) startGC() (func(), error) {
+	conn, err := srv.storage.NewRadosConn()
 	if err != nil {
-		logger.Log.Fatalf("Can't create new Rados connection: %s. Exiting", err)
-		return
+		return nil, fmt.Errorf("Can't create new Rados connection: %s", err)
 	}
-	defer conn.Shutdown()
 
+	return func() {
+		defer conn.Shutdown()
+		srv.collectGarbage(conn)
+	}, nil
+}
+
+func (srv *Server) collectGarbage(conn *rados.Conn) {
 	logger.Log.Info("Started")
+	srv.gcHeartbeat()
 
 	delObj := func(ioctx *rados.IOContext, oid string) {
-		err = ioctx.Delete(oid)
+		// Size is unknown if stat fails, object is deleted anyway
+		stat, _ := ioctx.Stat(oid)
+		err := ioctx.Delete(oid)
 		if err != nil {
 			logger.Log.Errorf("Can't delete object %s: %s", oid, err)
 			return
 		}
+		srv.metrics.gcDeleted.Inc()
+		srv.metrics.gcReclaimed.Add(float64(stat.Size))
 		logger.Log.Infof("Deleted object %s", oid)
 	}
 
-	ticker := time.NewTicker(time.Duration(config.Config.CEPH_OPTIONS.GC_RUN_INTERVAL) * time.Second)
+	ticker := time.NewTicker(time.Duration(srv.cfg.CEPH_OPTIONS.GC_RUN_INTERVAL) * time.Second)
 	for {
 		select {
 		case <-ticker.C:
+			srv.gcHeartbeat()
+			start := time.Now()
 			pools, err := conn.ListPools()
 			if err != nil {
 				logger.Log.Error("Can't get pool list: ", err)
 				continue
 			}
 
+			// Usage tally of interrupted run is incomplete, so it is not reconciled
+			tally := make(cephutils.UsageTally)
+			complete := true
 			for _, pool := range pools {
-				ioctx, err := conn.OpenIOContext(pool)
-				if err != nil {
-					logger.Log.Errorf("Can't opent pool (%s): %s", pool, err)
-					continue
+				if complete = srv.collectPool(conn, pool, tally, delObj); !complete {
+					break
 				}
+			}
+			if !complete {
+				srv.metrics.gcRuns.WithLabelValues("interrupted").Inc()
+				continue
+			}
 
-				err = ioctx.ListObjects(func(oid string) {
-					ttl, err := cephutils.GetObjTTL(ioctx, oid)
-					if err != nil {
-						// Do nothing if no TTL attr
-						return
-					}
-
-					now := time.Duration(time.Now().UTC().Unix())
-					if now > ttl && !cephutils.IsObjectLocked(ioctx, oid) {
-						delObj(ioctx, oid)
-					}
-				})
-				if err != nil {
-					logger.Log.Errorf("Can't list objects within pool (%s): %s", pool, err)
-					ioctx.Destroy()
-					continue
-				}
+			if err = srv.storage.ReconcileUsage(conn, tally); err != nil {
+				logger.Log.Error("Can't reconcile storage usage: ", err)
+			}
+
+			// Entries of deleted and expired objects
+			if err = srv.storage.PruneIndexes(conn); err != nil {
+				logger.Log.Error("Can't prune indexes: ", err)
+			}
+			srv.metrics.gcRuns.WithLabelValues("complete").Inc()
+			srv.metrics.gcDuration.Observe(time.Since(start).Seconds())
+		case <-srv.shutdownCh:
+			// Rados connection is shut down on return
+			ticker.Stop()
+			logger.Log.Info("Stopped")
+			return
+		}
+	}
+}
+
+// Delete expired objects of all tenant namespaces within pool, count usage of live ones.
+// Stops between objects on shutdown, returns false then
+func (srv *Server) collectPool(conn *rados.Conn, pool string, tally cephutils.UsageTally, delObj func(*rados.IOContext, string)) bool {
+	ioctx, err := conn.OpenIOContext(pool)
+	if err != nil {
+		logger.Log.Errorf("Can't opent pool (%s): %s", pool, err)
+		return true
+	}
+	defer ioctx.Destroy()
+
+	// Listing context is bound to namespace, objects are processed within separate one
+	objctx, err := conn.OpenIOContext(pool)
+	if err != nil {
+		logger.Log.Errorf("Can't opent pool (%s): %s", pool, err)
+		return true
+	}
+	defer objctx.Destroy()
 
-				ioctx.Destroy()
+	ioctx.SetNamespace(rados.AllNamespaces)
+	iter, err := ioctx.Iter()
+	if err != nil {
+		logger.Log.Errorf("Can't list objects within pool (%s): %s", pool, err)
+		return true
+	}
+
+	namespaces := make(map[string]bool)
+	for iter.Next() {
+		if srv.shuttingDown() {
+			iter.Close()
+			return false
+		}
+
+		srv.gcHeartbeat()
+		srv.metrics.gcScanned.Inc()
+		oid, ns := iter.Value(), iter.Namespace()
+		namespaces[ns] = true
+		objctx.SetNamespace(ns)
+
+		ttl, err := cephutils.GetObjTTL(objctx, oid)
+		if err != nil {
+			// Do nothing if no TTL attr
+			continue
+		}
+
+		now := time.Duration(time.Now().UTC().Unix())
+		if now > ttl && !cephutils.IsObjectLocked(objctx, oid) {
+			delObj(objctx, oid)
+			continue
+		}
+
+		if cephutils.IsPendingUpload(objctx, oid) {
+			// Unfinished uploads are accounted on completion, as usage counters do
+			continue
+		}
+		if stat, err := objctx.Stat(oid); err == nil {
+			if cephutils.IsPartObject(oid) {
+				// Multipart object is accounted once by its manifest
+				tally.Add(ns, pool, stat.Size, 0)
+			} else {
+				tally.Add(ns, pool, stat.Size, 1)
 			}
 		}
 	}
+	if err = iter.Err(); err != nil {
+		logger.Log.Errorf("Can't list objects within pool (%s): %s", pool, err)
+	}
+	iter.Close()
+
+	for ns := range namespaces {
+		objctx.SetNamespace(ns)
+		packed, err := srv.storage.CollectPacks(objctx)
+		if err != nil {
+			logger.Log.Errorf("Can't collect packed objects within pool (%s): %s", pool, err)
+			continue
+		}
+		if packed.Objects > 0 {
+			tally.Add(ns, pool, packed.Bytes, packed.Objects)
+		}
+	}
+
+	return true
 }
@@ -0,0 +1,218 @@
+package server
+
+import (
+	"encoding/json"
+	"github.com/GrvHldr/dfscache/logger"
+	"github.com/ceph/go-ceph/rados"
+	"github.com/julienschmidt/httprouter"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Storage is checked in background, so probes neither pile up on nor hang with unreachable cluster.
+// Check result older than storageCheckStale means check itself hangs
+const (
+	storageCheckInterval = 10 * time.Second
+	storageCheckStale    = 3 * storageCheckInterval
+	gcStuckSlack         = time.Minute
+)
+
+const healthOK = "ok"
+
+// Liveness and readiness of instance
+type healthState struct {
+	sync.Mutex
+	started   []Component
+	serving   map[Component]bool
+	cluster   error // Ceph cluster reachability
+	pool      error // IOContext of meta pool
+	checkedAt time.Time
+	gcBeat    time.Time // GC progress: tick or processed object
+}
+
+type healthReport struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks,omitempty"`
+}
+
+func (c Component) String() string {
+	switch c {
+	case HTTP:
+		return "http"
+	case ZMQDownloader:
+		return "zmq_download"
+	case ZMQUploader:
+		return "zmq_upload"
+	case GC:
+		return "gc"
+	}
+
+	return "unknown"
+}
+
+// Mark component as serving or stopped
+func (srv *Server) setServing(c Component, serving bool) {
+	srv.health.Lock()
+	defer srv.health.Unlock()
+
+	if srv.health.serving == nil {
+		srv.health.serving = make(map[Component]bool)
+	}
+	if _, ok := srv.health.serving[c]; !ok {
+		srv.health.started = append(srv.health.started, c)
+	}
+	srv.health.serving[c] = serving
+}
+
+// Record GC progress
+func (srv *Server) gcHeartbeat() {
+	srv.health.Lock()
+	srv.health.gcBeat = time.Now()
+	srv.health.Unlock()
+}
+
+// Check Ceph storage until shutdown. Connection is kept between checks and reopened once cluster check fails
+func (srv *Server) monitorStorage() {
+	var conn *rados.Conn
+	ticker := time.NewTicker(storageCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		conn = srv.checkStorage(conn)
+		select {
+		case <-ticker.C:
+		case <-srv.shutdownCh:
+			if conn != nil {
+				conn.Shutdown()
+			}
+			return
+		}
+	}
+}
+
+func (srv *Server) checkStorage(conn *rados.Conn) *rados.Conn {
+	var cluster, pool error
+	if conn == nil {
+		conn, cluster = srv.storage.NewRadosConn()
+	}
+	if cluster == nil {
+		if _, cluster = conn.GetFSID(); cluster != nil {
+			conn.Shutdown()
+			conn = nil
+		}
+	}
+	if cluster == nil {
+		// Pool is only opened: missing pool is reported as not ready instead of being created by probe
+		var ioctx *rados.IOContext
+		if ioctx, pool = conn.OpenIOContext(srv.storage.MetaPool()); pool == nil {
+			ioctx.Destroy()
+		}
+	}
+
+	srv.health.Lock()
+	if cluster != nil && srv.health.cluster == nil {
+		logger.Log.Errorf("Ceph cluster is unreachable: %s", cluster)
+	}
+	srv.health.cluster, srv.health.pool, srv.health.checkedAt = cluster, pool, time.Now()
+	srv.health.Unlock()
+
+	return conn
+}
+
+// Readiness of instance, checks are keyed by name
+func (srv *Server) readiness() (bool, map[string]string) {
+	srv.health.Lock()
+	defer srv.health.Unlock()
+
+	checks := make(map[string]string)
+	ready := true
+	fail := func(name, reason string) {
+		checks[name] = reason
+		ready = false
+	}
+
+	switch {
+	case srv.health.checkedAt.IsZero():
+		fail("ceph", "Not checked yet")
+	case time.Since(srv.health.checkedAt) > storageCheckStale:
+		fail("ceph", "Check hangs since "+srv.health.checkedAt.Format(time.RFC3339))
+	case srv.health.cluster != nil:
+		fail("ceph", srv.health.cluster.Error())
+	default:
+		checks["ceph"] = healthOK
+		if srv.health.pool != nil {
+			fail("pool", srv.health.pool.Error())
+		} else {
+			checks["pool"] = healthOK
+		}
+	}
+
+	for _, c := range srv.health.started {
+		if !srv.health.serving[c] {
+			fail(c.String(), "Not serving")
+			continue
+		}
+		checks[c.String()] = healthOK
+
+		// GC is stuck if it made no progress within two run intervals
+		stuck := 2*time.Duration(srv.cfg.CEPH_OPTIONS.GC_RUN_INTERVAL)*time.Second + gcStuckSlack
+		if c == GC && time.Since(srv.health.gcBeat) > stuck {
+			fail(c.String(), "No progress since "+srv.health.gcBeat.Format(time.RFC3339))
+		}
+	}
+
+	return ready, checks
+}
+
+// Health probes and metrics scrapes aren't authenticated
+func isProbe(r *http.Request) bool {
+	return r.Method == http.MethodGet && (r.URL.Path == "/healthz" || r.URL.Path == "/readyz" || r.URL.Path == "/metrics")
+}
+
+// Process is alive
+func serveHealthz(w http.ResponseWriter, _ *http.Request, _ httprouter.Params) {
+	writeHealth(w, http.StatusOK, &healthReport{Status: "alive"})
+}
+
+// Instance is able to serve, 503 Service Unavailable w/ failed checks otherwise
+func (srv *Server) serveReadyz(w http.ResponseWriter, _ *http.Request, _ httprouter.Params) {
+	if srv.shuttingDown() {
+		writeHealth(w, http.StatusServiceUnavailable, &healthReport{Status: "shutting down"})
+		return
+	}
+
+	ready, checks := srv.readiness()
+	if !ready {
+		writeHealth(w, http.StatusServiceUnavailable, &healthReport{Status: "not ready", Checks: checks})
+		return
+	}
+	writeHealth(w, http.StatusOK, &healthReport{Status: "ready", Checks: checks})
+}
+
+func writeHealth(w http.ResponseWriter, rc int, report *healthReport) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(rc)
+	json.NewEncoder(w).Encode(report)
+}
+
+// Bind HEALTH_LISTEN probes and metrics listener. Returns loop serving it
+func (srv *Server) listenHealth() (func(), error) {
+	router := httprouter.New()
+	router.GET("/healthz", serveHealthz)
+	router.GET("/readyz", srv.serveReadyz)
+	router.GET("/metrics", srv.serveMetrics)
+
+	// Probes are served in plain HTTP regardless of TLS settings
+	hs := &http.Server{Addr: srv.cfg.HEALTH_LISTEN, Handler: router}
+	ln, err := net.Listen("tcp", hs.Addr)
+	if err != nil {
+		return nil, err
+	}
+
+	return func() {
+		srv.serveUntilShutdown(hs, ln)
+	}, nil
+}
@@ -0,0 +1,116 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"github.com/GrvHldr/dfscache/tenants"
+	"net/http"
+	"strings"
+)
+
+type contextKey int
+
+const (
+	tenantContextKey contextKey = iota
+	principalContextKey
+)
+
+// Tenant by name. Empty name stands for anonymous tenant when no tenants configured
+func (srv *Server) tenantByName(name string) *tenants.Tenant {
+	if name == "" && len(srv.cfg.TENANTS) == 0 {
+		return srv.tenants.Default()
+	}
+
+	return srv.tenants.ByName(name)
+}
+
+// Authenticate request by upload policy, signed URL, API key, bearer token, client certificate
+// or HTTP basic auth credentials, in that order. Requests w/o any of them go to default tenant w/ anonymous scopes
+func (srv *Server) authenticate(r *http.Request) (p *principal, err error, rc int) {
+	q := r.URL.Query()
+	switch {
+	case isProbe(r):
+		// Orchestrator probes and metrics scrapes carry no credentials
+		p = &principal{Name: "-", Anonymous: true}
+		return
+	case uploadPolicyToken(r) != "":
+		// Upload w/ pre-signed policy instead of credentials
+		policy, t, perr := srv.requestUploadPolicy(r)
+		if perr != nil {
+			err, rc = perr, http.StatusForbidden
+			return
+		}
+		p = &principal{
+			Name:   "policy:" + policy.KeyID,
+			ID:     policy.Owner,
+			Tenant: t,
+			Scopes: []string{scopeWrite},
+			Policy: policy,
+		}
+		return
+	case q.Get(signatureParam) != "":
+		// Signed URL is verified before request gets to download handler
+		t, serr := srv.signedRequestTenant(r)
+		if serr != nil {
+			err, rc = serr, http.StatusForbidden
+			return
+		}
+		p = &principal{Name: "signed:" + q.Get("kid"), Tenant: t, Scopes: []string{scopeRead}, Signed: true}
+		return
+	case r.Header.Get(apiKeyHeader) != "":
+		p, err = srv.principalByAPIKey(r.Header.Get(apiKeyHeader))
+	case strings.HasPrefix(r.Header.Get("Authorization"), bearerPrefix):
+		p, err = srv.principalByJWT(strings.TrimPrefix(r.Header.Get("Authorization"), bearerPrefix))
+	case r.TLS != nil && len(r.TLS.VerifiedChains) > 0:
+		p, err = srv.principalByCertificate(r.TLS.VerifiedChains[0][0])
+	default:
+		p, err = srv.principalByCredentials(r)
+	}
+	if err != nil {
+		rc = http.StatusUnauthorized
+	}
+
+	return
+}
+
+// Tenant user identified by HTTP basic auth credentials, or anonymous principal
+func (srv *Server) principalByCredentials(r *http.Request) (*principal, error) {
+	if user, password, ok := r.BasicAuth(); ok {
+		t := srv.tenants.ByHTTPCredentials(user, password)
+		if t == nil {
+			return nil, fmt.Errorf("Invalid credentials")
+		}
+		return &principal{Name: user, ID: "user:" + user, Tenant: t, Scopes: userScopes}, nil
+	}
+
+	t := srv.tenants.Default()
+	if t == nil || srv.signatureRequired(r) {
+		return nil, fmt.Errorf("Credentials required")
+	}
+
+	return &principal{
+		Name:      "-",
+		Tenant:    t,
+		Scopes:    srv.cfg.HTTP_OPTIONS.ANONYMOUS_SCOPES,
+		Anonymous: true,
+	}, nil
+}
+
+// Tenant attached to request by router
+func tenantFromContext(r *http.Request) *tenants.Tenant {
+	return r.Context().Value(tenantContextKey).(*tenants.Tenant)
+}
+
+// Authenticated principal attached to request by router, nil for S3 API requests
+func principalFromContext(r *http.Request) *principal {
+	p, _ := r.Context().Value(principalContextKey).(*principal)
+	return p
+}
+
+func withTenant(r *http.Request, t *tenants.Tenant) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), tenantContextKey, t))
+}
+
+func withPrincipal(r *http.Request, p *principal) *http.Request {
+	return withTenant(r.WithContext(context.WithValue(r.Context(), principalContextKey, p)), p.Tenant)
+}
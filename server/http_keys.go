@@ -0,0 +1,174 @@
+package server
+
+import (
+	"errors"
+	"github.com/GrvHldr/dfscache/cephutils"
+	"github.com/GrvHldr/dfscache/logger"
+	"github.com/julienschmidt/httprouter"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// Client key from request path
+func requestKey(p httprouter.Params) string {
+	return strings.TrimPrefix(p.ByName("key"), "/")
+}
+
+// Object stored under client key, 404 if there's no such key
+func (srv *Server) retrieveKeyedObj(w http.ResponseWriter, r *http.Request, p httprouter.Params) *cephutils.RadosObj {
+	key := requestKey(p)
+	if err := cephutils.ValidateKey(key); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil
+	}
+
+	obj, err := srv.storage.KeyedRadosObj(tenantFromContext(r).Namespace, key)
+	if err != nil {
+		http.Error(w, "Key not found", http.StatusNotFound)
+		return nil
+	}
+
+	return obj
+}
+
+var errKeyReplaceDenied = errors.New(http.StatusText(http.StatusForbidden))
+
+// Check if object under key may be replaced by request principal
+func keyReplaceCheck(r *http.Request) func(existing *cephutils.RadosObj) error {
+	p := principalFromContext(r)
+	return func(existing *cephutils.RadosObj) error {
+		if !p.canModify(&existing.BaseRadosObj) {
+			return errKeyReplaceDenied
+		}
+		return nil
+	}
+}
+
+// Respond to failed keyed upload start or finish
+func keyUploadError(w http.ResponseWriter, err error) {
+	switch err {
+	case cephutils.ErrKeyExists:
+		http.Error(w, err.Error(), http.StatusPreconditionFailed)
+	case cephutils.ErrKeyLocked:
+		http.Error(w, err.Error(), http.StatusConflict)
+	case errKeyReplaceDenied:
+		http.Error(w, err.Error(), http.StatusForbidden)
+	default:
+		logger.Log.Error(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func (srv *Server) serveKeyDownload(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	obj := srv.retrieveKeyedObj(w, r, p)
+	if obj == nil {
+		return
+	}
+	defer obj.Destroy()
+
+	if checkAccess(w, r, obj, false) {
+		serveObjectContent(w, r, obj)
+	}
+}
+
+// Upload under client key. Existing object is replaced unless "If-None-Match: *" is sent
+func (srv *Server) serveKeyUpload(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	key := requestKey(p)
+	if err := cephutils.ValidateKey(key); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if r.ContentLength < 0 {
+		http.Error(w, "Content-Length required", http.StatusLengthRequired)
+		return
+	}
+	if _, ok := srv.limitUpload(w, r, 0); !ok {
+		return
+	}
+
+	tenant := tenantFromContext(r)
+	length := uint64(r.ContentLength)
+	hint := placementHint(r)
+	if _, _, err := srv.storage.SelectPlacement(length, hint); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	meta, err := requestMeta(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	owner, acl, err := requestOwnership(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	opts := cephutils.ObjOptions{
+		FileName:  path.Base(key),
+		Size:      length,
+		Placement: hint,
+		Namespace: tenant.Namespace,
+		TTL:       tenant.ObjectTTL,
+		Meta:      meta,
+		Key:       key,
+		Owner:     owner,
+		ACL:       acl,
+	}
+	overwrite := r.Header.Get("If-None-Match") != "*"
+	obj, err := srv.storage.NewKeyedRadosObj(opts, length, overwrite, keyReplaceCheck(r), srv.resumableTimeout())
+	if err != nil {
+		keyUploadError(w, err)
+		return
+	}
+	defer obj.Destroy()
+
+	if err = obj.CheckQuota(length, tenant.QuotaBytes, tenant.QuotaObjects); err != nil {
+		obj.Delete()
+		if _, ok := err.(*cephutils.QuotaError); ok {
+			http.Error(w, err.Error(), http.StatusInsufficientStorage)
+			return
+		}
+		logger.Log.Error(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	obj.LockRados()
+	_, err = obj.WriteResumable(r.Body, 0, srv.resumableTimeout())
+	obj.UnlockRados()
+	if err != nil || obj.Size != length {
+		// Key still refers to previous object, partial content is never served
+		obj.Delete()
+		if err == nil {
+			http.Error(w, "Content is shorter than Content-Length", http.StatusBadRequest)
+			return
+		}
+		uploadReadError(w, err)
+		return
+	}
+
+	if err = obj.Finish(tenant.ObjectTTL); err != nil {
+		keyUploadError(w, err)
+		return
+	}
+
+	srv.writeObjectJSON(w, r, obj.RadosObj)
+}
+
+func (srv *Server) serveKeyDelete(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	obj := srv.retrieveKeyedObj(w, r, p)
+	if obj == nil {
+		return
+	}
+	defer obj.Destroy()
+
+	if !checkAccess(w, r, obj, true) {
+		return
+	}
+	if err := obj.Delete(); err != nil {
+		http.Error(w, err.Error(), http.StatusNotAcceptable)
+		return
+	}
+}
@@ -0,0 +1,234 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"github.com/GrvHldr/dfscache/logger"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+// Mutual TLS. Client certificates are verified against HTTP_OPTIONS.CLIENT_CA_FILE bundle and revocation list,
+// certificate subject common name or SAN is mapped to principal by HTTP_OPTIONS.CLIENT_CERTS
+const (
+	clientAuthOptional = "optional"
+	clientAuthRequired = "required"
+)
+
+// Load certificates of PEM bundle
+func loadCertBundle(fname string) ([]*x509.Certificate, error) {
+	raw, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return nil, err
+	}
+
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		if block, raw = pem.Decode(raw); block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("No certificates found in %s", fname)
+	}
+
+	return certs, nil
+}
+
+// Load revocation list (PEM or DER) signed by one of CA certificates
+func loadCRL(fname string, cas []*x509.Certificate) (map[string]map[string]bool, error) {
+	raw, err := ioutil.ReadFile(fname)
+	if err != nil {
+		return nil, err
+	}
+	if block, _ := pem.Decode(raw); block != nil {
+		raw = block.Bytes
+	}
+
+	crl, err := x509.ParseRevocationList(raw)
+	if err != nil {
+		return nil, err
+	}
+	var issuer *x509.Certificate
+	for _, ca := range cas {
+		if crl.CheckSignatureFrom(ca) == nil {
+			issuer = ca
+			break
+		}
+	}
+	if issuer == nil {
+		return nil, fmt.Errorf("Revocation list is not signed by client CA")
+	}
+
+	revoked := map[string]map[string]bool{string(issuer.RawSubject): {}}
+	for _, entry := range crl.RevokedCertificateEntries {
+		revoked[string(issuer.RawSubject)][entry.SerialNumber.String()] = true
+	}
+
+	return revoked, nil
+}
+
+// Client certificates revocation list, reloaded along w/ server certificates
+type crlStore struct {
+	sync.RWMutex
+	fname   string
+	cas     []*x509.Certificate
+	revoked map[string]map[string]bool // Serial numbers of revoked client certificates by issuer
+	mtime   time.Time
+}
+
+// Load revocation list, current one is kept on failure
+func (c *crlStore) load() error {
+	fi, err := os.Stat(c.fname)
+	if err != nil {
+		return err
+	}
+	revoked, err := loadCRL(c.fname, c.cas)
+	if err != nil {
+		return err
+	}
+
+	c.Lock()
+	c.revoked, c.mtime = revoked, fi.ModTime()
+	c.Unlock()
+
+	return nil
+}
+
+// Check if revocation list file is modified since loaded, false if there is no list
+func (c *crlStore) modified() bool {
+	if c == nil {
+		return false
+	}
+	c.RLock()
+	defer c.RUnlock()
+
+	fi, err := os.Stat(c.fname)
+	return err == nil && !fi.ModTime().Equal(c.mtime)
+}
+
+// Reload revocation list if there is one
+func (c *crlStore) reload() {
+	if c == nil {
+		return
+	}
+	if err := c.load(); err != nil {
+		logger.Log.Errorf("Revocation list reload failed, current one is kept: %s", err)
+		return
+	}
+	logger.Log.Info("Revocation list reloaded")
+}
+
+func (c *crlStore) isRevoked(cert *x509.Certificate) bool {
+	if c == nil {
+		return false
+	}
+	c.RLock()
+	defer c.RUnlock()
+
+	return c.revoked[string(cert.RawIssuer)][cert.SerialNumber.String()]
+}
+
+// Reject revoked client certificates after chain is verified
+func (srv *Server) verifyNotRevoked(_ [][]byte, chains [][]*x509.Certificate) error {
+	for _, chain := range chains {
+		for _, cert := range chain {
+			if srv.revokedCerts.isRevoked(cert) {
+				return fmt.Errorf("Certificate %s is revoked", cert.Subject)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Client certificates verification TLS settings, nil if mutual TLS is not configured
+func (srv *Server) clientAuthTLSConfig() (*tls.Config, error) {
+	opts := srv.cfg.HTTP_OPTIONS
+	if opts.CLIENT_CA_FILE == "" {
+		return nil, nil
+	}
+
+	cas, err := loadCertBundle(opts.CLIENT_CA_FILE)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	for _, ca := range cas {
+		pool.AddCert(ca)
+	}
+
+	if opts.CLIENT_CRL_FILE != "" {
+		crl := &crlStore{fname: opts.CLIENT_CRL_FILE, cas: cas}
+		if err = crl.load(); err != nil {
+			return nil, err
+		}
+		srv.revokedCerts = crl
+	}
+
+	cfg := &tls.Config{
+		ClientCAs:             pool,
+		ClientAuth:            tls.VerifyClientCertIfGiven,
+		VerifyPeerCertificate: srv.verifyNotRevoked,
+	}
+	switch opts.CLIENT_AUTH {
+	case "", clientAuthOptional:
+	case clientAuthRequired:
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	default:
+		return nil, fmt.Errorf("Unknown client auth mode '%s'", opts.CLIENT_AUTH)
+	}
+
+	return cfg, nil
+}
+
+// Certificate subject common name and SANs
+func certNames(cert *x509.Certificate) []string {
+	names := []string{cert.Subject.CommonName}
+	names = append(names, cert.DNSNames...)
+	names = append(names, cert.EmailAddresses...)
+	for _, ip := range cert.IPAddresses {
+		names = append(names, ip.String())
+	}
+	for _, uri := range cert.URIs {
+		names = append(names, uri.String())
+	}
+
+	return names
+}
+
+// Principal mapped to verified client certificate
+func (srv *Server) principalByCertificate(cert *x509.Certificate) (*principal, error) {
+	names := certNames(cert)
+	for _, m := range srv.cfg.HTTP_OPTIONS.CLIENT_CERTS {
+		for _, name := range names {
+			if name == "" || name != m.SUBJECT {
+				continue
+			}
+			t := srv.tenantByName(m.TENANT)
+			if t == nil {
+				return nil, fmt.Errorf("Unknown tenant")
+			}
+			pname := m.NAME
+			if pname == "" {
+				pname = name
+			}
+			return &principal{Name: pname, ID: "cert:" + pname, Tenant: t, Scopes: m.SCOPES}, nil
+		}
+	}
+
+	return nil, fmt.Errorf("Client certificate %s is not authorized", cert.Subject)
+}
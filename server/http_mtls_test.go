@@ -0,0 +1,160 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/x509"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Revocation list of CA revoking certificates of serials, written to DER or PEM file of test temp dir
+func writeTestCRL(t *testing.T, ca *x509.Certificate, caKey *ecdsa.PrivateKey, usePEM bool, serials ...*big.Int) string {
+	tmpl := &x509.RevocationList{
+		Number:     big.NewInt(time.Now().UnixNano()),
+		ThisUpdate: time.Now().Add(-time.Hour),
+		NextUpdate: time.Now().Add(time.Hour),
+	}
+	for _, serial := range serials {
+		tmpl.RevokedCertificateEntries = append(tmpl.RevokedCertificateEntries,
+			x509.RevocationListEntry{SerialNumber: serial, RevocationTime: time.Now()})
+	}
+	raw, err := x509.CreateRevocationList(rand.Reader, tmpl, ca, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fname := filepath.Join(t.TempDir(), "clients.crl")
+	if usePEM {
+		writePEM(t, fname, "X509 CRL", raw)
+	} else if err = ioutil.WriteFile(fname, raw, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return fname
+}
+
+// Client certificate issued by CA
+func newTestClientCert(t *testing.T, ca *x509.Certificate, caKey *ecdsa.PrivateKey, name string) *x509.Certificate {
+	certFile, _ := writeTestCert(t, ca, caKey, name)
+	certs, err := loadCertBundle(certFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return certs[0]
+}
+
+func TestLoadCRL(t *testing.T) {
+	ca, caKey := newTestCA(t, "client CA")
+	other, otherKey := newTestCA(t, "other CA")
+	revoked := newTestClientCert(t, ca, caKey, "revoked")
+
+	tests := []struct {
+		name  string
+		fname string
+		ok    bool
+	}{
+		{"der", writeTestCRL(t, ca, caKey, false, revoked.SerialNumber), true},
+		{"pem", writeTestCRL(t, ca, caKey, true, revoked.SerialNumber), true},
+		{"other issuer", writeTestCRL(t, other, otherKey, true, revoked.SerialNumber), false},
+		{"missing", filepath.Join(t.TempDir(), "missing.crl"), false},
+	}
+
+	for _, tt := range tests {
+		got, err := loadCRL(tt.fname, []*x509.Certificate{ca})
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: error = %v", tt.name, err)
+			continue
+		}
+		if err == nil && !got[string(ca.RawSubject)][revoked.SerialNumber.String()] {
+			t.Errorf("%s: serial %s is not revoked", tt.name, revoked.SerialNumber)
+		}
+	}
+}
+
+func TestVerifyNotRevoked(t *testing.T) {
+	ca, caKey := newTestCA(t, "client CA")
+	other, otherKey := newTestCA(t, "other CA")
+	revoked := newTestClientCert(t, ca, caKey, "revoked")
+	valid := newTestClientCert(t, ca, caKey, "valid")
+	// Same serial, but other issuer
+	foreign := newTestClientCert(t, other, otherKey, "foreign")
+	foreign.SerialNumber = revoked.SerialNumber
+
+	crl := &crlStore{fname: writeTestCRL(t, ca, caKey, true, revoked.SerialNumber), cas: []*x509.Certificate{ca}}
+	if err := crl.load(); err != nil {
+		t.Fatal(err)
+	}
+	srv := &Server{revokedCerts: crl}
+
+	tests := []struct {
+		name string
+		cert *x509.Certificate
+		ok   bool
+	}{
+		{"revoked", revoked, false},
+		{"valid", valid, true},
+		{"other issuer", foreign, true},
+	}
+
+	for _, tt := range tests {
+		err := srv.verifyNotRevoked(nil, [][]*x509.Certificate{{tt.cert, ca}})
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: error = %v", tt.name, err)
+		}
+	}
+
+	if err := (&Server{}).verifyNotRevoked(nil, [][]*x509.Certificate{{revoked, ca}}); err != nil {
+		t.Errorf("Certificate rejected w/o revocation list: %s", err)
+	}
+}
+
+func TestCRLStoreReload(t *testing.T) {
+	ca, caKey := newTestCA(t, "client CA")
+	first := newTestClientCert(t, ca, caKey, "first")
+	second := newTestClientCert(t, ca, caKey, "second")
+
+	fname := writeTestCRL(t, ca, caKey, true, first.SerialNumber)
+	crl := &crlStore{fname: fname, cas: []*x509.Certificate{ca}}
+	if err := crl.load(); err != nil {
+		t.Fatal(err)
+	}
+	if crl.modified() {
+		t.Error("Revocation list is modified right after load")
+	}
+
+	// Replace list, modification time is moved forward explicitly for coarse file system timestamps
+	raw, err := ioutil.ReadFile(writeTestCRL(t, ca, caKey, true, second.SerialNumber))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(fname, raw, 0600); err != nil {
+		t.Fatal(err)
+	}
+	mtime := time.Now().Add(time.Minute)
+	if err = os.Chtimes(fname, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	if !crl.modified() {
+		t.Fatal("Revocation list change is not detected")
+	}
+
+	crl.reload()
+	if crl.isRevoked(first) || !crl.isRevoked(second) {
+		t.Errorf("Revocation list is not reloaded: first %v, second %v", crl.isRevoked(first), crl.isRevoked(second))
+	}
+
+	// Broken list keeps current one
+	if err = ioutil.WriteFile(fname, []byte("broken"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	crl.reload()
+	if !crl.isRevoked(second) {
+		t.Error("Current revocation list is dropped on failed reload")
+	}
+}
@@ -0,0 +1,246 @@
+package server
+
+import (
+	"encoding/json"
+	"github.com/GrvHldr/dfscache/cephutils"
+	"github.com/GrvHldr/dfscache/logger"
+	"github.com/julienschmidt/httprouter"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const defaultMultipartTimeout = 24 * time.Hour
+
+type multipartUpload struct {
+	Pool string `json:"pool"`
+	Oid  string `json:"oid"`
+	Uri  string `json:"uri"`
+}
+
+type uploadedPart struct {
+	Number int    `json:"part"`
+	Size   uint64 `json:"size"`
+	ETag   string `json:"etag"`
+}
+
+type completeMultipartRequest struct {
+	Parts []cephutils.CompletedPart `json:"parts"`
+}
+
+// Incomplete multipart upload lifetime since initiation
+func (srv *Server) multipartTimeout() time.Duration {
+	if t := srv.cfg.HTTP_OPTIONS.MULTIPART_UPLOAD_TIMEOUT; t > 0 {
+		return time.Duration(t) * time.Second
+	}
+
+	return defaultMultipartTimeout
+}
+
+// Retrieve multipart upload which is not completed yet
+func (srv *Server) retrievePendingMultipart(w http.ResponseWriter, r *http.Request, p httprouter.Params) *cephutils.RadosObj {
+	obj, err, rc := srv.retrieveRadosObj(tenantFromContext(r), p)
+	if err != nil {
+		http.Error(w, err.Error(), rc)
+		return nil
+	}
+
+	if !obj.IsMultipartPending() {
+		obj.Destroy()
+		http.Error(w, "No such multipart upload", http.StatusNotFound)
+		return nil
+	}
+	if !checkAccess(w, r, obj, true) {
+		obj.Destroy()
+		return nil
+	}
+
+	return obj
+}
+
+// Initiate multipart upload
+func (srv *Server) serveMultipartInitiate(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	tenant := tenantFromContext(r)
+	hint := placementHint(r)
+	if _, _, err := srv.storage.SelectPlacement(0, hint); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	meta, err := requestMeta(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	owner, acl, err := requestOwnership(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	newObj, err := srv.storage.NewRadosObj(cephutils.ObjOptions{
+		FileName:  r.URL.Query().Get("filename"),
+		Placement: hint,
+		Namespace: tenant.Namespace,
+		TTL:       tenant.ObjectTTL,
+		NoPacking: true,
+		Meta:      meta,
+		Owner:     owner,
+		ACL:       acl,
+	})
+	if err != nil {
+		logger.Log.Error(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer newObj.Destroy()
+
+	if err = newObj.CheckQuota(0, tenant.QuotaBytes, tenant.QuotaObjects); err != nil {
+		if _, ok := err.(*cephutils.QuotaError); ok {
+			http.Error(w, err.Error(), http.StatusInsufficientStorage)
+			return
+		}
+		logger.Log.Error(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err = newObj.StartMultipart(srv.multipartTimeout()); err != nil {
+		logger.Log.Error(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	result, err := json.Marshal(multipartUpload{
+		Pool: newObj.Pool,
+		Oid:  newObj.Oid.String(),
+		Uri:  "/multipart/" + newObj.Pool + "/" + newObj.Oid.String(),
+	})
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		logger.Log.Error(err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(result)
+}
+
+// Limit content of part being uploaded, so parts pending completion fit upload limit (0 - unlimited)
+// and tenant and pool byte quotas together. Parts are accounted in usage on upload completion only
+func partReader(w http.ResponseWriter, r *http.Request, obj *cephutils.RadosObj, number int, limit, quotaBytes uint64) (io.Reader, error) {
+	pending, err := obj.PendingPartsSize(number)
+	if err != nil {
+		return nil, err
+	}
+
+	rd := r.Body
+	if limit > 0 {
+		if pending > limit {
+			return nil, &http.MaxBytesError{Limit: int64(limit)}
+		}
+		rd = http.MaxBytesReader(w, r.Body, int64(limit-pending))
+	}
+
+	return obj.QuotaReader(rd, quotaBytes, pending)
+}
+
+// Upload numbered part, may be retried and sent in parallel w/ other parts
+func (srv *Server) serveMultipartPart(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	number, err := strconv.Atoi(p.ByName("part"))
+	if err != nil || number < 1 || number > cephutils.MaxPartNumber {
+		http.Error(w, "Invalid part number", http.StatusBadRequest)
+		return
+	}
+
+	limit, ok := srv.limitUpload(w, r, 0)
+	if !ok {
+		return
+	}
+
+	obj := srv.retrievePendingMultipart(w, r, p)
+	if obj == nil {
+		return
+	}
+	defer obj.Destroy()
+
+	rd, err := partReader(w, r, obj, number, limit, tenantFromContext(r).QuotaBytes)
+	if err != nil {
+		uploadReadError(w, err)
+		return
+	}
+	size, etag, err := obj.WritePart(number, rd)
+	if err != nil {
+		uploadReadError(w, err)
+		return
+	}
+	result, err := json.Marshal(uploadedPart{Number: number, Size: size, ETag: etag})
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		logger.Log.Error(err)
+		return
+	}
+	w.Header().Set("ETag", `"`+etag+`"`)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(result)
+}
+
+// Complete multipart upload w/ list of parts, object becomes available
+func (srv *Server) serveMultipartComplete(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	var req completeMultipartRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	obj := srv.retrievePendingMultipart(w, r, p)
+	if obj == nil {
+		return
+	}
+	defer obj.Destroy()
+
+	total, err := obj.MultipartSize(req.Parts)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	tenant := tenantFromContext(r)
+	limit := tenant.UploadLimit(srv.cfg.HTTP_OPTIONS.MAX_UPLOAD_SIZE)
+	if limit > 0 && total > limit {
+		http.Error(w, "Upload size exceeds limit", http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err = obj.CheckQuota(total, tenant.QuotaBytes, tenant.QuotaObjects); err != nil {
+		if _, ok := err.(*cephutils.QuotaError); ok {
+			http.Error(w, err.Error(), http.StatusInsufficientStorage)
+			return
+		}
+		logger.Log.Error(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err = obj.CompleteMultipart(req.Parts, tenant.ObjectTTL); err != nil {
+		logger.Log.Error(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	logger.Log.Infof("Multipart upload completed for %s: %d parts", obj.Oid, len(req.Parts))
+
+	srv.writeObjectJSON(w, r, obj)
+}
+
+// Abort multipart upload, uploaded parts are discarded
+func (srv *Server) serveMultipartAbort(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	obj := srv.retrievePendingMultipart(w, r, p)
+	if obj == nil {
+		return
+	}
+	defer obj.Destroy()
+
+	if err := obj.Delete(); err != nil {
+		http.Error(w, err.Error(), http.StatusNotAcceptable)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,237 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/GrvHldr/dfscache/config"
+	"github.com/GrvHldr/dfscache/logger"
+	"github.com/GrvHldr/dfscache/tenants"
+	"github.com/julienschmidt/httprouter"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Pre-signed upload policies. Token is "<base64url policy JSON>.<hex HMAC-SHA256 of encoded policy>",
+// signed by download URLs signing key, and lets client w/o credentials upload into policy tenant
+const (
+	uploadPolicyParam  = "policy"
+	uploadPolicyHeader = "X-Upload-Policy"
+)
+
+type uploadPolicy struct {
+	Tenant       string   `json:"tenant"`
+	Expires      int64    `json:"expires"`                 // Token expiration, unix time
+	MaxSize      uint64   `json:"max_size,omitempty"`      // Upload size limit, tenant limit if 0
+	ContentTypes []string `json:"content_types,omitempty"` // Allowed media types, "type/*" matches any subtype
+	TTL          int64    `json:"ttl,omitempty"`           // Object lifetime in seconds, tenant one if 0
+	Owner        string   `json:"owner,omitempty"`         // Id of principal policy is issued by, owner of uploads
+	KeyID        string   `json:"kid"`
+}
+
+type policyRequest struct {
+	MaxSize      uint64   `json:"max_size"`
+	ContentTypes []string `json:"content_types"`
+	TTL          int64    `json:"ttl"`        // Up to lifetime of tenant objects
+	ExpiresIn    int64    `json:"expires_in"` // Token lifetime in seconds, up to and by default HTTP_OPTIONS.SIGNED_URL_TTL
+}
+
+type policyResponse struct {
+	Token   string `json:"token"`
+	Expires int64  `json:"expires"`
+}
+
+func policySignature(secret []byte, encoded string) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(encoded))
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Upload policy token of request, empty if there's none
+func uploadPolicyToken(r *http.Request) string {
+	if token := r.URL.Query().Get(uploadPolicyParam); token != "" {
+		return token
+	}
+
+	return r.Header.Get(uploadPolicyHeader)
+}
+
+// Issue upload policy token w/ active signing key, the first one of keys
+func (p *uploadPolicy) token(keys []config.SigningKey) (string, error) {
+	if len(keys) == 0 {
+		return "", fmt.Errorf("Upload policies signing is not configured")
+	}
+	p.KeyID = keys[0].KEY_ID
+
+	raw, err := json.Marshal(p)
+	if err != nil {
+		return "", err
+	}
+	encoded := base64.RawURLEncoding.EncodeToString(raw)
+
+	return encoded + "." + policySignature([]byte(keys[0].SECRET), encoded), nil
+}
+
+// Verify upload policy token of request, policy and tenant upload is stored for are returned
+func (srv *Server) requestUploadPolicy(r *http.Request) (*uploadPolicy, *tenants.Tenant, error) {
+	isUpload := r.Method == http.MethodPost && r.URL.Path == "/upload" ||
+		r.Method == http.MethodPut && strings.HasPrefix(r.URL.Path, "/upload/")
+	if !isUpload {
+		return nil, nil, fmt.Errorf("Upload policy is valid for uploads only")
+	}
+
+	parts := strings.SplitN(uploadPolicyToken(r), ".", 2)
+	if len(parts) != 2 {
+		return nil, nil, fmt.Errorf("Malformed upload policy")
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, nil, fmt.Errorf("Malformed upload policy")
+	}
+	p := new(uploadPolicy)
+	if err = json.Unmarshal(raw, p); err != nil {
+		return nil, nil, fmt.Errorf("Malformed upload policy")
+	}
+
+	secret := srv.signingSecret(p.KeyID)
+	if secret == nil {
+		return nil, nil, fmt.Errorf("Unknown signing key")
+	}
+	if !hmac.Equal([]byte(policySignature(secret, parts[0])), []byte(parts[1])) {
+		return nil, nil, fmt.Errorf("Signature mismatch")
+	}
+	if p.Expires < time.Now().UTC().Unix() {
+		return nil, nil, fmt.Errorf("Upload policy expired")
+	}
+
+	t := srv.tenantByName(p.Tenant)
+	if t == nil {
+		return nil, nil, fmt.Errorf("Unknown tenant")
+	}
+
+	return p, t, nil
+}
+
+// Upload policy request is authorized by, nil for uploads w/ credentials
+func policyFromContext(r *http.Request) *uploadPolicy {
+	if p := principalFromContext(r); p != nil {
+		return p.Policy
+	}
+
+	return nil
+}
+
+// Size limit of policy upload, 0 if policy doesn't limit it
+func (p *uploadPolicy) limit(tenantLimit uint64) uint64 {
+	if p.MaxSize > 0 && (tenantLimit == 0 || p.MaxSize < tenantLimit) {
+		return p.MaxSize
+	}
+
+	return tenantLimit
+}
+
+// Check if content type is allowed by policy
+func (p *uploadPolicy) allowsType(contentType string) bool {
+	if len(p.ContentTypes) == 0 {
+		return true
+	}
+
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	for _, allowed := range p.ContentTypes {
+		allowed = strings.ToLower(allowed)
+		if allowed == mediaType || strings.HasSuffix(allowed, "/*") && strings.HasPrefix(mediaType, strings.TrimSuffix(allowed, "*")) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Object lifetime of policy upload, capped by lifetime of tenant objects
+func (p *uploadPolicy) objectTTL(tenantTTL time.Duration) time.Duration {
+	if p.TTL > 0 && p.TTL <= int64(tenantTTL/time.Second) {
+		return time.Duration(p.TTL) * time.Second
+	}
+
+	return tenantTTL
+}
+
+// Lifetime of tenant objects, CEPH_OPTIONS.OBJECT_TTL if tenant doesn't set it
+func (srv *Server) tenantObjectTTL(t *tenants.Tenant) time.Duration {
+	if t.ObjectTTL > 0 {
+		return t.ObjectTTL
+	}
+
+	return time.Duration(srv.cfg.CEPH_OPTIONS.OBJECT_TTL) * time.Second
+}
+
+// Mint upload policy token for caller tenant. Credentials are required, so anonymous clients can't get tokens
+func (srv *Server) serveUploadPolicy(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	if principalFromContext(r).Anonymous {
+		w.Header().Set("WWW-Authenticate", `Basic realm="dfscache"`)
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+
+	req := new(policyRequest)
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	for _, ct := range req.ContentTypes {
+		if _, _, err := mime.ParseMediaType(ct); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid content type '%s'", ct), http.StatusBadRequest)
+			return
+		}
+	}
+
+	tenant := tenantFromContext(r)
+	if limit := tenant.UploadLimit(srv.cfg.HTTP_OPTIONS.MAX_UPLOAD_SIZE); limit > 0 && req.MaxSize > limit {
+		http.Error(w, "Upload size exceeds limit", http.StatusBadRequest)
+		return
+	}
+
+	lifetime := srv.signedURLTTL()
+	if req.ExpiresIn < 0 || req.ExpiresIn > int64(lifetime/time.Second) {
+		http.Error(w, fmt.Sprintf("Token lifetime must be within 0..%d seconds", lifetime/time.Second), http.StatusBadRequest)
+		return
+	}
+	if req.ExpiresIn > 0 {
+		lifetime = time.Duration(req.ExpiresIn) * time.Second
+	}
+	if maxTTL := srv.tenantObjectTTL(tenant); req.TTL < 0 || req.TTL > int64(maxTTL/time.Second) {
+		http.Error(w, fmt.Sprintf("Object lifetime must be within 0..%d seconds", maxTTL/time.Second), http.StatusBadRequest)
+		return
+	}
+	p := &uploadPolicy{
+		Tenant:       tenant.Name,
+		Expires:      time.Now().UTC().Add(lifetime).Unix(),
+		MaxSize:      req.MaxSize,
+		ContentTypes: req.ContentTypes,
+		TTL:          req.TTL,
+		Owner:        principalFromContext(r).ID,
+	}
+	token, err := p.token(srv.cfg.HTTP_OPTIONS.SIGNING_KEYS)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotImplemented)
+		return
+	}
+
+	result, err := json.Marshal(policyResponse{Token: token, Expires: p.Expires})
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		logger.Log.Error(err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(result)
+}
@@ -0,0 +1,166 @@
+package server
+
+import (
+	"github.com/GrvHldr/dfscache/config"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRequestUploadPolicy(t *testing.T) {
+	srv := newTestServer(testSigningConfig())
+
+	token := func(p *uploadPolicy, keys []config.SigningKey) string {
+		tok, err := p.token(keys)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return tok
+	}
+	expires := time.Now().UTC().Add(time.Hour).Unix()
+	valid := token(&uploadPolicy{Tenant: "builds", Expires: expires}, srv.cfg.HTTP_OPTIONS.SIGNING_KEYS)
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		token  string
+		header bool
+		ok     bool
+	}{
+		{"form upload", http.MethodPost, "/upload", valid, false, true},
+		{"raw upload", http.MethodPut, "/upload/file.bin", valid, false, true},
+		{"header", http.MethodPost, "/upload", valid, true, true},
+		{"download", http.MethodGet, "/download/pool/oid", valid, false, false},
+		{"other upload route", http.MethodPost, "/upload/file.bin", valid, false, false},
+		{"expired", http.MethodPost, "/upload",
+			token(&uploadPolicy{Tenant: "builds", Expires: time.Now().UTC().Add(-time.Minute).Unix()}, srv.cfg.HTTP_OPTIONS.SIGNING_KEYS), false, false},
+		{"unknown key", http.MethodPost, "/upload",
+			token(&uploadPolicy{Tenant: "builds", Expires: expires}, []config.SigningKey{{KEY_ID: "k3", SECRET: "new"}}), false, false},
+		{"wrong secret", http.MethodPost, "/upload",
+			token(&uploadPolicy{Tenant: "builds", Expires: expires}, []config.SigningKey{{KEY_ID: "k2", SECRET: "guess"}}), false, false},
+		{"unknown tenant", http.MethodPost, "/upload",
+			token(&uploadPolicy{Tenant: "other", Expires: expires}, srv.cfg.HTTP_OPTIONS.SIGNING_KEYS), false, false},
+		{"no signature", http.MethodPost, "/upload", valid[:len(valid)-65], false, false},
+		{"malformed", http.MethodPost, "/upload", "not a policy", false, false},
+	}
+
+	for _, tt := range tests {
+		target := tt.path
+		if !tt.header {
+			target += "?" + uploadPolicyParam + "=" + url.QueryEscape(tt.token)
+		}
+		r := httptest.NewRequest(tt.method, target, nil)
+		if tt.header {
+			r.Header.Set(uploadPolicyHeader, tt.token)
+		}
+
+		p, tenant, err := srv.requestUploadPolicy(r)
+		if tt.ok && (err != nil || p == nil || tenant.Name != "builds") {
+			t.Errorf("%s: policy = %v, error = %v", tt.name, p, err)
+		}
+		if !tt.ok && err == nil {
+			t.Errorf("%s: upload policy accepted", tt.name)
+		}
+	}
+}
+
+func TestUploadPolicyAllowsType(t *testing.T) {
+	p := &uploadPolicy{ContentTypes: []string{"image/*", "Application/PDF"}}
+
+	tests := []struct {
+		contentType string
+		want        bool
+	}{
+		{"image/png", true},
+		{"IMAGE/jpeg; q=1", true},
+		{"application/pdf", true},
+		{"application/pdfx", false},
+		{"imagex/png", false},
+		{"text/plain", false},
+		{"", false},
+	}
+
+	for _, tt := range tests {
+		if got := p.allowsType(tt.contentType); got != tt.want {
+			t.Errorf("allowsType(%q) = %v, want %v", tt.contentType, got, tt.want)
+		}
+	}
+	if !(&uploadPolicy{}).allowsType("anything/else") {
+		t.Error("Policy w/o content types must allow any type")
+	}
+}
+
+func TestUploadPolicyLimit(t *testing.T) {
+	tests := []struct {
+		maxSize, tenantLimit, want uint64
+	}{
+		{0, 0, 0},
+		{0, 100, 100},
+		{50, 0, 50},
+		{50, 100, 50},
+		{200, 100, 100},
+	}
+
+	for _, tt := range tests {
+		if got := (&uploadPolicy{MaxSize: tt.maxSize}).limit(tt.tenantLimit); got != tt.want {
+			t.Errorf("limit(%d) of max size %d = %d, want %d", tt.tenantLimit, tt.maxSize, got, tt.want)
+		}
+	}
+}
+
+func TestUploadPolicyObjectTTL(t *testing.T) {
+	tests := []struct {
+		ttl       int64
+		tenantTTL time.Duration
+		want      time.Duration
+	}{
+		{0, time.Hour, time.Hour},
+		{600, time.Hour, 10 * time.Minute},
+		{3600, time.Hour, time.Hour},
+		{7200, time.Hour, time.Hour},
+		{1 << 62, time.Hour, time.Hour},
+		{600, 0, 0},
+	}
+
+	for _, tt := range tests {
+		if got := (&uploadPolicy{TTL: tt.ttl}).objectTTL(tt.tenantTTL); got != tt.want {
+			t.Errorf("objectTTL(%s) of ttl %d = %s, want %s", tt.tenantTTL, tt.ttl, got, tt.want)
+		}
+	}
+}
+
+func TestServeUploadPolicyLimits(t *testing.T) {
+	cfg := testSigningConfig()
+	cfg.HTTP_OPTIONS.SIGNED_URL_TTL = 600
+	cfg.CEPH_OPTIONS.OBJECT_TTL = 3600
+	srv := newTestServer(cfg)
+	p := &principal{Name: "ci", ID: "ci", Tenant: srv.tenantByName("builds")}
+
+	tests := []struct {
+		name string
+		body string
+		code int
+	}{
+		{"defaults", `{}`, http.StatusOK},
+		{"within limits", `{"ttl":3600,"expires_in":600}`, http.StatusOK},
+		{"long token", `{"expires_in":601}`, http.StatusBadRequest},
+		{"negative token lifetime", `{"expires_in":-1}`, http.StatusBadRequest},
+		{"overflowing token lifetime", `{"expires_in":9223372036854775807}`, http.StatusBadRequest},
+		{"long ttl", `{"ttl":3601}`, http.StatusBadRequest},
+		{"negative ttl", `{"ttl":-1}`, http.StatusBadRequest},
+		{"overflowing ttl", `{"ttl":9223372036854775807}`, http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		r := withPrincipal(httptest.NewRequest(http.MethodPost, "/upload-policy", strings.NewReader(tt.body)), p)
+		w := httptest.NewRecorder()
+		srv.serveUploadPolicy(w, r, nil)
+		if w.Code != tt.code {
+			t.Errorf("%s: status = %d, want %d", tt.name, w.Code, tt.code)
+		}
+	}
+}
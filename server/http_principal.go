@@ -0,0 +1,165 @@
+package server
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"github.com/GrvHldr/dfscache/tenants"
+	"github.com/dgrijalva/jwt-go"
+	"github.com/julienschmidt/httprouter"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// Access scopes checked per route, admin grants all of them
+const (
+	scopeRead   = "read"
+	scopeWrite  = "write"
+	scopeDelete = "delete"
+	scopeAdmin  = "admin"
+)
+
+const (
+	apiKeyHeader = "X-Api-Key"
+	bearerPrefix = "Bearer "
+)
+
+// Scopes of tenant HTTP users
+var userScopes = []string{scopeRead, scopeWrite, scopeDelete}
+
+type principal struct {
+	Name      string // Recorded in access log
+	ID        string // Owner id of uploaded objects, empty for anonymous principal
+	Tenant    *tenants.Tenant
+	Scopes    []string
+	Anonymous bool
+	Signed    bool          // Authorized by signed URL, which grants read access regardless of ACL
+	Policy    *uploadPolicy // Upload policy request is authorized by
+}
+
+// Static API key, HTTP_OPTIONS.API_KEYS_FILE entry
+type apiKey struct {
+	KEY    string
+	NAME   string
+	TENANT string
+	SCOPES []string
+}
+
+type jwtClaims struct {
+	Tenant string `json:"tenant"`
+	Scope  string `json:"scope"` // Space separated scopes
+	jwt.StandardClaims
+}
+
+func (p *principal) hasScope(scope string) bool {
+	for _, s := range p.Scopes {
+		if s == scope || s == scopeAdmin {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Load API keys file and JWT verification key
+func (srv *Server) loadAuthKeys() error {
+	opts := srv.cfg.HTTP_OPTIONS
+	if opts.API_KEYS_FILE != "" {
+		raw, err := ioutil.ReadFile(opts.API_KEYS_FILE)
+		if err != nil {
+			return err
+		}
+		if err = json.Unmarshal(raw, &srv.apiKeys); err != nil {
+			return fmt.Errorf("API keys file error: %s", err)
+		}
+	}
+
+	if opts.JWT_RS256_PUBLIC_KEY_FILE != "" {
+		raw, err := ioutil.ReadFile(opts.JWT_RS256_PUBLIC_KEY_FILE)
+		if err != nil {
+			return err
+		}
+		if srv.jwtPublicKey, err = jwt.ParseRSAPublicKeyFromPEM(raw); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (srv *Server) principalByAPIKey(key string) (*principal, error) {
+	for _, k := range srv.apiKeys {
+		if subtle.ConstantTimeCompare([]byte(k.KEY), []byte(key)) != 1 {
+			continue
+		}
+		t := srv.tenantByName(k.TENANT)
+		if t == nil {
+			return nil, fmt.Errorf("Unknown tenant")
+		}
+		return &principal{Name: k.NAME, ID: "key:" + k.NAME, Tenant: t, Scopes: k.SCOPES}, nil
+	}
+
+	return nil, fmt.Errorf("Invalid API key")
+}
+
+// Verification key of bearer token by its signing method
+func (srv *Server) jwtKey(token *jwt.Token) (interface{}, error) {
+	switch token.Method.Alg() {
+	case jwt.SigningMethodHS256.Alg():
+		if secret := srv.cfg.HTTP_OPTIONS.JWT_HS256_SECRET; secret != "" {
+			return []byte(secret), nil
+		}
+	case jwt.SigningMethodRS256.Alg():
+		if srv.jwtPublicKey != nil {
+			return srv.jwtPublicKey, nil
+		}
+	}
+
+	return nil, fmt.Errorf("Unexpected signing method %s", token.Method.Alg())
+}
+
+func (srv *Server) principalByJWT(raw string) (*principal, error) {
+	claims := new(jwtClaims)
+	parser := &jwt.Parser{ValidMethods: []string{jwt.SigningMethodHS256.Alg(), jwt.SigningMethodRS256.Alg()}}
+	if _, err := parser.ParseWithClaims(raw, claims, srv.jwtKey); err != nil {
+		return nil, fmt.Errorf("Invalid bearer token: %s", err)
+	}
+	// Principal must be identified, and token must not live forever
+	if claims.Subject == "" {
+		return nil, fmt.Errorf("Invalid bearer token: missing sub claim")
+	}
+	if claims.ExpiresAt == 0 {
+		return nil, fmt.Errorf("Invalid bearer token: missing exp claim")
+	}
+
+	t := srv.tenantByName(claims.Tenant)
+	if t == nil {
+		return nil, fmt.Errorf("Unknown tenant")
+	}
+
+	return &principal{
+		Name:   claims.Subject,
+		ID:     "jwt:" + claims.Subject,
+		Tenant: t,
+		Scopes: strings.Fields(claims.Scope),
+	}, nil
+}
+
+// Route handler available to principals w/ scope only
+func requireScope(scope string, h httprouter.Handle) httprouter.Handle {
+	return func(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+		pr := principalFromContext(r)
+		if pr.hasScope(scope) {
+			h(w, r, p)
+			return
+		}
+
+		if pr.Anonymous {
+			w.Header().Set("WWW-Authenticate", `Basic realm="dfscache"`)
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		http.Error(w, fmt.Sprintf("'%s' scope required", scope), http.StatusForbidden)
+	}
+}
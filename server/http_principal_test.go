@@ -0,0 +1,128 @@
+package server
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"github.com/dgrijalva/jwt-go"
+	"reflect"
+	"testing"
+	"time"
+)
+
+const testJWTSecret = "jwt-secret"
+
+func TestPrincipalByAPIKey(t *testing.T) {
+	srv := newTestServer(testSigningConfig())
+	srv.apiKeys = []apiKey{
+		{KEY: "builds-key", NAME: "ci", TENANT: "builds", SCOPES: []string{scopeRead, scopeWrite}},
+		{KEY: "gone-key", NAME: "old", TENANT: "gone", SCOPES: []string{scopeRead}},
+	}
+
+	tests := []struct {
+		name string
+		key  string
+		ok   bool
+	}{
+		{"valid", "builds-key", true},
+		{"unknown", "other-key", false},
+		{"empty", "", false},
+		{"prefix", "builds", false},
+		{"extended", "builds-key2", false},
+		{"unknown tenant", "gone-key", false},
+	}
+
+	for _, tt := range tests {
+		p, err := srv.principalByAPIKey(tt.key)
+		if !tt.ok {
+			if err == nil {
+				t.Errorf("%s: API key accepted", tt.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: error = %v", tt.name, err)
+			continue
+		}
+		if p.Name != "ci" || p.ID != "key:ci" || p.Tenant.Name != "builds" || !reflect.DeepEqual(p.Scopes, []string{scopeRead, scopeWrite}) {
+			t.Errorf("%s: principal = %+v", tt.name, p)
+		}
+	}
+}
+
+func TestPrincipalByJWT(t *testing.T) {
+	cfg := testSigningConfig()
+	cfg.HTTP_OPTIONS.JWT_HS256_SECRET = testJWTSecret
+	srv := newTestServer(cfg)
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.jwtPublicKey = &rsaKey.PublicKey
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now().UTC()
+	claims := func(sub, tenant string, exp time.Time) *jwtClaims {
+		c := &jwtClaims{Tenant: tenant, Scope: "read write"}
+		c.Subject = sub
+		if !exp.IsZero() {
+			c.ExpiresAt = exp.Unix()
+		}
+		return c
+	}
+	sign := func(method jwt.SigningMethod, key interface{}, c *jwtClaims) string {
+		raw, err := jwt.NewWithClaims(method, c).SignedString(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return raw
+	}
+	valid := claims("deployer", "builds", now.Add(time.Hour))
+	notYet := claims("deployer", "builds", now.Add(time.Hour))
+	notYet.NotBefore = now.Add(time.Minute).Unix()
+
+	tests := []struct {
+		name  string
+		token string
+		ok    bool
+	}{
+		{"hs256", sign(jwt.SigningMethodHS256, []byte(testJWTSecret), valid), true},
+		{"rs256", sign(jwt.SigningMethodRS256, rsaKey, valid), true},
+		{"missing sub", sign(jwt.SigningMethodHS256, []byte(testJWTSecret), claims("", "builds", now.Add(time.Hour))), false},
+		{"missing exp", sign(jwt.SigningMethodHS256, []byte(testJWTSecret), claims("deployer", "builds", time.Time{})), false},
+		{"expired", sign(jwt.SigningMethodHS256, []byte(testJWTSecret), claims("deployer", "builds", now.Add(-time.Minute))), false},
+		{"not yet valid", sign(jwt.SigningMethodHS256, []byte(testJWTSecret), notYet), false},
+		{"hs512", sign(jwt.SigningMethodHS512, []byte(testJWTSecret), valid), false},
+		{"rs512", sign(jwt.SigningMethodRS512, rsaKey, valid), false},
+		{"none", sign(jwt.SigningMethodNone, jwt.UnsafeAllowNoneSignatureType, valid), false},
+		{"wrong secret", sign(jwt.SigningMethodHS256, []byte("guess"), valid), false},
+		{"wrong rsa key", sign(jwt.SigningMethodRS256, otherKey, valid), false},
+		{"unknown tenant", sign(jwt.SigningMethodHS256, []byte(testJWTSecret), claims("deployer", "other", now.Add(time.Hour))), false},
+		{"malformed", "not.a.token", false},
+	}
+
+	for _, tt := range tests {
+		p, err := srv.principalByJWT(tt.token)
+		if !tt.ok {
+			if err == nil {
+				t.Errorf("%s: bearer token accepted", tt.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: error = %v", tt.name, err)
+			continue
+		}
+		if p.Name != "deployer" || p.ID != "jwt:deployer" || p.Tenant.Name != "builds" || !reflect.DeepEqual(p.Scopes, []string{scopeRead, scopeWrite}) {
+			t.Errorf("%s: principal = %+v", tt.name, p)
+		}
+	}
+
+	// Token of configured method is rejected once its verification key is not configured
+	srv.cfg.HTTP_OPTIONS.JWT_HS256_SECRET = ""
+	if _, err := srv.principalByJWT(tests[0].token); err == nil {
+		t.Error("HS256 token accepted w/o JWT_HS256_SECRET")
+	}
+}
@@ -11,10 +11,8 @@ import (
 
 func logRequestContent(w *customResponseWriter, req *http.Request) {
 	var username = "-"
-	if req.URL.User != nil {
-		if name := req.URL.User.Username(); name != "" {
-			username = name
-		}
+	if w.principal != "" {
+		username = w.principal
 	}
 	logger.Log.Infof("%s - %s \"%s %s %s\" %d %d (%s)",
 		req.RemoteAddr,
@@ -30,6 +28,7 @@ func logRequestContent(w *customResponseWriter, req *http.Request) {
 
 type customRouter struct {
 	httprouter.Router
+	server *Server
 }
 
 type customResponseWriter struct {
@@ -37,6 +36,8 @@ type customResponseWriter struct {
 	bytesCount      int
 	requestDuration time.Duration
 	statusCode      int
+	principal       string // Authenticated principal name
+	route           string // Route path request is served by, metrics label
 }
 
 func (w *customResponseWriter) Header() http.Header {
@@ -59,10 +60,57 @@ func (w *customResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
 	return hj.Hijack()
 }
 
+// Register route handler, which records route path of request
+func (r *customRouter) Handle(method, path string, handle httprouter.Handle) {
+	r.Router.Handle(method, path, func(w http.ResponseWriter, req *http.Request, ps httprouter.Params) {
+		if m, ok := w.(*customResponseWriter); ok {
+			m.route = path
+		}
+		handle(w, req, ps)
+	})
+}
+
+func (r *customRouter) GET(path string, handle httprouter.Handle) {
+	r.Handle(http.MethodGet, path, handle)
+}
+
+func (r *customRouter) HEAD(path string, handle httprouter.Handle) {
+	r.Handle(http.MethodHead, path, handle)
+}
+
+func (r *customRouter) OPTIONS(path string, handle httprouter.Handle) {
+	r.Handle(http.MethodOptions, path, handle)
+}
+
+func (r *customRouter) POST(path string, handle httprouter.Handle) {
+	r.Handle(http.MethodPost, path, handle)
+}
+
+func (r *customRouter) PUT(path string, handle httprouter.Handle) {
+	r.Handle(http.MethodPut, path, handle)
+}
+
+func (r *customRouter) PATCH(path string, handle httprouter.Handle) {
+	r.Handle(http.MethodPatch, path, handle)
+}
+
+func (r *customRouter) DELETE(path string, handle httprouter.Handle) {
+	r.Handle(http.MethodDelete, path, handle)
+}
+
 func (r *customRouter) ServeHTTP(w http.ResponseWriter, req *http.Request) {
-	m := &customResponseWriter{w, 0, 0, 0}
+	m := &customResponseWriter{w, 0, 0, 0, "", ""}
 	start := time.Now()
-	r.Router.ServeHTTP(m, req)
+	if p, err, rc := r.server.authenticate(req); err == nil {
+		m.principal = p.Name
+		r.Router.ServeHTTP(m, withPrincipal(req, p))
+	} else {
+		if rc == http.StatusUnauthorized {
+			m.Header().Set("WWW-Authenticate", `Basic realm="dfscache"`)
+		}
+		http.Error(m, err.Error(), rc)
+	}
 	m.requestDuration = time.Since(start)
 	logRequestContent(m, req)
+	r.server.metrics.observeRequest(m, req)
 }
@@ -2,115 +2,154 @@ package server
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/GrvHldr/dfscache/cephutils"
-	"github.com/GrvHldr/dfscache/config"
 	"github.com/GrvHldr/dfscache/logger"
+	"github.com/GrvHldr/dfscache/tenants"
 	"github.com/julienschmidt/httprouter"
 	"github.com/satori/go.uuid"
-	"mime/multipart"
+	"io"
+	"io/ioutil"
+	"net"
 	"net/http"
 	"strconv"
 	"strings"
+	"time"
 )
 
-const bytesHeader = "bytes="
+const (
+	// Multipart form headers and boundaries allowance on top of upload size limit
+	multipartOverhead = 64 << 10
+	// User metadata request and response headers prefix
+	metaHeaderPrefix = "X-Dfscache-Meta-"
+)
 
-type httpRange struct {
-	start  int64
-	length int64
+// Stored object description, w/ signed download URL if signing is configured
+type uploadResult struct {
+	cephutils.UriRadosObj
+	SignedUri string `json:"signed_uri,omitempty"`
 }
 
-// https://github.com/pkg4go/httprange/blob/master/util.go
-func parseRange(s string, maxsize int64) ([]httpRange, error) {
-	if s == "" {
-		return nil, nil
-	}
+type objectInfo struct {
+	cephutils.UriRadosObj
+	Locked       bool  `json:"locked"`
+	TTLRemaining int64 `json:"ttl_remaining"`
+}
 
-	if !strings.HasPrefix(s, bytesHeader) {
-		return nil, fmt.Errorf("invalid range")
+// Placement class requested by client, either by query parameter or header
+func placementHint(r *http.Request) string {
+	if hint := r.URL.Query().Get("placement"); hint != "" {
+		return hint
 	}
 
-	var ranges []httpRange
+	return r.Header.Get("X-Placement")
+}
 
-	for _, ra := range strings.Split(s[len(bytesHeader):], ",") {
-		ra = strings.TrimSpace(ra)
-		if ra == "" {
+// User metadata from request headers
+func requestMeta(r *http.Request) (map[string]string, error) {
+	var meta map[string]string
+	for name, values := range r.Header {
+		if !strings.HasPrefix(name, metaHeaderPrefix) || len(values) == 0 {
 			continue
 		}
-		i := strings.Index(ra, "-")
-		if i < 0 {
-			return nil, fmt.Errorf("invalid range")
-		}
-		start, end := strings.TrimSpace(ra[:i]), strings.TrimSpace(ra[i+1:])
-		var r httpRange
-		if start == "" {
-			i, err := strconv.ParseInt(end, 10, 64)
-			if err != nil {
-				return nil, fmt.Errorf("invalid range")
-			}
-			if i > maxsize {
-				i = maxsize
-			}
-			r.start = maxsize - i
-			r.length = maxsize - r.start
-		} else {
-			i, err := strconv.ParseInt(start, 10, 64)
-			if err != nil || i >= maxsize || i < 0 {
-				return nil, fmt.Errorf("invalid range")
-			}
-			r.start = i
-			if end == "" {
-				// If no end is specified, range extends to end of the file.
-				r.length = maxsize - r.start
-			} else {
-				i, err := strconv.ParseInt(end, 10, 64)
-				if err != nil || r.start > i {
-					return nil, fmt.Errorf("invalid range")
-				}
-				if i >= maxsize {
-					i = maxsize - 1
-				}
-				r.length = i - r.start + 1
-			}
+		if meta == nil {
+			meta = make(map[string]string)
 		}
-		ranges = append(ranges, r)
+		meta[strings.ToLower(strings.TrimPrefix(name, metaHeaderPrefix))] = values[0]
 	}
 
-	return ranges, nil
+	return meta, cephutils.ValidateMeta(meta)
 }
 
-func getContentMultipartFormData(r *http.Request) (*multipart.FileHeader, error) {
-	if err := r.ParseMultipartForm(config.Config.HTTP_OPTIONS.MAX_MEMORY_FORM_PARSE); err != nil {
-		return nil, err
+func serveIndex(_ http.ResponseWriter, _ *http.Request, _ httprouter.Params) {
+	//	Dummy index - just stub
+}
+
+// Check declared upload size and limit request body before it is read, so no 100-continue is sent
+// to rejected client. Returns upload size limit, 0 if not limited
+func (srv *Server) limitUpload(w http.ResponseWriter, r *http.Request, overhead uint64) (uint64, bool) {
+	limit := tenantFromContext(r).UploadLimit(srv.cfg.HTTP_OPTIONS.MAX_UPLOAD_SIZE)
+	if p := policyFromContext(r); p != nil {
+		limit = p.limit(limit)
+	}
+	if limit == 0 {
+		return 0, true
 	}
-	contentName := config.Config.HTTP_OPTIONS.HTTP_UPLOAD_CONTENT_FIELD_NAME
-	if _, ok := r.MultipartForm.File[contentName]; !ok {
-		return nil, fmt.Errorf("'%s' not found in uploaded data", contentName)
+
+	if r.ContentLength > int64(limit+overhead) {
+		http.Error(w, "Upload size exceeds limit", http.StatusRequestEntityTooLarge)
+		return 0, false
 	}
+	r.Body = http.MaxBytesReader(w, r.Body, int64(limit+overhead))
 
-	return r.MultipartForm.File[contentName][0], nil
+	return limit, true
 }
 
-func serveIndex(_ http.ResponseWriter, _ *http.Request, _ httprouter.Params) {
-	//	Dummy index - just stub
+// Respond to failed upload body read
+func uploadReadError(w http.ResponseWriter, err error) {
+	var maxErr *http.MaxBytesError
+	if errors.As(err, &maxErr) {
+		http.Error(w, "Upload size exceeds limit", http.StatusRequestEntityTooLarge)
+		return
+	}
+	var quotaErr *cephutils.QuotaError
+	if errors.As(err, &quotaErr) {
+		http.Error(w, err.Error(), http.StatusInsufficientStorage)
+		return
+	}
+	logger.Log.Error(err)
+	http.Error(w, err.Error(), http.StatusInternalServerError)
+}
+
+// Declared upload size, 0 if unknown
+func declaredSize(r *http.Request) uint64 {
+	if r.ContentLength < 0 {
+		return 0
+	}
+
+	return uint64(r.ContentLength)
 }
 
-func serveFileUpload(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
-	fh, err := getContentMultipartFormData(r)
+// Stream upload content directly into new Rados object and respond w/ object description.
+// Size is exact content size if exact is set, its upper bound otherwise (0 - unknown). It drives placement
+// and packing, while quota is enforced on content actually written
+func (srv *Server) storeUpload(w http.ResponseWriter, r *http.Request, fname, contentType string, size uint64, exact bool, limit uint64, rd io.Reader) {
+	tenant := tenantFromContext(r)
+	ttl := tenant.ObjectTTL
+	if p := policyFromContext(r); p != nil {
+		if !p.allowsType(contentType) {
+			http.Error(w, "Content type is not allowed by upload policy", http.StatusUnsupportedMediaType)
+			return
+		}
+		ttl = p.objectTTL(srv.tenantObjectTTL(tenant))
+	}
+	hint := placementHint(r)
+	if _, _, err := srv.storage.SelectPlacement(size, hint); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	meta, err := requestMeta(r)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-
-	fd, err := fh.Open()
+	owner, acl, err := requestOwnership(r)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	defer fd.Close()
 
-	newObj, err := cephutils.NewRadosObj(fh.Filename)
+	newObj, err := srv.storage.NewRadosObj(cephutils.ObjOptions{
+		FileName:  fname,
+		Size:      size,
+		Placement: hint,
+		Namespace: tenant.Namespace,
+		TTL:       ttl,
+		Meta:      meta,
+		Owner:     owner,
+		ACL:       acl,
+	})
 	if err != nil {
 		logger.Log.Error(err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -118,24 +157,46 @@ func serveFileUpload(w http.ResponseWriter, r *http.Request, _ httprouter.Params
 	}
 	defer newObj.Destroy()
 
-	_, err = newObj.WriteFromReader(fd)
-	if err != nil {
+	quotaSize := size
+	if !exact {
+		quotaSize = 0
+	}
+	if err = newObj.CheckQuota(quotaSize, tenant.QuotaBytes, tenant.QuotaObjects); err != nil {
+		if _, ok := err.(*cephutils.QuotaError); ok {
+			http.Error(w, err.Error(), http.StatusInsufficientStorage)
+			return
+		}
 		logger.Log.Error(err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	if rd, err = newObj.QuotaReader(rd, tenant.QuotaBytes, 0); err != nil {
+		logger.Log.Error(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Content itself is cut off at limit, body limit includes multipart overhead
+	if limit > 0 {
+		rd = http.MaxBytesReader(w, ioutil.NopCloser(rd), int64(limit))
+	}
+
+	_, err = newObj.WriteFromReader(rd)
+	if err != nil {
+		newObj.Abort()
+		uploadReadError(w, err)
+		return
+	}
 
-	result, err := json.Marshal(
-		cephutils.NewUriRadosObj(
-			cephutils.BaseRadosObj{
-				Pool:     newObj.Pool,
-				Oid:      newObj.Oid,
-				Size:     newObj.Size,
-				TTL:      newObj.TTL,
-				FileName: newObj.FileName,
-			},
-		),
-	)
+	srv.writeObjectJSON(w, r, newObj)
+}
+
+// Respond w/ stored object description
+func (srv *Server) writeObjectJSON(w http.ResponseWriter, r *http.Request, obj *cephutils.RadosObj) {
+	result, err := json.Marshal(uploadResult{
+		UriRadosObj: *cephutils.NewUriRadosObj(obj.BaseRadosObj),
+		SignedUri:   srv.objectSignedURL(r, obj),
+	})
 	if err != nil {
 		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 		logger.Log.Error(err)
@@ -145,8 +206,58 @@ func serveFileUpload(w http.ResponseWriter, r *http.Request, _ httprouter.Params
 	w.Write(result)
 }
 
-func serveFileDownload(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
-	obj, err, rc := retrieveRadosObj(p)
+// Multipart form upload, content part is streamed to storage w/o buffering
+func (srv *Server) serveFileUpload(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	limit, ok := srv.limitUpload(w, r, multipartOverhead)
+	if !ok {
+		return
+	}
+
+	mr, err := r.MultipartReader()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	contentName := srv.cfg.HTTP_OPTIONS.HTTP_UPLOAD_CONTENT_FIELD_NAME
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			http.Error(w, fmt.Sprintf("'%s' not found in uploaded data", contentName), http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			var maxErr *http.MaxBytesError
+			if errors.As(err, &maxErr) {
+				http.Error(w, "Upload size exceeds limit", http.StatusRequestEntityTooLarge)
+				return
+			}
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if part.FormName() == contentName {
+			// Request size includes form framing, so it is upper bound of content size only
+			srv.storeUpload(w, r, part.FileName(), part.Header.Get("Content-Type"), declaredSize(r), false, limit, part)
+			part.Close()
+			return
+		}
+		part.Close()
+	}
+}
+
+// Raw upload, request body is streamed to storage
+func (srv *Server) serveRawUpload(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	limit, ok := srv.limitUpload(w, r, 0)
+	if !ok {
+		return
+	}
+
+	srv.storeUpload(w, r, p.ByName("filename"), r.Header.Get("Content-Type"), declaredSize(r), r.ContentLength >= 0, limit, r.Body)
+}
+
+func (srv *Server) serveFileDownload(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	obj, err, rc := srv.retrieveRadosObj(tenantFromContext(r), p)
 	if err != nil {
 		http.Error(w, err.Error(), rc)
 		logger.Log.Error(err)
@@ -154,44 +265,171 @@ func serveFileDownload(w http.ResponseWriter, r *http.Request, p httprouter.Para
 	}
 	defer obj.Destroy()
 
+	if checkAccess(w, r, obj, false) {
+		serveObjectContent(w, r, obj)
+	}
+}
+
+// Object content w/ its headers, shared by download by OID and by client key
+func serveObjectContent(w http.ResponseWriter, r *http.Request, obj *cephutils.RadosObj) {
+	if obj.IsPartial() {
+		http.Error(w, "Upload is not finished", http.StatusNotFound)
+		return
+	}
+
 	fname := obj.FileName
 	if fname == "" {
 		fname = obj.Oid.String()
 	}
 	w.Header().Set("Content-Disposition", "attachment; filename="+fname)
-	w.Header().Set("Content-Type", r.Header.Get("Content-Type"))
-	w.Header().Set("Accept-Ranges", "bytes")
-
-	strRange := r.Header.Get("Range")
-	if strRange == "" {
-		w.Header().Set("Content-Length", fmt.Sprintf("%d", obj.Size))
-		if _, err = obj.ReadToWriter(w, 0, int64(obj.Size)); err != nil {
-			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
-			logger.Log.Error(err)
+	for key, value := range obj.Meta {
+		w.Header().Set(metaHeaderPrefix+key, value)
+	}
+	modified := setCacheHeaders(w, obj)
+
+	// Object is locked while read, so GC doesn't remove it in the middle of transfer
+	obj.LockRados()
+	defer obj.UnlockRados()
+
+	// Ranges, If-Range and conditional requests against ETag and Last-Modified are handled by ServeContent
+	http.ServeContent(w, r, fname, modified, io.NewSectionReader(obj, 0, int64(obj.Size)))
+}
+
+// Set object validators and caching lifetime, so downstream caches never keep object longer than it is stored.
+// Returns object upload time, zero if unknown
+func setCacheHeaders(w http.ResponseWriter, obj *cephutils.RadosObj) time.Time {
+	if obj.Checksum != "" {
+		w.Header().Set("ETag", `"`+obj.Checksum+`"`)
+	}
+
+	expires := time.Unix(int64(obj.TTL), 0)
+	maxAge := int64(time.Until(expires) / time.Second)
+	if maxAge < 0 {
+		maxAge = 0
+	}
+	w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", maxAge))
+	w.Header().Set("Expires", expires.UTC().Format(http.TimeFormat))
+
+	if obj.Modified == 0 {
+		return time.Time{}
+	}
+
+	return time.Unix(obj.Modified, 0)
+}
+
+// List tenant objects, page by page
+func (srv *Server) serveObjectsList(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	q := r.URL.Query()
+	req := &listRequest{
+		Pool:      q.Get("pool"),
+		Prefix:    q.Get("prefix"),
+		Meta:      q.Get("meta"),
+		MetaValue: q.Get("meta_value"),
+		Cursor:    q.Get("cursor"),
+	}
+	var err error
+	for name, v := range map[string]*int64{"expires_after": &req.ExpiresAfter, "expires_before": &req.ExpiresBefore} {
+		if s := q.Get(name); s != "" {
+			if *v, err = strconv.ParseInt(s, 10, 64); err != nil {
+				http.Error(w, "Invalid "+name, http.StatusBadRequest)
+				return
+			}
+		}
+	}
+	if s := q.Get("limit"); s != "" {
+		if req.Limit, err = strconv.Atoi(s); err != nil {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
 			return
 		}
+	}
+
+	resp, err, rc := srv.listObjects(principalFromContext(r), req)
+	if err != nil {
+		http.Error(w, err.Error(), rc)
+		logger.Log.Error(err)
 		return
 	}
-	// If range download
-	ranges, err := parseRange(strRange, int64(obj.Size))
+
+	result, err := json.Marshal(resp)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		logger.Log.Error(err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(result)
+}
+
+// Latest object w/ file name, or all its versions
+func (srv *Server) serveLookupByName(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	srv.serveLookup(w, r, &lookupRequest{FileName: p.ByName("filename")})
+}
+
+// Latest object w/ indexed metadata value, or all of them
+func (srv *Server) serveLookupByMeta(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	srv.serveLookup(w, r, &lookupRequest{Meta: p.ByName("key"), MetaValue: p.ByName("value")})
+}
+
+func (srv *Server) serveLookup(w http.ResponseWriter, r *http.Request, req *lookupRequest) {
+	req.All = r.URL.Query().Get("all") != ""
+	objs, err, rc := srv.lookupObjects(principalFromContext(r), req)
+	if err != nil {
+		http.Error(w, err.Error(), rc)
 		return
 	}
 
-	off, len := ranges[0].start, ranges[0].length
-	w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/*", off, off+len-1))
-	w.Header().Set("Content-Length", fmt.Sprintf("%d", len))
-	if _, err = obj.ReadToWriter(w, off, len); err != nil {
+	var result []byte
+	if req.All {
+		result, err = json.Marshal(objs)
+	} else {
+		result, err = json.Marshal(objs[0])
+	}
+	if err != nil {
 		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 		logger.Log.Error(err)
 		return
 	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(result)
+}
+
+// Object description w/o its content
+func (srv *Server) serveFileInfo(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	obj, err, rc := srv.retrieveRadosObj(tenantFromContext(r), p)
+	if err != nil {
+		http.Error(w, err.Error(), rc)
+		return
+	}
+	defer obj.Destroy()
+
+	if obj.IsPartial() {
+		http.Error(w, "Upload is not finished", http.StatusNotFound)
+		return
+	}
+	if !checkAccess(w, r, obj, false) {
+		return
+	}
 
+	remaining := int64(obj.TTL) - time.Now().UTC().Unix()
+	if remaining < 0 {
+		remaining = 0
+	}
+	result, err := json.Marshal(objectInfo{
+		UriRadosObj:  *cephutils.NewUriRadosObj(obj.BaseRadosObj),
+		Locked:       obj.IsLocked(),
+		TTLRemaining: remaining,
+	})
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		logger.Log.Error(err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(result)
 }
 
-func serveFileDelete(w http.ResponseWriter, _ *http.Request, p httprouter.Params) {
-	obj, err, rc := retrieveRadosObj(p)
+func (srv *Server) serveFileDelete(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	obj, err, rc := srv.retrieveRadosObj(tenantFromContext(r), p)
 	if err != nil {
 		http.Error(w, err.Error(), rc)
 		logger.Log.Error(err)
@@ -199,6 +437,9 @@ func serveFileDelete(w http.ResponseWriter, _ *http.Request, p httprouter.Params
 	}
 	defer obj.Destroy()
 
+	if !checkAccess(w, r, obj, true) {
+		return
+	}
 	err = obj.Delete()
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusNotAcceptable)
@@ -206,10 +447,10 @@ func serveFileDelete(w http.ResponseWriter, _ *http.Request, p httprouter.Params
 	}
 }
 
-func retrieveRadosObj(p httprouter.Params) (obj *cephutils.RadosObj, err error, rc int) {
+func (srv *Server) retrieveRadosObj(t *tenants.Tenant, p httprouter.Params) (obj *cephutils.RadosObj, err error, rc int) {
 	poolName := p.ByName("pool")
 	stroid := p.ByName("oid")
-	if !strings.HasPrefix(poolName, config.Config.CEPH_OPTIONS.POOL_NAMES_PREFIX) {
+	if !srv.storage.IsCachePool(poolName) {
 		err, rc = fmt.Errorf("Invalid data pool name"), http.StatusBadRequest
 		return
 	}
@@ -220,7 +461,7 @@ func retrieveRadosObj(p httprouter.Params) (obj *cephutils.RadosObj, err error,
 		return
 	}
 
-	obj, err = cephutils.ExistingRadosObj(poolName, oid)
+	obj, err = srv.storage.ExistingRadosObj(poolName, t.Namespace, oid)
 	if err != nil {
 		err, rc = err, http.StatusNotFound
 		return
@@ -229,20 +470,79 @@ func retrieveRadosObj(p httprouter.Params) (obj *cephutils.RadosObj, err error,
 	return
 }
 
-func Run() {
-	router := &customRouter{*httprouter.New()}
+// HTTP API routes
+func (srv *Server) newRouter() *customRouter {
+	router := &customRouter{Router: *httprouter.New(), server: srv}
 
 	// HTTP resources
 	router.GET("/", serveIndex)
-	router.POST("/upload", serveFileUpload)
-	router.GET("/download/:pool/:oid", serveFileDownload)
-	router.DELETE("/delete/:pool/:oid", serveFileDelete)
-
-	logger.Log.Infof("HTTPS Listening on '%s'", config.Config.HTTP_OPTIONS.LISTEN)
-	logger.Log.Fatal(http.ListenAndServeTLS(
-		config.Config.HTTP_OPTIONS.LISTEN,
-		config.Config.HTTP_OPTIONS.CERT_FILE,
-		config.Config.HTTP_OPTIONS.CERT_KEY_FILE,
-		router,
-	))
+	router.GET("/healthz", serveHealthz)
+	router.GET("/readyz", srv.serveReadyz)
+	router.GET("/metrics", srv.serveMetrics)
+	router.POST("/upload", requireScope(scopeWrite, srv.serveFileUpload))
+	router.PUT("/upload/:filename", requireScope(scopeWrite, srv.serveRawUpload))
+	router.GET("/download/:pool/:oid", requireScope(scopeRead, srv.serveFileDownload))
+	router.HEAD("/download/:pool/:oid", requireScope(scopeRead, srv.serveFileDownload))
+	router.GET("/info/:pool/:oid", requireScope(scopeRead, srv.serveFileInfo))
+	router.GET("/objects", requireScope(scopeRead, srv.serveObjectsList))
+	router.GET("/by-name/:filename", requireScope(scopeRead, srv.serveLookupByName))
+	router.GET("/by-meta/:key/:value", requireScope(scopeRead, srv.serveLookupByMeta))
+	router.DELETE("/delete/:pool/:oid", requireScope(scopeDelete, srv.serveFileDelete))
+	router.PUT("/acl/:pool/:oid", requireScope(scopeWrite, srv.serveObjectACL))
+	router.POST("/sign", requireScope(scopeRead, srv.serveSignURL))
+	router.POST("/upload-policy", requireScope(scopeWrite, srv.serveUploadPolicy))
+
+	// Client-chosen keys
+	router.GET("/keys/*key", requireScope(scopeRead, srv.serveKeyDownload))
+	router.HEAD("/keys/*key", requireScope(scopeRead, srv.serveKeyDownload))
+	router.PUT("/keys/*key", requireScope(scopeWrite, srv.serveKeyUpload))
+	router.DELETE("/keys/*key", requireScope(scopeDelete, srv.serveKeyDelete))
+
+	// Resumable uploads (tus.io)
+	router.OPTIONS("/files", srv.serveTusOptions)
+	router.POST("/files", requireScope(scopeWrite, srv.serveTusCreate))
+	router.HEAD("/files/:pool/:oid", requireScope(scopeWrite, srv.serveTusHead))
+	router.PATCH("/files/:pool/:oid", requireScope(scopeWrite, srv.serveTusPatch))
+	router.DELETE("/files/:pool/:oid", requireScope(scopeWrite, srv.serveTusDelete))
+
+	// Multipart uploads
+	router.POST("/multipart", requireScope(scopeWrite, srv.serveMultipartInitiate))
+	router.PUT("/multipart/:pool/:oid/:part", requireScope(scopeWrite, srv.serveMultipartPart))
+	router.POST("/multipart/:pool/:oid", requireScope(scopeWrite, srv.serveMultipartComplete))
+	router.DELETE("/multipart/:pool/:oid", requireScope(scopeWrite, srv.serveMultipartAbort))
+
+	return router
+}
+
+// Bind HTTP listener, and S3 compatible API one if configured. Returns loop serving both of them
+func (srv *Server) listenHTTP() (func(), error) {
+	api := &http.Server{Addr: srv.cfg.HTTP_OPTIONS.LISTEN, Handler: srv.router}
+	apiLn, err := srv.listen(api, true)
+	if err != nil {
+		return nil, err
+	}
+
+	// Optional S3 compatible API
+	var s3 *http.Server
+	var s3Ln net.Listener
+	if srv.cfg.S3_OPTIONS.LISTEN != "" {
+		s3 = &http.Server{Addr: srv.cfg.S3_OPTIONS.LISTEN, Handler: &s3Router{server: srv}}
+		if s3Ln, err = srv.listen(s3, false); err != nil {
+			apiLn.Close()
+			return nil, err
+		}
+	}
+
+	return func() {
+		s3done := make(chan struct{})
+		go func() {
+			defer close(s3done)
+			if s3 != nil {
+				srv.serveUntilShutdown(s3, s3Ln)
+			}
+		}()
+
+		srv.serveUntilShutdown(api, apiLn)
+		<-s3done
+	}, nil
 }
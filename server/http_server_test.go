@@ -0,0 +1,52 @@
+package server
+
+import (
+	"fmt"
+	"github.com/GrvHldr/dfscache/cephutils"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestSetCacheHeaders(t *testing.T) {
+	now := time.Now().UTC().Truncate(time.Second)
+
+	tests := []struct {
+		name     string
+		obj      cephutils.BaseRadosObj
+		etag     string
+		maxAge   int64
+		modified time.Time
+	}{
+		{"fresh", cephutils.BaseRadosObj{Checksum: "abc", TTL: time.Duration(now.Add(time.Hour).Unix()), Modified: now.Add(-time.Hour).Unix()},
+			`"abc"`, 3600, now.Add(-time.Hour)},
+		{"expired", cephutils.BaseRadosObj{Checksum: "abc", TTL: time.Duration(now.Add(-time.Minute).Unix()), Modified: now.Add(-time.Hour).Unix()},
+			`"abc"`, 0, now.Add(-time.Hour)},
+		{"no checksum", cephutils.BaseRadosObj{TTL: time.Duration(now.Add(time.Minute).Unix()), Modified: now.Unix()},
+			"", 60, now},
+		{"no modification time", cephutils.BaseRadosObj{Checksum: "abc", TTL: time.Duration(now.Add(time.Minute).Unix())},
+			`"abc"`, 60, time.Time{}},
+	}
+
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		modified := setCacheHeaders(w, &cephutils.RadosObj{BaseRadosObj: tt.obj})
+
+		if got := w.Header().Get("ETag"); got != tt.etag {
+			t.Errorf("%s: ETag = %q, want %q", tt.name, got, tt.etag)
+		}
+		// A second may pass between setting TTL and headers
+		var maxAge int64
+		if _, err := fmt.Sscanf(w.Header().Get("Cache-Control"), "max-age=%d", &maxAge); err != nil ||
+			maxAge > tt.maxAge || maxAge < tt.maxAge-1 || maxAge < 0 {
+			t.Errorf("%s: Cache-Control = %q, want max-age=%d", tt.name, w.Header().Get("Cache-Control"), tt.maxAge)
+		}
+		if got, want := w.Header().Get("Expires"), time.Unix(int64(tt.obj.TTL), 0).UTC().Format(http.TimeFormat); got != want {
+			t.Errorf("%s: Expires = %q, want %q", tt.name, got, want)
+		}
+		if !modified.Equal(tt.modified) {
+			t.Errorf("%s: modification time = %s, want %s", tt.name, modified, tt.modified)
+		}
+	}
+}
@@ -0,0 +1,242 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/GrvHldr/dfscache/cephutils"
+	"github.com/GrvHldr/dfscache/logger"
+	"github.com/GrvHldr/dfscache/tenants"
+	"github.com/julienschmidt/httprouter"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Signed download URLs. Signature is HMAC-SHA256 of method restriction, path, expiration time,
+// client IP restriction, tenant and key id, so URL grants access to single object w/o credentials
+const (
+	signatureParam          = "sig"
+	defaultSignedURLTTL     = time.Hour
+	signedDownloadPrefix    = "/download/"
+	signedKeyDownloadPrefix = "/keys/"
+)
+
+type signRequest struct {
+	Pool   string `json:"pool"`
+	Oid    string `json:"oid"`
+	Key    string `json:"key"`    // Client key instead of pool and OID
+	TTL    int64  `json:"ttl"`    // URL lifetime in seconds, HTTP_OPTIONS.SIGNED_URL_TTL if not set
+	IP     string `json:"ip"`     // Client IP allowed to use URL, any if empty
+	Method string `json:"method"` // GET or HEAD, both allowed if empty
+}
+
+type signResponse struct {
+	SignedUri string `json:"signed_uri"`
+	Expires   int64  `json:"expires"`
+}
+
+// Default signed URL lifetime
+func (srv *Server) signedURLTTL() time.Duration {
+	if t := srv.cfg.HTTP_OPTIONS.SIGNED_URL_TTL; t > 0 {
+		return time.Duration(t) * time.Second
+	}
+
+	return defaultSignedURLTTL
+}
+
+// Secret of signing key by id
+func (srv *Server) signingSecret(kid string) []byte {
+	for _, k := range srv.cfg.HTTP_OPTIONS.SIGNING_KEYS {
+		if k.KEY_ID == kid {
+			return []byte(k.SECRET)
+		}
+	}
+
+	return nil
+}
+
+func urlSignature(secret []byte, path string, q url.Values) string {
+	mac := hmac.New(sha256.New, secret)
+	fmt.Fprintf(mac, "%s\n%s\n%s\n%s\n%s\n%s",
+		q.Get("method"), path, q.Get("expires"), q.Get("ip"), q.Get("tenant"), q.Get("kid"))
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Check if path may be accessed by signed URL
+func isSignedPath(path string) bool {
+	return strings.HasPrefix(path, signedDownloadPrefix) || strings.HasPrefix(path, signedKeyDownloadPrefix)
+}
+
+// Check if anonymous download must use signed URL
+func (srv *Server) signatureRequired(r *http.Request) bool {
+	return srv.cfg.HTTP_OPTIONS.REQUIRE_SIGNED_DOWNLOADS && isSignedPath(r.URL.Path)
+}
+
+// Sign download path for tenant w/ active (first configured) signing key
+func (srv *Server) signURL(path string, t *tenants.Tenant, ttl time.Duration, ip, method string) (string, int64, error) {
+	keys := srv.cfg.HTTP_OPTIONS.SIGNING_KEYS
+	if len(keys) == 0 {
+		return "", 0, fmt.Errorf("URL signing is not configured")
+	}
+
+	expires := time.Now().UTC().Add(ttl).Unix()
+	q := url.Values{}
+	q.Set("expires", strconv.FormatInt(expires, 10))
+	q.Set("kid", keys[0].KEY_ID)
+	if t.Name != "" {
+		q.Set("tenant", t.Name)
+	}
+	if ip != "" {
+		q.Set("ip", ip)
+	}
+	if method != "" {
+		q.Set("method", method)
+	}
+	q.Set(signatureParam, urlSignature([]byte(keys[0].SECRET), path, q))
+
+	return path + "?" + q.Encode(), expires, nil
+}
+
+// Verify signed URL of request, tenant object is accessed on behalf of is returned
+func (srv *Server) signedRequestTenant(r *http.Request) (*tenants.Tenant, error) {
+	q := r.URL.Query()
+	if !isSignedPath(r.URL.Path) {
+		return nil, fmt.Errorf("Resource can't be accessed by signed URL")
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return nil, fmt.Errorf("Method is not allowed by signed URL")
+	}
+	if m := q.Get("method"); m != "" && m != r.Method {
+		return nil, fmt.Errorf("Method is not allowed by signed URL")
+	}
+
+	secret := srv.signingSecret(q.Get("kid"))
+	if secret == nil {
+		return nil, fmt.Errorf("Unknown signing key")
+	}
+	expected := urlSignature(secret, r.URL.EscapedPath(), q)
+	if !hmac.Equal([]byte(expected), []byte(q.Get(signatureParam))) {
+		return nil, fmt.Errorf("Signature mismatch")
+	}
+
+	expires, err := strconv.ParseInt(q.Get("expires"), 10, 64)
+	if err != nil || expires < time.Now().UTC().Unix() {
+		return nil, fmt.Errorf("Signed URL expired")
+	}
+	if ip := q.Get("ip"); ip != "" {
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil || !net.ParseIP(ip).Equal(net.ParseIP(host)) {
+			return nil, fmt.Errorf("Client IP is not allowed by signed URL")
+		}
+	}
+
+	t := srv.tenantByName(q.Get("tenant"))
+	if t == nil {
+		return nil, fmt.Errorf("Unknown tenant")
+	}
+
+	return t, nil
+}
+
+// Signed URL of stored object for upload response, empty if signing is not configured
+func (srv *Server) objectSignedURL(r *http.Request, obj *cephutils.RadosObj) string {
+	if len(srv.cfg.HTTP_OPTIONS.SIGNING_KEYS) == 0 {
+		return ""
+	}
+
+	signed, _, err := srv.signURL(cephutils.NewUriRadosObj(obj.BaseRadosObj).Uri, tenantFromContext(r), srv.signedURLTTL(), "", "")
+	if err != nil {
+		logger.Log.Error(err)
+		return ""
+	}
+
+	return signed
+}
+
+// Sign download URL of tenant object. Credentials are required, so anonymous clients can't get signed URLs
+func (srv *Server) serveSignURL(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	if principalFromContext(r).Anonymous {
+		w.Header().Set("WWW-Authenticate", `Basic realm="dfscache"`)
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+
+	req := new(signRequest)
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var path string
+	switch {
+	case req.Key != "":
+		if err := cephutils.ValidateKey(req.Key); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		obj, err := srv.storage.KeyedRadosObj(tenantFromContext(r).Namespace, req.Key)
+		if err != nil {
+			http.Error(w, "Key not found", http.StatusNotFound)
+			return
+		}
+		allowed := checkAccess(w, r, obj, false)
+		obj.Destroy()
+		if !allowed {
+			return
+		}
+		path = signedKeyDownloadPrefix + (&url.URL{Path: req.Key}).EscapedPath()
+	case req.Pool != "" && req.Oid != "":
+		obj, err, rc := srv.retrieveRadosObj(tenantFromContext(r), httprouter.Params{
+			{Key: "pool", Value: req.Pool},
+			{Key: "oid", Value: req.Oid},
+		})
+		if err != nil {
+			http.Error(w, err.Error(), rc)
+			return
+		}
+		allowed := checkAccess(w, r, obj, false)
+		path = cephutils.NewUriRadosObj(obj.BaseRadosObj).Uri
+		obj.Destroy()
+		if !allowed {
+			return
+		}
+	default:
+		http.Error(w, "Pool and OID or key required", http.StatusBadRequest)
+		return
+	}
+
+	if req.Method != "" && req.Method != http.MethodGet && req.Method != http.MethodHead {
+		http.Error(w, "Method must be GET or HEAD", http.StatusBadRequest)
+		return
+	}
+	if req.IP != "" && net.ParseIP(req.IP) == nil {
+		http.Error(w, "Invalid IP", http.StatusBadRequest)
+		return
+	}
+	ttl := srv.signedURLTTL()
+	if req.TTL > 0 {
+		ttl = time.Duration(req.TTL) * time.Second
+	}
+
+	signed, expires, err := srv.signURL(path, tenantFromContext(r), ttl, req.IP, req.Method)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotImplemented)
+		return
+	}
+
+	result, err := json.Marshal(signResponse{SignedUri: signed, Expires: expires})
+	if err != nil {
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		logger.Log.Error(err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(result)
+}
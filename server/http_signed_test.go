@@ -0,0 +1,92 @@
+package server
+
+import (
+	"github.com/GrvHldr/dfscache/config"
+	"github.com/GrvHldr/dfscache/tenants"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Server w/o storage for request verification tests
+func newTestServer(cfg *config.ServerConfig) *Server {
+	return &Server{cfg: cfg, tenants: tenants.NewRegistry(cfg)}
+}
+
+func testSigningConfig() *config.ServerConfig {
+	cfg := new(config.ServerConfig)
+	cfg.TENANTS = []config.TenantConfig{{NAME: "builds", NAMESPACE: "builds"}}
+	cfg.HTTP_OPTIONS.SIGNING_KEYS = []config.SigningKey{{KEY_ID: "k2", SECRET: "new"}, {KEY_ID: "k1", SECRET: "old"}}
+	return cfg
+}
+
+func TestSignedRequestTenant(t *testing.T) {
+	srv := newTestServer(testSigningConfig())
+	tenant := srv.tenantByName("builds")
+	path := "/download/pool/6ba7b810-9dad-11d1-80b4-00c04fd430c8"
+
+	sign := func(path string, ttl time.Duration, ip, method string) string {
+		signed, _, err := srv.signURL(path, tenant, ttl, ip, method)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return signed
+	}
+	valid := sign(path, time.Hour, "", "")
+
+	tests := []struct {
+		name   string
+		method string
+		url    string
+		remote string
+		ok     bool
+	}{
+		{"get", http.MethodGet, valid, "", true},
+		{"head", http.MethodHead, valid, "", true},
+		{"post", http.MethodPost, valid, "", false},
+		{"method bound", http.MethodGet, sign(path, time.Hour, "", http.MethodGet), "", true},
+		{"other method", http.MethodHead, sign(path, time.Hour, "", http.MethodGet), "", false},
+		{"ip bound", http.MethodGet, sign(path, time.Hour, "10.0.0.1", ""), "10.0.0.1:4321", true},
+		{"other ip", http.MethodGet, sign(path, time.Hour, "10.0.0.1", ""), "10.0.0.2:4321", false},
+		{"expired", http.MethodGet, sign(path, -time.Minute, "", ""), "", false},
+		{"other path", http.MethodGet, strings.Replace(valid, "/pool/", "/other/", 1), "", false},
+		{"tampered expiration", http.MethodGet, strings.Replace(valid, "expires=", "expires=1", 1), "", false},
+		{"unknown key", http.MethodGet, strings.Replace(valid, "kid=k2", "kid=k3", 1), "", false},
+		{"not signed path", http.MethodGet, sign("/objects", time.Hour, "", ""), "", false},
+		{"no signature", http.MethodGet, path, "", false},
+	}
+
+	for _, tt := range tests {
+		r := httptest.NewRequest(tt.method, tt.url, nil)
+		if tt.remote != "" {
+			r.RemoteAddr = tt.remote
+		}
+
+		got, err := srv.signedRequestTenant(r)
+		if tt.ok && (err != nil || got == nil || got.Name != "builds") {
+			t.Errorf("%s: tenant = %v, error = %v, want builds", tt.name, got, err)
+		}
+		if !tt.ok && err == nil {
+			t.Errorf("%s: signed URL %s accepted", tt.name, tt.url)
+		}
+	}
+}
+
+func TestSignedRequestRotatedKey(t *testing.T) {
+	cfg := testSigningConfig()
+	srv := newTestServer(cfg)
+
+	// URL signed by previous active key stays valid while the key is configured
+	old := newTestServer(&config.ServerConfig{TENANTS: cfg.TENANTS})
+	old.cfg.HTTP_OPTIONS.SIGNING_KEYS = cfg.HTTP_OPTIONS.SIGNING_KEYS[1:]
+	signed, _, err := old.signURL("/keys/a/b", old.tenantByName("builds"), time.Hour, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = srv.signedRequestTenant(httptest.NewRequest(http.MethodGet, signed, nil)); err != nil {
+		t.Errorf("URL signed by rotated key rejected: %s", err)
+	}
+}
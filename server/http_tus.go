@@ -0,0 +1,272 @@
+package server
+
+import (
+	"encoding/base64"
+	"github.com/GrvHldr/dfscache/cephutils"
+	"github.com/GrvHldr/dfscache/logger"
+	"github.com/julienschmidt/httprouter"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Resumable uploads, tus.io protocol: https://tus.io/protocols/resumable-upload.html
+const (
+	tusVersion              = "1.0.0"
+	tusExtensions           = "creation,termination"
+	tusContentType          = "application/offset+octet-stream"
+	defaultResumableTimeout = 24 * time.Hour
+)
+
+// Unfinished resumable upload lifetime since last received data
+func (srv *Server) resumableTimeout() time.Duration {
+	if t := srv.cfg.HTTP_OPTIONS.RESUMABLE_UPLOAD_TIMEOUT; t > 0 {
+		return time.Duration(t) * time.Second
+	}
+
+	return defaultResumableTimeout
+}
+
+// Check client protocol version
+func checkTusVersion(w http.ResponseWriter, r *http.Request) bool {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	if r.Header.Get("Tus-Resumable") != tusVersion {
+		w.Header().Set("Tus-Version", tusVersion)
+		http.Error(w, "Unsupported tus protocol version", http.StatusPreconditionFailed)
+		return false
+	}
+
+	return true
+}
+
+// Parse Upload-Metadata header: comma separated "key base64(value)" pairs
+func parseTusMetadata(s string) map[string]string {
+	meta := make(map[string]string)
+	for _, pair := range strings.Split(s, ",") {
+		kv := strings.Fields(pair)
+		if len(kv) == 0 {
+			continue
+		}
+		if len(kv) == 1 {
+			meta[kv[0]] = ""
+			continue
+		}
+		if v, err := base64.StdEncoding.DecodeString(kv[1]); err == nil {
+			meta[kv[0]] = string(v)
+		}
+	}
+
+	return meta
+}
+
+func (srv *Server) serveTusOptions(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	w.Header().Set("Tus-Version", tusVersion)
+	w.Header().Set("Tus-Extension", tusExtensions)
+	if limit := tenantFromContext(r).UploadLimit(srv.cfg.HTTP_OPTIONS.MAX_UPLOAD_SIZE); limit > 0 {
+		w.Header().Set("Tus-Max-Size", strconv.FormatUint(limit, 10))
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Create new resumable upload
+func (srv *Server) serveTusCreate(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	if !checkTusVersion(w, r) {
+		return
+	}
+
+	length, err := strconv.ParseUint(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid Upload-Length", http.StatusBadRequest)
+		return
+	}
+
+	tenant := tenantFromContext(r)
+	limit := tenant.UploadLimit(srv.cfg.HTTP_OPTIONS.MAX_UPLOAD_SIZE)
+	if limit > 0 && length > limit {
+		http.Error(w, "Upload size exceeds limit", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	meta := parseTusMetadata(r.Header.Get("Upload-Metadata"))
+	hint := meta["placement"]
+	if hint == "" {
+		hint = placementHint(r)
+	}
+	if _, _, err = srv.storage.SelectPlacement(length, hint); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	userMeta, err := requestMeta(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	owner, acl, err := requestOwnership(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	newObj, err := srv.storage.NewRadosObj(cephutils.ObjOptions{
+		FileName:  meta["filename"],
+		Size:      length,
+		Placement: hint,
+		Namespace: tenant.Namespace,
+		TTL:       tenant.ObjectTTL,
+		NoPacking: true,
+		Meta:      userMeta,
+		Owner:     owner,
+		ACL:       acl,
+	})
+	if err != nil {
+		logger.Log.Error(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer newObj.Destroy()
+
+	if err = newObj.CheckQuota(length, tenant.QuotaBytes, tenant.QuotaObjects); err != nil {
+		if _, ok := err.(*cephutils.QuotaError); ok {
+			http.Error(w, err.Error(), http.StatusInsufficientStorage)
+			return
+		}
+		logger.Log.Error(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err = newObj.StartResumable(length, srv.resumableTimeout()); err != nil {
+		logger.Log.Error(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Location", "/files/"+newObj.Pool+"/"+newObj.Oid.String())
+	w.WriteHeader(http.StatusCreated)
+}
+
+// Current resumable upload offset
+func (srv *Server) serveTusHead(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	if !checkTusVersion(w, r) {
+		return
+	}
+
+	obj, err, rc := srv.retrieveRadosObj(tenantFromContext(r), p)
+	if err != nil {
+		w.WriteHeader(rc)
+		return
+	}
+	defer obj.Destroy()
+
+	if !checkAccess(w, r, obj, true) {
+		return
+	}
+
+	if obj.IsMultipartPending() {
+		http.Error(w, "Not a resumable upload", http.StatusNotFound)
+		return
+	}
+
+	length := obj.Size
+	if obj.IsResumable() {
+		length = obj.UploadLength()
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Upload-Offset", strconv.FormatUint(obj.Size, 10))
+	w.Header().Set("Upload-Length", strconv.FormatUint(length, 10))
+	w.WriteHeader(http.StatusOK)
+}
+
+// Append data to resumable upload
+func (srv *Server) serveTusPatch(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	if !checkTusVersion(w, r) {
+		return
+	}
+
+	if r.Header.Get("Content-Type") != tusContentType {
+		http.Error(w, "Invalid Content-Type", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	offset, err := strconv.ParseUint(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid Upload-Offset", http.StatusBadRequest)
+		return
+	}
+
+	tenant := tenantFromContext(r)
+	obj, err, rc := srv.retrieveRadosObj(tenant, p)
+	if err != nil {
+		http.Error(w, err.Error(), rc)
+		return
+	}
+	defer obj.Destroy()
+
+	if !checkAccess(w, r, obj, true) {
+		return
+	}
+
+	if err = obj.LockRados(); err != nil {
+		http.Error(w, err.Error(), http.StatusLocked)
+		return
+	}
+	defer obj.UnlockRados()
+
+	// Offset is checked under lock against upload state written by concurrent PATCH
+	if err = obj.ReloadResumable(); err != nil {
+		logger.Log.Error(err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !obj.IsResumable() || offset != obj.Size {
+		http.Error(w, "Upload offset mismatch", http.StatusConflict)
+		return
+	}
+
+	if _, err = obj.WriteResumable(r.Body, offset, srv.resumableTimeout()); err != nil {
+		// Received data is kept, client resumes from reported offset
+		logger.Log.Errorf("Resumable upload %s interrupted: %s", obj.Oid, err)
+	}
+
+	if obj.Size == obj.UploadLength() {
+		if err = obj.FinishResumable(tenant.ObjectTTL); err != nil {
+			logger.Log.Error(err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		logger.Log.Infof("Resumable upload finished for %s", obj.Oid)
+	}
+
+	w.Header().Set("Upload-Offset", strconv.FormatUint(obj.Size, 10))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Terminate resumable upload
+func (srv *Server) serveTusDelete(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	if !checkTusVersion(w, r) {
+		return
+	}
+
+	obj, err, rc := srv.retrieveRadosObj(tenantFromContext(r), p)
+	if err != nil {
+		http.Error(w, err.Error(), rc)
+		return
+	}
+	defer obj.Destroy()
+
+	// Finished objects are deleted by DELETE /delete, which requires delete scope
+	if !obj.IsResumable() {
+		http.Error(w, "Upload not found", http.StatusNotFound)
+		return
+	}
+	if !checkAccess(w, r, obj, true) {
+		return
+	}
+	if err = obj.Delete(); err != nil {
+		http.Error(w, err.Error(), http.StatusLocked)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,26 @@
+package server
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseTusMetadata(t *testing.T) {
+	tests := []struct {
+		header string
+		want   map[string]string
+	}{
+		{"", map[string]string{}},
+		{"filename d29ybGRfZG9taW5hdGlvbl9wbGFuLnBkZg==", map[string]string{"filename": "world_domination_plan.pdf"}},
+		{"filename Zm9v, is_confidential", map[string]string{"filename": "foo", "is_confidential": ""}},
+		{"filename Zm9v,type YXBwbGljYXRpb24vcGRm", map[string]string{"filename": "foo", "type": "application/pdf"}},
+		{"filename not-base64!, type YQ==", map[string]string{"type": "a"}},
+		{" , ,flag", map[string]string{"flag": ""}},
+	}
+
+	for _, tt := range tests {
+		if got := parseTusMetadata(tt.header); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("parseTusMetadata(%q) = %v, want %v", tt.header, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package server
+
+import (
+	"fmt"
+	"github.com/GrvHldr/dfscache/cephutils"
+	"net/http"
+	"time"
+)
+
+const (
+	defaultListLimit = 100
+	maxListLimit     = 1000
+)
+
+// Objects listing request, shared by HTTP and ZMQ
+type listRequest struct {
+	Pool          string `json:"pool"`
+	Prefix        string `json:"prefix"`
+	ExpiresAfter  int64  `json:"expires_after"`
+	ExpiresBefore int64  `json:"expires_before"`
+	Meta          string `json:"meta"`
+	MetaValue     string `json:"meta_value"`
+	Limit         int    `json:"limit"`
+	Cursor        string `json:"cursor"`
+}
+
+type listResponse struct {
+	Objects []*cephutils.UriRadosObj `json:"objects"`
+	Cursor  string                   `json:"cursor,omitempty"`
+	Error   string                   `json:"error,omitempty"` // ZMQ only, HTTP responds w/ status code
+}
+
+// List page of tenant objects principal may read
+func (srv *Server) listObjects(p *principal, req *listRequest) (resp *listResponse, err error, rc int) {
+	if req.Pool != "" && !srv.storage.IsCachePool(req.Pool) {
+		err, rc = fmt.Errorf("Invalid data pool name"), http.StatusBadRequest
+		return
+	}
+
+	limit := req.Limit
+	if limit <= 0 {
+		limit = defaultListLimit
+	}
+	if limit > maxListLimit {
+		limit = maxListLimit
+	}
+
+	filter := cephutils.ListFilter{
+		Prefix:        req.Prefix,
+		ExpiresAfter:  time.Duration(req.ExpiresAfter),
+		ExpiresBefore: time.Duration(req.ExpiresBefore),
+		MetaKey:       req.Meta,
+		MetaValue:     req.MetaValue,
+		Access:        p.canRead,
+	}
+	objs, cursor, err := srv.storage.ListObjects(p.Tenant.Namespace, req.Pool, filter, req.Cursor, limit)
+	if err == cephutils.ErrInvalidCursor {
+		rc = http.StatusBadRequest
+		return
+	}
+	if err != nil {
+		rc = http.StatusInternalServerError
+		return
+	}
+
+	resp = &listResponse{Objects: []*cephutils.UriRadosObj{}, Cursor: cursor}
+	for _, o := range objs {
+		resp.Objects = append(resp.Objects, cephutils.NewUriRadosObj(o))
+	}
+
+	return
+}
+
+// Lookup by file name or indexed metadata value, shared by HTTP and ZMQ
+type lookupRequest struct {
+	FileName  string `json:"file_name"`
+	Meta      string `json:"meta"`
+	MetaValue string `json:"meta_value"`
+	All       bool   `json:"all"`
+}
+
+// Tenant objects principal may read found by secondary index, latest first. Only latest one unless all versions requested
+func (srv *Server) lookupObjects(p *principal, req *lookupRequest) (objs []*cephutils.UriRadosObj, err error, rc int) {
+	t := p.Tenant
+	var entries []cephutils.IndexEntry
+	switch {
+	case req.FileName != "":
+		entries, err = srv.storage.LookupByName(t.Namespace, req.FileName, true)
+	case req.Meta != "":
+		if !srv.storage.IsIndexedMeta(req.Meta) {
+			err, rc = fmt.Errorf("Metadata key '%s' is not indexed", req.Meta), http.StatusBadRequest
+			return
+		}
+		entries, err = srv.storage.LookupByMeta(t.Namespace, req.Meta, req.MetaValue, true)
+	default:
+		err, rc = fmt.Errorf("File name or metadata key required"), http.StatusBadRequest
+		return
+	}
+	if err != nil {
+		rc = http.StatusInternalServerError
+		return
+	}
+
+	objs = []*cephutils.UriRadosObj{}
+	for _, e := range entries {
+		obj, oerr := srv.storage.ExistingRadosObj(e.Pool, t.Namespace, e.Oid)
+		if oerr != nil {
+			// Deleted, index entry is pruned by GC
+			continue
+		}
+		if !obj.IsPartial() && p.canRead(&obj.BaseRadosObj) {
+			objs = append(objs, cephutils.NewUriRadosObj(obj.BaseRadosObj))
+		}
+		obj.Destroy()
+		if len(objs) > 0 && !req.All {
+			// Latest version principal may read
+			break
+		}
+	}
+
+	if len(objs) == 0 && !req.All {
+		err, rc = fmt.Errorf("Object not found"), http.StatusNotFound
+	}
+
+	return
+}
@@ -0,0 +1,178 @@
+package server
+
+import (
+	"github.com/julienschmidt/httprouter"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const metricsNamespace = "dfscache"
+
+// Prometheus metrics of instance. Registry is per instance, so several instances may run within one process
+type metrics struct {
+	registry *prometheus.Registry
+	handler  http.Handler
+
+	httpRequests *prometheus.CounterVec   // route, method, status
+	httpDuration *prometheus.HistogramVec // route, method
+	httpBytes    *prometheus.CounterVec   // route, method, status
+
+	zmqUploadSessions   *prometheus.CounterVec // result
+	zmqUploadChunks     prometheus.Counter
+	zmqUploadBytes      prometheus.Counter
+	zmqDownloadRequests *prometheus.CounterVec // command, result
+	zmqDownloadBytes    prometheus.Counter
+
+	radosDuration *prometheus.HistogramVec // op
+	radosErrors   *prometheus.CounterVec   // op
+
+	gcRuns      *prometheus.CounterVec // result
+	gcDuration  prometheus.Histogram
+	gcScanned   prometheus.Counter
+	gcDeleted   prometheus.Counter
+	gcReclaimed prometheus.Counter
+}
+
+func newMetrics(srv *Server) *metrics {
+	m := &metrics{
+		registry: prometheus.NewRegistry(),
+
+		httpRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace, Subsystem: "http", Name: "requests_total",
+			Help: "HTTP and S3 requests by route, method and status code.",
+		}, []string{"route", "method", "status"}),
+		httpDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace, Subsystem: "http", Name: "request_duration_seconds",
+			Help:    "HTTP and S3 request latency by route and method.",
+			Buckets: prometheus.ExponentialBuckets(0.005, 4, 8),
+		}, []string{"route", "method"}),
+		httpBytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace, Subsystem: "http", Name: "response_bytes_total",
+			Help: "HTTP and S3 response body bytes by route, method and status code.",
+		}, []string{"route", "method", "status"}),
+
+		zmqUploadSessions: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace, Subsystem: "zmq", Name: "upload_sessions_total",
+			Help: "ZMQ upload sessions by result: completed, rejected, failed or aborted on shutdown.",
+		}, []string{"result"}),
+		zmqUploadChunks: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace, Subsystem: "zmq", Name: "upload_chunks_total",
+			Help: "ZMQ upload chunks written to storage.",
+		}),
+		zmqUploadBytes: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace, Subsystem: "zmq", Name: "upload_bytes_total",
+			Help: "ZMQ upload bytes written to storage.",
+		}),
+		zmqDownloadRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace, Subsystem: "zmq", Name: "download_requests_total",
+			Help: "ZMQ downloader requests by command (download, list, lookup) and result.",
+		}, []string{"command", "result"}),
+		zmqDownloadBytes: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace, Subsystem: "zmq", Name: "download_bytes_total",
+			Help: "ZMQ download chunk bytes sent.",
+		}),
+
+		radosDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace, Subsystem: "rados", Name: "operation_duration_seconds",
+			Help:    "RADOS operation latency by operation.",
+			Buckets: prometheus.ExponentialBuckets(0.001, 4, 8),
+		}, []string{"op"}),
+		radosErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace, Subsystem: "rados", Name: "operation_errors_total",
+			Help: "Failed RADOS operations by operation.",
+		}, []string{"op"}),
+
+		gcRuns: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace, Subsystem: "gc", Name: "runs_total",
+			Help: "Garbage Collector runs by result: complete or interrupted.",
+		}, []string{"result"}),
+		gcDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: metricsNamespace, Subsystem: "gc", Name: "run_duration_seconds",
+			Help:    "Garbage Collector run duration.",
+			Buckets: prometheus.ExponentialBuckets(1, 4, 8),
+		}),
+		gcScanned: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace, Subsystem: "gc", Name: "objects_scanned_total",
+			Help: "Objects scanned by Garbage Collector.",
+		}),
+		gcDeleted: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace, Subsystem: "gc", Name: "objects_deleted_total",
+			Help: "Expired objects deleted by Garbage Collector.",
+		}),
+		gcReclaimed: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace, Subsystem: "gc", Name: "bytes_reclaimed_total",
+			Help: "Bytes of expired objects deleted by Garbage Collector.",
+		}),
+	}
+
+	m.registry.MustRegister(
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: metricsNamespace, Subsystem: "zmq", Name: "upload_sessions_active",
+			Help: "ZMQ upload sessions in progress.",
+		}, func() float64 {
+			return float64(srv.uploadsCount())
+		}),
+		m.httpRequests, m.httpDuration, m.httpBytes,
+		m.zmqUploadSessions, m.zmqUploadChunks, m.zmqUploadBytes, m.zmqDownloadRequests, m.zmqDownloadBytes,
+		m.radosDuration, m.radosErrors,
+		m.gcRuns, m.gcDuration, m.gcScanned, m.gcDeleted, m.gcReclaimed,
+	)
+	m.handler = promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+
+	return m
+}
+
+// Record served HTTP request, requests not routed, e.g. unauthenticated ones, are recorded as "other" route
+func (m *metrics) observeRequest(w *customResponseWriter, r *http.Request) {
+	route, status := w.route, w.statusCode
+	if route == "" {
+		route = "other"
+	}
+	if status == 0 {
+		status = http.StatusOK
+	}
+	code := strconv.Itoa(status)
+
+	m.httpRequests.WithLabelValues(route, r.Method, code).Inc()
+	m.httpDuration.WithLabelValues(route, r.Method).Observe(w.requestDuration.Seconds())
+	m.httpBytes.WithLabelValues(route, r.Method, code).Add(float64(w.bytesCount))
+}
+
+// Storage observer
+func (m *metrics) observeRados(op string, d time.Duration, err error) {
+	m.radosDuration.WithLabelValues(op).Observe(d.Seconds())
+	if err != nil {
+		m.radosErrors.WithLabelValues(op).Inc()
+	}
+}
+
+func (m *metrics) observeZmqDownload(command string, err bool) {
+	result := "ok"
+	if err {
+		result = "error"
+	}
+	m.zmqDownloadRequests.WithLabelValues(command, result).Inc()
+}
+
+// S3 route of request path: service, bucket or object
+func s3Route(path string) string {
+	switch path = strings.Trim(path, "/"); {
+	case path == "":
+		return "s3:/"
+	case !strings.Contains(path, "/"):
+		return "s3:/:bucket"
+	default:
+		return "s3:/:bucket/*key"
+	}
+}
+
+// Prometheus metrics scrape
+func (srv *Server) serveMetrics(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	srv.metrics.handler.ServeHTTP(w, r)
+}
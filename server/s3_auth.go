@@ -0,0 +1,319 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// AWS Signature Version 4, both Authorization header and presigned URL (query) forms
+const (
+	sigV4Algorithm      = "AWS4-HMAC-SHA256"
+	sigV4Service        = "s3"
+	sigV4Terminator     = "aws4_request"
+	sigV4TimeFormat     = "20060102T150405Z"
+	sigV4MaxSkew        = 15 * time.Minute
+	sigV4MaxExpires     = 7 * 24 * time.Hour
+	amzContentSHA256    = "X-Amz-Content-Sha256"
+	unsignedPayload     = "UNSIGNED-PAYLOAD"
+	streamingPayload    = "STREAMING-AWS4-HMAC-SHA256-PAYLOAD"
+	sigV4CredentialSize = 5
+)
+
+type sigV4Request struct {
+	accessKey     string
+	date          string // Credential scope date, YYYYMMDD
+	region        string
+	signedHeaders []string
+	signature     string
+	amzDate       time.Time
+	payloadHash   string
+	presigned     bool
+}
+
+// Access key resolved from request signature
+type s3Credentials struct {
+	accessKey string
+	tenant    string
+}
+
+// Parse signature parameters of request
+func parseSigV4(r *http.Request) (*sigV4Request, *s3Error) {
+	if auth := r.Header.Get("Authorization"); auth != "" {
+		return parseSigV4Header(r, auth)
+	}
+	if r.URL.Query().Get("X-Amz-Algorithm") != "" {
+		return parseSigV4Query(r)
+	}
+
+	return nil, errAccessDenied
+}
+
+func parseSigV4Header(r *http.Request, auth string) (*sigV4Request, *s3Error) {
+	if !strings.HasPrefix(auth, sigV4Algorithm+" ") {
+		return nil, errSignatureVersion
+	}
+
+	s := new(sigV4Request)
+	for _, field := range strings.Split(auth[len(sigV4Algorithm)+1:], ",") {
+		kv := strings.SplitN(strings.TrimSpace(field), "=", 2)
+		if len(kv) != 2 {
+			return nil, errAuthorizationHeader
+		}
+		switch kv[0] {
+		case "Credential":
+			if err := s.parseCredential(kv[1]); err != nil {
+				return nil, err
+			}
+		case "SignedHeaders":
+			s.signedHeaders = strings.Split(kv[1], ";")
+		case "Signature":
+			s.signature = kv[1]
+		}
+	}
+	if s.accessKey == "" || !s.signsHost() || s.signature == "" {
+		return nil, errAuthorizationHeader
+	}
+
+	// Date header is in HTTP format, request time is signed in ISO 8601 format anyway
+	var t time.Time
+	var err error
+	if amzDate := r.Header.Get("X-Amz-Date"); amzDate != "" {
+		t, err = time.Parse(sigV4TimeFormat, amzDate)
+	} else {
+		t, err = http.ParseTime(r.Header.Get("Date"))
+	}
+	if err != nil {
+		return nil, errAuthorizationHeader
+	}
+	t = t.UTC()
+	s.amzDate = t
+	if skew := time.Since(t); skew > sigV4MaxSkew || skew < -sigV4MaxSkew {
+		return nil, errRequestTimeTooSkewed
+	}
+
+	s.payloadHash = r.Header.Get(amzContentSHA256)
+	if s.payloadHash == "" {
+		return nil, errAuthorizationHeader
+	}
+	if s.payloadHash == streamingPayload {
+		return nil, errNotImplemented
+	}
+
+	return s, nil
+}
+
+func parseSigV4Query(r *http.Request) (*sigV4Request, *s3Error) {
+	q := r.URL.Query()
+	if q.Get("X-Amz-Algorithm") != sigV4Algorithm {
+		return nil, errSignatureVersion
+	}
+
+	s := &sigV4Request{presigned: true, payloadHash: unsignedPayload}
+	if err := s.parseCredential(q.Get("X-Amz-Credential")); err != nil {
+		return nil, err
+	}
+	s.signedHeaders = strings.Split(q.Get("X-Amz-SignedHeaders"), ";")
+	s.signature = q.Get("X-Amz-Signature")
+	if !s.signsHost() || s.signature == "" {
+		return nil, errAuthorizationQuery
+	}
+
+	t, err := time.Parse(sigV4TimeFormat, q.Get("X-Amz-Date"))
+	if err != nil {
+		return nil, errAuthorizationQuery
+	}
+	s.amzDate = t
+	if time.Until(t) > sigV4MaxSkew {
+		return nil, errRequestTimeTooSkewed
+	}
+	expires, err := strconv.Atoi(q.Get("X-Amz-Expires"))
+	if err != nil || expires < 0 || time.Duration(expires)*time.Second > sigV4MaxExpires {
+		return nil, errAuthorizationQuery
+	}
+	if time.Now().After(t.Add(time.Duration(expires) * time.Second)) {
+		return nil, errExpiredPresignRequest
+	}
+
+	return s, nil
+}
+
+// Host is required to be signed, otherwise signature may be replayed against another host
+func (s *sigV4Request) signsHost() bool {
+	for _, name := range s.signedHeaders {
+		if name == "host" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Credential: <access key>/<date>/<region>/s3/aws4_request
+func (s *sigV4Request) parseCredential(credential string) *s3Error {
+	parts := strings.Split(credential, "/")
+	if len(parts) != sigV4CredentialSize || parts[3] != sigV4Service || parts[4] != sigV4Terminator {
+		return errAuthorizationHeader
+	}
+	s.accessKey, s.date, s.region = parts[0], parts[1], parts[2]
+
+	return nil
+}
+
+// Verify request signature against configured access keys
+func (srv *Server) authenticateS3(r *http.Request) (*s3Credentials, *s3Error) {
+	s, serr := parseSigV4(r)
+	if serr != nil {
+		return nil, serr
+	}
+
+	var secret string
+	creds := new(s3Credentials)
+	for _, k := range srv.cfg.S3_OPTIONS.ACCESS_KEYS {
+		if k.ACCESS_KEY == s.accessKey {
+			secret = k.SECRET_KEY
+			creds.accessKey, creds.tenant = k.ACCESS_KEY, k.TENANT
+			break
+		}
+	}
+	if creds.accessKey == "" {
+		return nil, errInvalidAccessKeyId
+	}
+	if s.region != srv.cfg.S3_OPTIONS.REGION || s.date != s.amzDate.Format("20060102") {
+		return nil, errAuthorizationHeader
+	}
+
+	expected := s.sign(secret, s.stringToSign(r))
+	if subtle.ConstantTimeCompare([]byte(expected), []byte(s.signature)) != 1 {
+		return nil, errSignatureDoesNotMatch
+	}
+
+	// Signed payload hash is verified while body is read
+	if !s.presigned && s.payloadHash != unsignedPayload && r.Body != nil {
+		r.Body = &payloadVerifier{ReadCloser: r.Body, hash: sha256.New(), expected: s.payloadHash}
+	}
+
+	return creds, nil
+}
+
+func (s *sigV4Request) scope() string {
+	return strings.Join([]string{s.date, s.region, sigV4Service, sigV4Terminator}, "/")
+}
+
+func (s *sigV4Request) stringToSign(r *http.Request) string {
+	canonical := strings.Join([]string{
+		r.Method,
+		awsURIEncode(r.URL.Path, false),
+		s.canonicalQuery(r.URL.Query()),
+		s.canonicalHeaders(r),
+		strings.Join(s.signedHeaders, ";"),
+		s.payloadHash,
+	}, "\n")
+	sum := sha256.Sum256([]byte(canonical))
+
+	return strings.Join([]string{
+		sigV4Algorithm,
+		s.amzDate.Format(sigV4TimeFormat),
+		s.scope(),
+		hex.EncodeToString(sum[:]),
+	}, "\n")
+}
+
+func (s *sigV4Request) canonicalQuery(q url.Values) string {
+	var params []string
+	for key, values := range q {
+		if s.presigned && key == "X-Amz-Signature" {
+			continue
+		}
+		for _, v := range values {
+			params = append(params, awsURIEncode(key, true)+"="+awsURIEncode(v, true))
+		}
+	}
+	sort.Strings(params)
+
+	return strings.Join(params, "&")
+}
+
+func (s *sigV4Request) canonicalHeaders(r *http.Request) string {
+	var b strings.Builder
+	for _, name := range s.signedHeaders {
+		var raw []string
+		switch name {
+		case "host":
+			raw = []string{r.Host}
+		case "content-length":
+			raw = []string{strconv.FormatInt(r.ContentLength, 10)}
+		default:
+			raw = r.Header[http.CanonicalHeaderKey(name)]
+		}
+		values := make([]string, len(raw))
+		for i, v := range raw {
+			values[i] = strings.Join(strings.Fields(v), " ")
+		}
+		fmt.Fprintf(&b, "%s:%s\n", name, strings.Join(values, ","))
+	}
+
+	return b.String()
+}
+
+// Signature of string by secret key derived for credential scope
+func (s *sigV4Request) sign(secret, stringToSign string) string {
+	key := hmacSHA256([]byte("AWS4"+secret), s.date)
+	key = hmacSHA256(key, s.region)
+	key = hmacSHA256(key, sigV4Service)
+	key = hmacSHA256(key, sigV4Terminator)
+
+	return hex.EncodeToString(hmacSHA256(key, stringToSign))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// URI encoding as required by SigV4: everything but unreserved characters is percent encoded
+func awsURIEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+
+	return b.String()
+}
+
+// Request body reader failing at EOF if content doesn't match signed SHA256
+type payloadVerifier struct {
+	io.ReadCloser
+	hash     hash.Hash
+	expected string
+}
+
+func (p *payloadVerifier) Read(b []byte) (int, error) {
+	n, err := p.ReadCloser.Read(b)
+	p.hash.Write(b[:n])
+	if err == io.EOF && hex.EncodeToString(p.hash.Sum(nil)) != p.expected {
+		return n, errContentSHA256Mismatch
+	}
+
+	return n, err
+}
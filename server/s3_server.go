@@ -0,0 +1,814 @@
+package server
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"github.com/GrvHldr/dfscache/cephutils"
+	"github.com/GrvHldr/dfscache/logger"
+	"github.com/GrvHldr/dfscache/tenants"
+	"github.com/satori/go.uuid"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// S3 compatible API subset. Path style requests only: /<bucket>/<key>
+const (
+	s3Namespace       = "http://s3.amazonaws.com/doc/2006-03-01/"
+	s3TimeFormat      = "2006-01-02T15:04:05.000Z"
+	s3MaxKeys         = 1000
+	s3StorageClass    = "STANDARD"
+	s3DefaultMimeType = "binary/octet-stream"
+	s3MetaPrefix      = "X-Amz-Meta-"
+)
+
+type s3Error struct {
+	Code    string
+	Message string
+	Status  int
+}
+
+func (e *s3Error) Error() string {
+	return e.Message
+}
+
+var (
+	errAccessDenied          = &s3Error{"AccessDenied", "Access Denied", http.StatusForbidden}
+	errSignatureVersion      = &s3Error{"AccessDenied", "Only AWS Signature Version 4 is supported", http.StatusForbidden}
+	errAuthorizationHeader   = &s3Error{"AuthorizationHeaderMalformed", "The authorization header is malformed", http.StatusBadRequest}
+	errAuthorizationQuery    = &s3Error{"AuthorizationQueryParametersError", "Query-string authentication parameters are malformed", http.StatusBadRequest}
+	errRequestTimeTooSkewed  = &s3Error{"RequestTimeTooSkewed", "The difference between the request time and the server's time is too large", http.StatusForbidden}
+	errExpiredPresignRequest = &s3Error{"AccessDenied", "Request has expired", http.StatusForbidden}
+	errInvalidAccessKeyId    = &s3Error{"InvalidAccessKeyId", "The access key Id you provided does not exist in our records", http.StatusForbidden}
+	errSignatureDoesNotMatch = &s3Error{"SignatureDoesNotMatch", "The request signature we calculated does not match the signature you provided", http.StatusForbidden}
+	errContentSHA256Mismatch = &s3Error{"XAmzContentSHA256Mismatch", "The provided 'x-amz-content-sha256' header does not match what was computed", http.StatusBadRequest}
+	errBadDigest             = &s3Error{"BadDigest", "The Content-MD5 you specified did not match what we received", http.StatusBadRequest}
+	errNotImplemented        = &s3Error{"NotImplemented", "A header or query you provided implies functionality that is not implemented", http.StatusNotImplemented}
+	errMethodNotAllowed      = &s3Error{"MethodNotAllowed", "The specified method is not allowed against this resource", http.StatusMethodNotAllowed}
+	errNoSuchBucket          = &s3Error{"NoSuchBucket", "The specified bucket does not exist", http.StatusNotFound}
+	errNoSuchKey             = &s3Error{"NoSuchKey", "The specified key does not exist", http.StatusNotFound}
+	errNoSuchUpload          = &s3Error{"NoSuchUpload", "The specified multipart upload does not exist", http.StatusNotFound}
+	errInvalidArgument       = &s3Error{"InvalidArgument", "Invalid Argument", http.StatusBadRequest}
+	errInvalidPart           = &s3Error{"InvalidPart", "One or more of the specified parts could not be found", http.StatusBadRequest}
+	errMalformedXML          = &s3Error{"MalformedXML", "The XML you provided was not well-formed", http.StatusBadRequest}
+	errMissingContentLength  = &s3Error{"MissingContentLength", "You must provide the Content-Length HTTP header", http.StatusLengthRequired}
+	errEntityTooLarge        = &s3Error{"EntityTooLarge", "Your proposed upload exceeds the maximum allowed object size", http.StatusBadRequest}
+	errQuotaExceeded         = &s3Error{"QuotaExceeded", "Storage quota exceeded", http.StatusInsufficientStorage}
+	errInternal              = &s3Error{"InternalError", "We encountered an internal error. Please try again", http.StatusInternalServerError}
+)
+
+type s3ErrorResponse struct {
+	XMLName  xml.Name `xml:"Error"`
+	Code     string
+	Message  string
+	Resource string
+}
+
+type s3Bucket struct {
+	Name      string
+	Placement string
+	Tenant    *tenants.Tenant
+	Index     *cephutils.BucketIndex
+	Owner     string // Owner of objects uploaded by request
+}
+
+type s3BucketInfo struct {
+	Name         string
+	CreationDate string
+}
+
+type s3ListAllMyBucketsResult struct {
+	XMLName xml.Name       `xml:"ListAllMyBucketsResult"`
+	Xmlns   string         `xml:"xmlns,attr"`
+	Owner   s3Owner        `xml:"Owner"`
+	Buckets []s3BucketInfo `xml:"Buckets>Bucket"`
+}
+
+type s3Owner struct {
+	ID          string
+	DisplayName string
+}
+
+type s3LocationConstraint struct {
+	XMLName  xml.Name `xml:"LocationConstraint"`
+	Xmlns    string   `xml:"xmlns,attr"`
+	Location string   `xml:",chardata"`
+}
+
+type s3Object struct {
+	Key          string
+	LastModified string
+	ETag         string
+	Size         uint64
+	StorageClass string
+}
+
+type s3CommonPrefix struct {
+	Prefix string
+}
+
+type s3ListBucketResult struct {
+	XMLName               xml.Name `xml:"ListBucketResult"`
+	Xmlns                 string   `xml:"xmlns,attr"`
+	Name                  string
+	Prefix                string
+	Delimiter             string `xml:",omitempty"`
+	StartAfter            string `xml:",omitempty"`
+	ContinuationToken     string `xml:",omitempty"`
+	NextContinuationToken string `xml:",omitempty"`
+	EncodingType          string `xml:",omitempty"`
+	KeyCount              int
+	MaxKeys               int
+	IsTruncated           bool
+	Contents              []s3Object
+	CommonPrefixes        []s3CommonPrefix
+}
+
+type s3InitiateMultipartUploadResult struct {
+	XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+	Xmlns    string   `xml:"xmlns,attr"`
+	Bucket   string
+	Key      string
+	UploadId string
+}
+
+type s3CompletedPart struct {
+	PartNumber int
+	ETag       string
+}
+
+type s3CompleteMultipartUpload struct {
+	XMLName xml.Name          `xml:"CompleteMultipartUpload"`
+	Parts   []s3CompletedPart `xml:"Part"`
+}
+
+type s3CompleteMultipartUploadResult struct {
+	XMLName  xml.Name `xml:"CompleteMultipartUploadResult"`
+	Xmlns    string   `xml:"xmlns,attr"`
+	Location string
+	Bucket   string
+	Key      string
+	ETag     string
+}
+
+type s3Router struct {
+	server *Server
+}
+
+func writeS3Error(w http.ResponseWriter, r *http.Request, e *s3Error) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(e.Status)
+	if r.Method == http.MethodHead {
+		return
+	}
+	w.Write([]byte(xml.Header))
+	xml.NewEncoder(w).Encode(s3ErrorResponse{Code: e.Code, Message: e.Message, Resource: r.URL.Path})
+}
+
+func writeS3XML(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.Write([]byte(xml.Header))
+	if err := xml.NewEncoder(w).Encode(v); err != nil {
+		logger.Log.Error(err)
+	}
+}
+
+// Respond to storage failure
+func writeS3StorageError(w http.ResponseWriter, r *http.Request, err error) {
+	var s3err *s3Error
+	var maxErr *http.MaxBytesError
+	switch {
+	case errors.As(err, &s3err):
+		writeS3Error(w, r, s3err)
+	case errors.As(err, &maxErr):
+		writeS3Error(w, r, errEntityTooLarge)
+	default:
+		if _, ok := err.(*cephutils.QuotaError); ok {
+			writeS3Error(w, r, errQuotaExceeded)
+			return
+		}
+		logger.Log.Error(err)
+		writeS3Error(w, r, errInternal)
+	}
+}
+
+// Tenant of S3 bucket or access key, default one if not set
+func (srv *Server) s3Tenant(name string) *tenants.Tenant {
+	if name == "" {
+		return srv.tenants.Default()
+	}
+
+	return srv.tenants.ByName(name)
+}
+
+// Configured bucket accessible by credentials
+func (srv *Server) openS3Bucket(name string, creds *s3Credentials) (*s3Bucket, *s3Error) {
+	for _, b := range srv.cfg.S3_OPTIONS.BUCKETS {
+		if b.NAME != name {
+			continue
+		}
+		if b.TENANT != creds.tenant {
+			return nil, errAccessDenied
+		}
+		tenant := srv.s3Tenant(b.TENANT)
+		if tenant == nil {
+			return nil, errAccessDenied
+		}
+		index, err := srv.storage.OpenBucketIndex(tenant.Namespace, b.NAME)
+		if err != nil {
+			logger.Log.Error(err)
+			return nil, errInternal
+		}
+		return &s3Bucket{Name: b.NAME, Placement: b.PLACEMENT, Tenant: tenant, Index: index, Owner: s3OwnerPrefix + creds.accessKey}, nil
+	}
+
+	return nil, errNoSuchBucket
+}
+
+func (s *s3Router) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	m := &customResponseWriter{w, 0, 0, 0, "", s3Route(req.URL.Path)}
+	start := time.Now()
+	s.server.serveS3(m, req)
+	m.requestDuration = time.Since(start)
+	logRequestContent(m, req)
+	s.server.metrics.observeRequest(m, req)
+}
+
+// Dispatch S3 operation by method, path and query parameters
+func (srv *Server) serveS3(w http.ResponseWriter, r *http.Request) {
+	creds, serr := srv.authenticateS3(r)
+	if serr != nil {
+		writeS3Error(w, r, serr)
+		return
+	}
+	if m, ok := w.(*customResponseWriter); ok {
+		m.principal = creds.accessKey
+	}
+
+	bucketName, key := r.URL.Path, ""
+	bucketName = strings.TrimPrefix(bucketName, "/")
+	if i := strings.Index(bucketName, "/"); i >= 0 {
+		bucketName, key = bucketName[:i], bucketName[i+1:]
+	}
+
+	if bucketName == "" {
+		if r.Method != http.MethodGet {
+			writeS3Error(w, r, errMethodNotAllowed)
+			return
+		}
+		srv.serveS3ListBuckets(w, creds)
+		return
+	}
+
+	b, serr := srv.openS3Bucket(bucketName, creds)
+	if serr != nil {
+		writeS3Error(w, r, serr)
+		return
+	}
+	defer b.Index.Close()
+	r = withTenant(r, b.Tenant)
+
+	q := r.URL.Query()
+	if key == "" {
+		switch {
+		case r.Method == http.MethodHead:
+		case r.Method == http.MethodGet && hasQuery(q, "location"):
+			writeS3XML(w, s3LocationConstraint{Xmlns: s3Namespace, Location: srv.cfg.S3_OPTIONS.REGION})
+		case r.Method == http.MethodGet:
+			serveS3ListObjects(w, r, b)
+		default:
+			writeS3Error(w, r, errMethodNotAllowed)
+		}
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		srv.serveS3GetObject(w, r, b, key)
+	case http.MethodPut:
+		switch {
+		case r.Header.Get("X-Amz-Copy-Source") != "":
+			writeS3Error(w, r, errNotImplemented)
+		case hasQuery(q, "uploadId"):
+			srv.serveS3UploadPart(w, r, b)
+		default:
+			srv.serveS3PutObject(w, r, b, key)
+		}
+	case http.MethodPost:
+		switch {
+		case hasQuery(q, "uploads"):
+			srv.serveS3CreateMultipart(w, r, b, key)
+		case hasQuery(q, "uploadId"):
+			srv.serveS3CompleteMultipart(w, r, b, key)
+		default:
+			writeS3Error(w, r, errMethodNotAllowed)
+		}
+	case http.MethodDelete:
+		if hasQuery(q, "uploadId") {
+			srv.serveS3AbortMultipart(w, r, b)
+			return
+		}
+		srv.serveS3DeleteObject(w, r, b, key)
+	default:
+		writeS3Error(w, r, errMethodNotAllowed)
+	}
+}
+
+func hasQuery(q url.Values, name string) bool {
+	_, ok := q[name]
+	return ok
+}
+
+func (srv *Server) serveS3ListBuckets(w http.ResponseWriter, creds *s3Credentials) {
+	result := s3ListAllMyBucketsResult{
+		Xmlns: s3Namespace,
+		Owner: s3Owner{ID: creds.tenant, DisplayName: creds.tenant},
+	}
+	for _, b := range srv.cfg.S3_OPTIONS.BUCKETS {
+		if b.TENANT == creds.tenant {
+			result.Buckets = append(result.Buckets, s3BucketInfo{Name: b.NAME, CreationDate: time.Unix(0, 0).UTC().Format(s3TimeFormat)})
+		}
+	}
+
+	writeS3XML(w, result)
+}
+
+// ListObjectsV2, keys sharing common prefix up to delimiter are rolled up
+func serveS3ListObjects(w http.ResponseWriter, r *http.Request, b *s3Bucket) {
+	q := r.URL.Query()
+	if t := q.Get("list-type"); t != "2" {
+		writeS3Error(w, r, errNotImplemented)
+		return
+	}
+
+	result := s3ListBucketResult{
+		Xmlns:             s3Namespace,
+		Name:              b.Name,
+		Prefix:            q.Get("prefix"),
+		Delimiter:         q.Get("delimiter"),
+		StartAfter:        q.Get("start-after"),
+		ContinuationToken: q.Get("continuation-token"),
+		EncodingType:      q.Get("encoding-type"),
+		MaxKeys:           s3MaxKeys,
+	}
+	if v := q.Get("max-keys"); v != "" {
+		max, err := strconv.Atoi(v)
+		if err != nil || max < 0 {
+			writeS3Error(w, r, errInvalidArgument)
+			return
+		}
+		if max < s3MaxKeys {
+			result.MaxKeys = max
+		}
+	}
+
+	marker := result.StartAfter
+	if result.ContinuationToken != "" {
+		raw, err := base64.RawURLEncoding.DecodeString(result.ContinuationToken)
+		if err != nil {
+			writeS3Error(w, r, errInvalidArgument)
+			return
+		}
+		marker = string(raw)
+	}
+
+	encode := func(s string) string {
+		if result.EncodingType == "url" {
+			return url.QueryEscape(s)
+		}
+		return s
+	}
+
+	for result.KeyCount < result.MaxKeys {
+		keys, entries, err := b.Index.List(result.Prefix, marker, result.MaxKeys-result.KeyCount)
+		if err != nil {
+			writeS3StorageError(w, r, err)
+			return
+		}
+		if len(keys) == 0 {
+			break
+		}
+
+		for _, key := range keys {
+			if result.KeyCount == result.MaxKeys {
+				break
+			}
+			rest := key[len(result.Prefix):]
+			if i := strings.Index(rest, result.Delimiter); result.Delimiter != "" && i >= 0 {
+				common := result.Prefix + rest[:i+len(result.Delimiter)]
+				result.CommonPrefixes = append(result.CommonPrefixes, s3CommonPrefix{Prefix: encode(common)})
+				result.KeyCount++
+				// Skip rest of keys rolled up into common prefix
+				marker = common + "\xff"
+				break
+			}
+			e := entries[key]
+			result.Contents = append(result.Contents, s3Object{
+				Key:          encode(key),
+				LastModified: time.Unix(e.Modified, 0).UTC().Format(s3TimeFormat),
+				ETag:         `"` + e.ETag + `"`,
+				Size:         e.Size,
+				StorageClass: s3StorageClass,
+			})
+			result.KeyCount++
+			marker = key
+		}
+	}
+
+	if result.KeyCount > 0 {
+		more, _, err := b.Index.List(result.Prefix, marker, 1)
+		if err != nil {
+			writeS3StorageError(w, r, err)
+			return
+		}
+		if len(more) > 0 {
+			result.IsTruncated = true
+			result.NextContinuationToken = base64.RawURLEncoding.EncodeToString([]byte(marker))
+		}
+	}
+	result.Prefix = encode(result.Prefix)
+	result.Delimiter = encode(result.Delimiter)
+	result.StartAfter = encode(result.StartAfter)
+
+	writeS3XML(w, result)
+}
+
+// Live bucket object registered under key
+func (srv *Server) lookupS3Object(b *s3Bucket, key string) (*cephutils.BucketEntry, *cephutils.RadosObj, error) {
+	e, err := b.Index.Get(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	if e == nil || e.Expired() {
+		return nil, nil, errNoSuchKey
+	}
+
+	obj, err := srv.storage.ExistingRadosObj(e.Pool, b.Tenant.Namespace, e.Oid)
+	if err != nil {
+		// Object is gone, e.g. removed by GC
+		b.Index.RemoveStale(key, e.Oid)
+		return nil, nil, errNoSuchKey
+	}
+	if obj.IsPartial() {
+		obj.Destroy()
+		return nil, nil, errNoSuchKey
+	}
+
+	return e, obj, nil
+}
+
+// Delete object previously registered under bucket key
+func (srv *Server) deleteS3Object(b *s3Bucket, e *cephutils.BucketEntry) {
+	obj, err := srv.storage.ExistingRadosObj(e.Pool, b.Tenant.Namespace, e.Oid)
+	if err != nil {
+		return
+	}
+	defer obj.Destroy()
+
+	if err = obj.Delete(); err != nil {
+		logger.Log.Errorf("Can't delete replaced object %s: %s", e.Oid, err)
+	}
+}
+
+// Register stored object under bucket key, replaced object is deleted
+func (srv *Server) registerS3Object(b *s3Bucket, key string, obj *cephutils.RadosObj, contentType string) error {
+	if contentType == "" {
+		contentType = s3DefaultMimeType
+	}
+	prev, err := b.Index.Swap(key, &cephutils.BucketEntry{
+		Pool:        obj.Pool,
+		Oid:         obj.Oid,
+		Size:        obj.Size,
+		ETag:        obj.Checksum,
+		ContentType: contentType,
+		Modified:    obj.Modified,
+		TTL:         obj.TTL,
+	})
+	if err != nil {
+		return err
+	}
+
+	if prev != nil && prev.Oid != obj.Oid {
+		srv.deleteS3Object(b, prev)
+	}
+
+	return nil
+}
+
+// GetObject and HeadObject, ranges and conditional requests are handled by http.ServeContent
+func (srv *Server) serveS3GetObject(w http.ResponseWriter, r *http.Request, b *s3Bucket, key string) {
+	e, obj, err := srv.lookupS3Object(b, key)
+	if err != nil {
+		writeS3StorageError(w, r, err)
+		return
+	}
+	defer obj.Destroy()
+
+	w.Header().Set("ETag", `"`+e.ETag+`"`)
+	w.Header().Set("Content-Type", e.ContentType)
+	for key, value := range obj.Meta {
+		w.Header().Set(s3MetaPrefix+key, value)
+	}
+
+	// Object is locked while read, so GC doesn't remove it in the middle of transfer
+	obj.LockRados()
+	defer obj.UnlockRados()
+
+	http.ServeContent(w, r, "", time.Unix(e.Modified, 0), io.NewSectionReader(obj, 0, int64(obj.Size)))
+}
+
+// User metadata from x-amz-meta-* headers
+func s3RequestMeta(r *http.Request) (map[string]string, *s3Error) {
+	var meta map[string]string
+	for name, values := range r.Header {
+		if !strings.HasPrefix(name, s3MetaPrefix) || len(values) == 0 {
+			continue
+		}
+		if meta == nil {
+			meta = make(map[string]string)
+		}
+		meta[strings.ToLower(strings.TrimPrefix(name, s3MetaPrefix))] = values[0]
+	}
+	if err := cephutils.ValidateMeta(meta); err != nil {
+		return nil, &s3Error{errInvalidArgument.Code, err.Error(), errInvalidArgument.Status}
+	}
+
+	return meta, nil
+}
+
+// Upload size limit of bucket tenant, request body is limited accordingly
+func (srv *Server) limitS3Upload(w http.ResponseWriter, r *http.Request, b *s3Bucket) *s3Error {
+	if r.ContentLength < 0 {
+		return errMissingContentLength
+	}
+
+	limit := b.Tenant.UploadLimit(srv.cfg.HTTP_OPTIONS.MAX_UPLOAD_SIZE)
+	if limit > 0 {
+		if uint64(r.ContentLength) > limit {
+			return errEntityTooLarge
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, int64(limit))
+	}
+
+	return nil
+}
+
+// Check Content-MD5 header against stored object checksum if supplied
+func checkContentMD5(r *http.Request, checksum string) *s3Error {
+	v := r.Header.Get("Content-Md5")
+	if v == "" {
+		return nil
+	}
+
+	expected, err := base64.StdEncoding.DecodeString(v)
+	if err != nil || hex.EncodeToString(expected) != checksum {
+		return errBadDigest
+	}
+
+	return nil
+}
+
+func (srv *Server) serveS3PutObject(w http.ResponseWriter, r *http.Request, b *s3Bucket, key string) {
+	if serr := srv.limitS3Upload(w, r, b); serr != nil {
+		writeS3Error(w, r, serr)
+		return
+	}
+	size := uint64(r.ContentLength)
+	meta, serr := s3RequestMeta(r)
+	if serr != nil {
+		writeS3Error(w, r, serr)
+		return
+	}
+
+	obj, err := srv.storage.NewRadosObj(cephutils.ObjOptions{
+		FileName:  path.Base(key),
+		Size:      size,
+		Placement: b.Placement,
+		Namespace: b.Tenant.Namespace,
+		TTL:       b.Tenant.ObjectTTL,
+		Owner:     b.Owner,
+		Meta:      meta,
+	})
+	if err != nil {
+		writeS3StorageError(w, r, err)
+		return
+	}
+	defer obj.Destroy()
+
+	if err = obj.CheckQuota(size, b.Tenant.QuotaBytes, b.Tenant.QuotaObjects); err != nil {
+		writeS3StorageError(w, r, err)
+		return
+	}
+
+	if _, err = obj.WriteFromReader(r.Body); err != nil {
+		obj.Abort()
+		writeS3StorageError(w, r, err)
+		return
+	}
+	if serr := checkContentMD5(r, obj.Checksum); serr != nil {
+		obj.Delete()
+		writeS3Error(w, r, serr)
+		return
+	}
+
+	if err = srv.registerS3Object(b, key, obj, r.Header.Get("Content-Type")); err != nil {
+		obj.Delete()
+		writeS3StorageError(w, r, err)
+		return
+	}
+
+	w.Header().Set("ETag", `"`+obj.Checksum+`"`)
+}
+
+func (srv *Server) serveS3DeleteObject(w http.ResponseWriter, r *http.Request, b *s3Bucket, key string) {
+	e, err := b.Index.Take(key)
+	if err != nil {
+		writeS3StorageError(w, r, err)
+		return
+	}
+
+	if e != nil {
+		srv.deleteS3Object(b, e)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Upload ID encodes pool and OID of multipart upload object
+func s3UploadId(obj *cephutils.RadosObj) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(obj.Pool + "/" + obj.Oid.String()))
+}
+
+// Pending multipart upload by upload ID
+func (srv *Server) retrieveS3Upload(b *s3Bucket, uploadId string) (*cephutils.RadosObj, *s3Error) {
+	raw, err := base64.RawURLEncoding.DecodeString(uploadId)
+	if err != nil {
+		return nil, errNoSuchUpload
+	}
+	parts := strings.SplitN(string(raw), "/", 2)
+	if len(parts) != 2 || !srv.storage.IsCachePool(parts[0]) {
+		return nil, errNoSuchUpload
+	}
+	oid, err := uuid.FromString(parts[1])
+	if err != nil {
+		return nil, errNoSuchUpload
+	}
+
+	obj, err := srv.storage.ExistingRadosObj(parts[0], b.Tenant.Namespace, oid)
+	if err != nil {
+		return nil, errNoSuchUpload
+	}
+	if !obj.IsMultipartPending() {
+		obj.Destroy()
+		return nil, errNoSuchUpload
+	}
+
+	return obj, nil
+}
+
+func (srv *Server) serveS3CreateMultipart(w http.ResponseWriter, r *http.Request, b *s3Bucket, key string) {
+	meta, serr := s3RequestMeta(r)
+	if serr != nil {
+		writeS3Error(w, r, serr)
+		return
+	}
+
+	obj, err := srv.storage.NewRadosObj(cephutils.ObjOptions{
+		FileName:  path.Base(key),
+		Placement: b.Placement,
+		Namespace: b.Tenant.Namespace,
+		TTL:       b.Tenant.ObjectTTL,
+		Owner:     b.Owner,
+		NoPacking: true,
+		Meta:      meta,
+	})
+	if err != nil {
+		writeS3StorageError(w, r, err)
+		return
+	}
+	defer obj.Destroy()
+
+	if err = obj.CheckQuota(0, b.Tenant.QuotaBytes, b.Tenant.QuotaObjects); err != nil {
+		writeS3StorageError(w, r, err)
+		return
+	}
+	if err = obj.StartMultipart(srv.multipartTimeout()); err != nil {
+		writeS3StorageError(w, r, err)
+		return
+	}
+
+	writeS3XML(w, s3InitiateMultipartUploadResult{
+		Xmlns:    s3Namespace,
+		Bucket:   b.Name,
+		Key:      key,
+		UploadId: s3UploadId(obj),
+	})
+}
+
+func (srv *Server) serveS3UploadPart(w http.ResponseWriter, r *http.Request, b *s3Bucket) {
+	q := r.URL.Query()
+	number, err := strconv.Atoi(q.Get("partNumber"))
+	if err != nil || number < 1 || number > cephutils.MaxPartNumber {
+		writeS3Error(w, r, errInvalidArgument)
+		return
+	}
+	if serr := srv.limitS3Upload(w, r, b); serr != nil {
+		writeS3Error(w, r, serr)
+		return
+	}
+
+	obj, serr := srv.retrieveS3Upload(b, q.Get("uploadId"))
+	if serr != nil {
+		writeS3Error(w, r, serr)
+		return
+	}
+	defer obj.Destroy()
+
+	limit := b.Tenant.UploadLimit(srv.cfg.HTTP_OPTIONS.MAX_UPLOAD_SIZE)
+	rd, err := partReader(w, r, obj, number, limit, b.Tenant.QuotaBytes)
+	if err != nil {
+		writeS3StorageError(w, r, err)
+		return
+	}
+	_, etag, err := obj.WritePart(number, rd)
+	if err != nil {
+		writeS3StorageError(w, r, err)
+		return
+	}
+	w.Header().Set("ETag", `"`+etag+`"`)
+}
+
+func (srv *Server) serveS3CompleteMultipart(w http.ResponseWriter, r *http.Request, b *s3Bucket, key string) {
+	var req s3CompleteMultipartUpload
+	if err := xml.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeS3Error(w, r, errMalformedXML)
+		return
+	}
+
+	obj, serr := srv.retrieveS3Upload(b, r.URL.Query().Get("uploadId"))
+	if serr != nil {
+		writeS3Error(w, r, serr)
+		return
+	}
+	defer obj.Destroy()
+
+	var parts []cephutils.CompletedPart
+	for _, p := range req.Parts {
+		parts = append(parts, cephutils.CompletedPart{Number: p.PartNumber, ETag: p.ETag})
+	}
+
+	total, err := obj.MultipartSize(parts)
+	if err != nil {
+		writeS3Error(w, r, &s3Error{errInvalidPart.Code, err.Error(), errInvalidPart.Status})
+		return
+	}
+	limit := b.Tenant.UploadLimit(srv.cfg.HTTP_OPTIONS.MAX_UPLOAD_SIZE)
+	if limit > 0 && total > limit {
+		writeS3Error(w, r, errEntityTooLarge)
+		return
+	}
+	if err = obj.CheckQuota(total, b.Tenant.QuotaBytes, b.Tenant.QuotaObjects); err != nil {
+		writeS3StorageError(w, r, err)
+		return
+	}
+
+	if err = obj.CompleteMultipart(parts, b.Tenant.ObjectTTL); err != nil {
+		writeS3StorageError(w, r, err)
+		return
+	}
+
+	if err = srv.registerS3Object(b, key, obj, ""); err != nil {
+		obj.Delete()
+		writeS3StorageError(w, r, err)
+		return
+	}
+	logger.Log.Infof("S3 multipart upload completed for %s/%s: %d parts", b.Name, key, len(parts))
+
+	writeS3XML(w, s3CompleteMultipartUploadResult{
+		Xmlns:    s3Namespace,
+		Location: "/" + b.Name + "/" + key,
+		Bucket:   b.Name,
+		Key:      key,
+		ETag:     `"` + obj.Checksum + `"`,
+	})
+}
+
+func (srv *Server) serveS3AbortMultipart(w http.ResponseWriter, r *http.Request, b *s3Bucket) {
+	obj, serr := srv.retrieveS3Upload(b, r.URL.Query().Get("uploadId"))
+	if serr != nil {
+		writeS3Error(w, r, serr)
+		return
+	}
+	defer obj.Destroy()
+
+	if err := obj.Delete(); err != nil {
+		writeS3StorageError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,171 @@
+package server
+
+import (
+	"crypto/rsa"
+	"fmt"
+	"github.com/GrvHldr/dfscache/cephutils"
+	"github.com/GrvHldr/dfscache/config"
+	"github.com/GrvHldr/dfscache/logger"
+	"github.com/GrvHldr/dfscache/tenants"
+	"net/http"
+	"sync"
+)
+
+// Server instance. HTTP, S3 and ZMQ listeners and garbage collector of instance share its configuration,
+// storage backend and tenants, so several instances may run within one process
+type Server struct {
+	cfg     *config.ServerConfig
+	storage *cephutils.Storage
+	tenants *tenants.Registry
+	router  *customRouter
+	metrics *metrics
+
+	// HTTP_OPTIONS authentication keys
+	apiKeys      []apiKey
+	jwtPublicKey *rsa.PublicKey
+	revokedCerts *crlStore // Revoked client certificates, nil if CLIENT_CRL_FILE isn't set
+
+	certificates     *certStore
+	certificatesOnce sync.Once
+	certificatesErr  error
+
+	uploadsMu sync.Mutex
+	uploads   map[string]*cephutils.LockRadosObj // ZMQ upload sessions by client identity
+
+	zmqMu     sync.Mutex
+	zmqDomain string // ZAP domain of instance sockets, empty if ZMQ authentication isn't started
+
+	health       healthState
+	monitorOnce  sync.Once
+	monitorErr   error
+	running      sync.WaitGroup
+	shutdownCh   chan struct{}
+	shutdownOnce sync.Once
+}
+
+// Server component
+type Component int
+
+const (
+	HTTP          Component = iota // HTTP API, and S3 compatible API if S3_OPTIONS.LISTEN is set
+	ZMQDownloader                  // ZMQ_OPTIONS.LISTEN_DOWNLOAD listener
+	ZMQUploader                    // ZMQ_OPTIONS.LISTEN_UPLOAD listener
+	GC                             // Garbage Collector
+)
+
+// New server instance of configuration and storage backend, storage is made of CEPH_OPTIONS if nil
+func New(cfg *config.ServerConfig, storage *cephutils.Storage) (*Server, error) {
+	if storage == nil {
+		storage = cephutils.NewStorage(cfg.CEPH_OPTIONS)
+	}
+
+	srv := &Server{
+		cfg:        cfg,
+		storage:    storage,
+		tenants:    tenants.NewRegistry(cfg),
+		uploads:    make(map[string]*cephutils.LockRadosObj),
+		shutdownCh: make(chan struct{}),
+	}
+	if err := srv.loadAuthKeys(); err != nil {
+		return nil, fmt.Errorf("Can't load authentication keys: %s", err)
+	}
+	srv.metrics = newMetrics(srv)
+	storage.AddObserver(srv.metrics.observeRados)
+	srv.router = srv.newRouter()
+
+	return srv, nil
+}
+
+// Configuration of instance
+func (srv *Server) Options() *config.ServerConfig {
+	return srv.cfg
+}
+
+// HTTP API handler
+func (srv *Server) Handler() http.Handler {
+	return srv.router
+}
+
+// Bind components and serve them in background until shutdown.
+// Components already started are shut down if any of them fails to start
+func (srv *Server) Start(components ...Component) error {
+	if err := srv.startMonitor(); err != nil {
+		srv.Shutdown()
+		srv.Wait()
+		return err
+	}
+
+	for _, c := range components {
+		var serve func()
+		var err error
+		switch c {
+		case HTTP:
+			serve, err = srv.listenHTTP()
+		case ZMQDownloader:
+			serve, err = srv.bindZmqDownloader()
+		case ZMQUploader:
+			serve, err = srv.bindZmqUploader()
+		case GC:
+			serve, err = srv.startGC()
+		default:
+			err = fmt.Errorf("Unknown server component %d", c)
+		}
+		if err != nil {
+			srv.Shutdown()
+			srv.Wait()
+			return err
+		}
+
+		srv.setServing(c, true)
+		srv.running.Add(1)
+		go func(c Component) {
+			defer srv.running.Done()
+			serve()
+			srv.setServing(c, false)
+		}(c)
+	}
+
+	return nil
+}
+
+// Start storage health monitor, and HEALTH_LISTEN probes listener if configured, once per instance
+func (srv *Server) startMonitor() error {
+	srv.monitorOnce.Do(func() {
+		if srv.cfg.HEALTH_LISTEN != "" {
+			var serve func()
+			if serve, srv.monitorErr = srv.listenHealth(); srv.monitorErr != nil {
+				return
+			}
+			srv.running.Add(1)
+			go func() {
+				defer srv.running.Done()
+				serve()
+			}()
+		}
+
+		srv.running.Add(1)
+		go func() {
+			defer srv.running.Done()
+			srv.monitorStorage()
+		}()
+	})
+
+	return srv.monitorErr
+}
+
+// Wait for components to finish after shutdown
+func (srv *Server) Wait() {
+	srv.running.Wait()
+	srv.stopZmqAuth()
+}
+
+// Start components and serve them until SIGTERM or SIGINT. Exits if any component fails to start
+func (srv *Server) Serve(components ...Component) {
+	if err := srv.Start(components...); err != nil {
+		logger.Log.Fatal(err)
+	}
+	go srv.handleSignals()
+
+	srv.Wait()
+	logger.Log.Info("Shutdown complete")
+}
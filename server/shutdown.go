@@ -0,0 +1,106 @@
+package server
+
+import (
+	"context"
+	"github.com/GrvHldr/dfscache/logger"
+	zmq "github.com/pebbe/zmq4"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// Graceful shutdown. /readyz reports shutting down, HTTP listeners keep serving for SHUTDOWN_DRAIN
+// so load balancers notice it, then servers stop taking new work, in-flight HTTP requests and ZMQ
+// upload sessions are given SHUTDOWN_TIMEOUT to finish, unfinished uploads are aborted
+const (
+	defaultShutdownTimeout = 30 * time.Second
+	zmqPollInterval        = time.Second
+)
+
+// Stop all components of instance
+func (srv *Server) Shutdown() {
+	srv.shutdownOnce.Do(func() {
+		close(srv.shutdownCh)
+	})
+}
+
+func (srv *Server) shuttingDown() bool {
+	select {
+	case <-srv.shutdownCh:
+		return true
+	default:
+		return false
+	}
+}
+
+// Time given to in-flight requests and uploads to finish
+func (srv *Server) shutdownTimeout() time.Duration {
+	if t := srv.cfg.SHUTDOWN_TIMEOUT; t > 0 {
+		return time.Duration(t) * time.Second
+	}
+
+	return defaultShutdownTimeout
+}
+
+// Time HTTP listeners keep serving after shutdown starts, w/ /readyz reporting shutting down
+func (srv *Server) shutdownDrain() time.Duration {
+	if t := srv.cfg.SHUTDOWN_DRAIN; t > 0 {
+		return time.Duration(t) * time.Second
+	}
+
+	return 0
+}
+
+// Shut down on SIGTERM or SIGINT, second signal forces exit
+func (srv *Server) handleSignals() {
+	sig := make(chan os.Signal, 2)
+	signal.Notify(sig, syscall.SIGTERM, syscall.SIGINT)
+
+	logger.Log.Infof("Received %s, shutting down", <-sig)
+	srv.Shutdown()
+
+	logger.Log.Fatalf("Received %s, exiting immediately", <-sig)
+}
+
+// Serve HTTP on bound listener until shutdown drain is over, connections still active after shutdown timeout are closed
+func (srv *Server) serveUntilShutdown(hs *http.Server, ln net.Listener) {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		<-srv.shutdownCh
+		time.Sleep(srv.shutdownDrain())
+
+		ctx, cancel := context.WithTimeout(context.Background(), srv.shutdownTimeout())
+		defer cancel()
+		if err := hs.Shutdown(ctx); err != nil {
+			logger.Log.Errorf("HTTP server %s shutdown: %s, closing active connections", hs.Addr, err)
+			hs.Close()
+		}
+	}()
+
+	var err error
+	if hs.TLSConfig != nil {
+		err = hs.ServeTLS(ln, "", "")
+	} else {
+		err = hs.Serve(ln)
+	}
+	if err != http.ErrServerClosed {
+		logger.Log.Errorf("HTTP server %s failed: %s", hs.Addr, err)
+		return
+	}
+	<-done
+	logger.Log.Infof("Stopped HTTP server %s", hs.Addr)
+}
+
+// Poll ZMQ sockets for shutdown interval, poll interrupted by signal reports no events
+func pollZmq(poller *zmq.Poller) ([]zmq.Polled, error) {
+	polled, err := poller.Poll(zmqPollInterval)
+	if err != nil && zmq.AsErrno(err) == zmq.Errno(syscall.EINTR) {
+		return nil, nil
+	}
+
+	return polled, err
+}
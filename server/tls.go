@@ -0,0 +1,244 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"github.com/GrvHldr/dfscache/logger"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Server certificates are selected by SNI and reloaded when files change or on SIGHUP,
+// established connections keep certificate they were negotiated with. Client certificates
+// revocation list is reloaded the same way
+const defaultCertReloadInterval = time.Minute
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+type certStore struct {
+	sync.RWMutex
+	pairs    [][2]string // Certificate and key files
+	certs    []*tls.Certificate
+	mtimes   map[string]time.Time
+	interval time.Duration // Files modification check interval
+	crl      *crlStore     // Client certificates revocation list, nil if none
+}
+
+// Certificate and key files of HTTP_OPTIONS, primary pair first
+func (srv *Server) certPairs() [][2]string {
+	opts := srv.cfg.HTTP_OPTIONS
+	pairs := [][2]string{{opts.CERT_FILE, opts.CERT_KEY_FILE}}
+	for _, c := range opts.CERTIFICATES {
+		pairs = append(pairs, [2]string{c.CERT_FILE, c.CERT_KEY_FILE})
+	}
+
+	return pairs
+}
+
+// Load all certificates, current ones are kept on failure
+func (s *certStore) load() error {
+	var certs []*tls.Certificate
+	mtimes := make(map[string]time.Time)
+	for _, pair := range s.pairs {
+		cert, err := tls.LoadX509KeyPair(pair[0], pair[1])
+		if err != nil {
+			return fmt.Errorf("Can't load certificate %s: %s", pair[0], err)
+		}
+		if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+			return err
+		}
+		certs = append(certs, &cert)
+
+		for _, fname := range pair {
+			if fi, err := os.Stat(fname); err == nil {
+				mtimes[fname] = fi.ModTime()
+			}
+		}
+	}
+
+	s.Lock()
+	s.certs, s.mtimes = certs, mtimes
+	s.Unlock()
+
+	return nil
+}
+
+// Check if any certificate or key file is modified since loaded
+func (s *certStore) modified() bool {
+	s.RLock()
+	defer s.RUnlock()
+
+	for _, pair := range s.pairs {
+		for _, fname := range pair {
+			if fi, err := os.Stat(fname); err == nil && !fi.ModTime().Equal(s.mtimes[fname]) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// Reload certificates and revocation list on files change or SIGHUP until stopped
+func (s *certStore) watch(stop <-chan struct{}) {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	for {
+		certs, crl := true, true
+		select {
+		case <-ticker.C:
+			certs, crl = s.modified(), s.crl.modified()
+		case <-hup:
+		case <-stop:
+			return
+		}
+
+		if crl {
+			s.crl.reload()
+		}
+		if !certs {
+			continue
+		}
+		if err := s.load(); err != nil {
+			logger.Log.Errorf("Certificates reload failed, current ones are kept: %s", err)
+			continue
+		}
+		logger.Log.Info("Certificates reloaded")
+	}
+}
+
+// Certificate matching client SNI, primary certificate if none matches
+func (s *certStore) getCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	for _, cert := range s.certs {
+		if hello.SupportsCertificate(cert) == nil {
+			return cert, nil
+		}
+	}
+
+	return s.certs[0], nil
+}
+
+// Server certificates shared by HTTP and S3 listeners, loaded once and watched until shutdown
+func (srv *Server) serverCertificates() (*certStore, error) {
+	srv.certificatesOnce.Do(func() {
+		s := &certStore{pairs: srv.certPairs(), interval: defaultCertReloadInterval, crl: srv.revokedCerts}
+		if t := srv.cfg.HTTP_OPTIONS.CERT_RELOAD_INTERVAL; t > 0 {
+			s.interval = time.Duration(t) * time.Second
+		}
+		if srv.certificatesErr = s.load(); srv.certificatesErr != nil {
+			return
+		}
+		go s.watch(srv.shutdownCh)
+		srv.certificates = s
+	})
+
+	return srv.certificates, srv.certificatesErr
+}
+
+// Cipher suite ids by names
+func cipherSuites(names []string) ([]uint16, error) {
+	suites := append(tls.CipherSuites(), tls.InsecureCipherSuites()...)
+	var ids []uint16
+	for _, name := range names {
+		found := false
+		for _, suite := range suites {
+			if suite.Name == name {
+				ids = append(ids, suite.ID)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("Unknown cipher suite '%s'", name)
+		}
+	}
+
+	return ids, nil
+}
+
+// Server TLS settings of HTTP_OPTIONS, w/ client certificates verification if requested.
+// Client auth settings go first, so revocation list is watched along w/ server certificates
+func (srv *Server) serverTLSConfig(clientAuth bool) (*tls.Config, error) {
+	opts := srv.cfg.HTTP_OPTIONS
+
+	cfg := &tls.Config{}
+	if clientAuth {
+		mtls, err := srv.clientAuthTLSConfig()
+		if err != nil {
+			return nil, err
+		}
+		if mtls != nil {
+			cfg = mtls
+		}
+	}
+
+	var err error
+
+	cfg.MinVersion = tls.VersionTLS12
+	if opts.TLS_MIN_VERSION != "" {
+		v, ok := tlsVersions[opts.TLS_MIN_VERSION]
+		if !ok {
+			return nil, fmt.Errorf("Unknown TLS version '%s'", opts.TLS_MIN_VERSION)
+		}
+		cfg.MinVersion = v
+	}
+	if cfg.CipherSuites, err = cipherSuites(opts.TLS_CIPHER_SUITES); err != nil {
+		return nil, err
+	}
+
+	certs, err := srv.serverCertificates()
+	if err != nil {
+		return nil, err
+	}
+	cfg.GetCertificate = certs.getCertificate
+
+	return cfg, nil
+}
+
+// Listen HTTPS, or plain HTTP in HTTP_OPTIONS.PLAINTEXT mode behind TLS terminating proxy.
+// TLS settings are set to server
+func (srv *Server) listen(hs *http.Server, clientAuth bool) (net.Listener, error) {
+	opts := srv.cfg.HTTP_OPTIONS
+	if opts.PLAINTEXT {
+		if clientAuth && opts.CLIENT_CA_FILE != "" {
+			return nil, fmt.Errorf("Client certificates verification requires TLS")
+		}
+		ln, err := net.Listen("tcp", hs.Addr)
+		if err != nil {
+			return nil, err
+		}
+		logger.Log.Infof("HTTP Listening on '%s'", hs.Addr)
+		return ln, nil
+	}
+
+	cfg, err := srv.serverTLSConfig(clientAuth)
+	if err != nil {
+		return nil, err
+	}
+	ln, err := net.Listen("tcp", hs.Addr)
+	if err != nil {
+		return nil, err
+	}
+	hs.TLSConfig = cfg
+
+	logger.Log.Infof("HTTPS Listening on '%s'", hs.Addr)
+	return ln, nil
+}
@@ -0,0 +1,157 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"github.com/GrvHldr/dfscache/config"
+	"io/ioutil"
+	"math/big"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestCipherSuites(t *testing.T) {
+	tests := []struct {
+		names []string
+		want  []uint16
+		ok    bool
+	}{
+		{nil, nil, true},
+		{[]string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"}, []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256}, true},
+		{
+			[]string{"TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256", "TLS_RSA_WITH_AES_128_CBC_SHA256"},
+			[]uint16{tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256, tls.TLS_RSA_WITH_AES_128_CBC_SHA256},
+			true,
+		},
+		{[]string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256", "TLS_NO_SUCH_SUITE"}, nil, false},
+		{[]string{"tls_ecdhe_rsa_with_aes_128_gcm_sha256"}, nil, false},
+	}
+
+	for _, tt := range tests {
+		got, err := cipherSuites(tt.names)
+		if (err == nil) != tt.ok {
+			t.Errorf("cipherSuites(%v) error = %v", tt.names, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("cipherSuites(%v) = %v, want %v", tt.names, got, tt.want)
+		}
+	}
+}
+
+func TestServerTLSConfig(t *testing.T) {
+	ca, caKey := newTestCA(t, "server CA")
+	certFile, keyFile := writeTestCert(t, ca, caKey, "localhost")
+
+	tests := []struct {
+		version string
+		suites  []string
+		want    uint16
+		ok      bool
+	}{
+		{"", nil, tls.VersionTLS12, true},
+		{"1.0", nil, tls.VersionTLS10, true},
+		{"1.3", nil, tls.VersionTLS13, true},
+		{"1.2", []string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"}, tls.VersionTLS12, true},
+		{"1.4", nil, 0, false},
+		{"TLS1.2", nil, 0, false},
+		{"1.2", []string{"TLS_NO_SUCH_SUITE"}, 0, false},
+	}
+
+	for _, tt := range tests {
+		cfg := new(config.ServerConfig)
+		cfg.HTTP_OPTIONS.CERT_FILE, cfg.HTTP_OPTIONS.CERT_KEY_FILE = certFile, keyFile
+		cfg.HTTP_OPTIONS.TLS_MIN_VERSION, cfg.HTTP_OPTIONS.TLS_CIPHER_SUITES = tt.version, tt.suites
+		srv := newTestServer(cfg)
+		srv.shutdownCh = make(chan struct{})
+
+		got, err := srv.serverTLSConfig(false)
+		close(srv.shutdownCh)
+		if (err == nil) != tt.ok {
+			t.Errorf("TLS version %q, suites %v: error = %v", tt.version, tt.suites, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if got.MinVersion != tt.want {
+			t.Errorf("TLS version %q: min version = %x, want %x", tt.version, got.MinVersion, tt.want)
+		}
+		cert, err := got.GetCertificate(&tls.ClientHelloInfo{ServerName: "localhost"})
+		if err != nil || cert.Leaf.Subject.CommonName != "localhost" {
+			t.Errorf("TLS version %q: certificate = %v, error = %v", tt.version, cert, err)
+		}
+	}
+}
+
+// Self-signed CA certificate and key
+func newTestCA(t *testing.T, name string) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	raw, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := x509.ParseCertificate(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return ca, key
+}
+
+// Certificate of CA issued for name, written w/ its key to PEM files of test temp dir
+func writeTestCert(t *testing.T, ca *x509.Certificate, caKey *ecdsa.PrivateKey, name string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	raw, err := x509.CreateCertificate(rand.Reader, tmpl, ca, &key.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rawKey, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, name+".crt"), filepath.Join(dir, name+".key")
+	writePEM(t, certFile, "CERTIFICATE", raw)
+	writePEM(t, keyFile, "EC PRIVATE KEY", rawKey)
+
+	return certFile, keyFile
+}
+
+func writePEM(t *testing.T, fname, blockType string, raw []byte) {
+	if err := ioutil.WriteFile(fname, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: raw}), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
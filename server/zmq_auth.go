@@ -0,0 +1,84 @@
+package server
+
+import (
+	"fmt"
+	zmq "github.com/pebbe/zmq4"
+	"sync"
+)
+
+// ZMQ message property holding CURVE client public key
+const zmqUserIdProperty = "User-Id"
+
+// ZMQ authentication handler is process wide: it is started by first server instance using ZMQ
+// and stopped once all of them are stopped. Each instance has its own ZAP domain, so only client keys
+// of instance tenants are allowed to connect to its sockets
+var (
+	zmqAuthMu      sync.Mutex
+	zmqAuthUsers   int
+	zmqAuthDomains int
+)
+
+// Start ZMQ CURVE authentication of keys within new domain, returns the domain.
+// Client public key is passed to sockets as User-Id message property to identify tenant
+func startZmqAuth(keys []string) (string, error) {
+	zmqAuthMu.Lock()
+	defer zmqAuthMu.Unlock()
+
+	if zmqAuthUsers == 0 {
+		zmq.AuthSetVerbose(true)
+		if err := zmq.AuthStart(); err != nil {
+			return "", err
+		}
+		zmq.AuthSetMetadataHandler(
+			func(version, requestId, domain, address, identity, mechanism string, credentials ...string) map[string]string {
+				if mechanism != "CURVE" || len(credentials) == 0 {
+					return map[string]string{}
+				}
+				return map[string]string{zmqUserIdProperty: zmq.Z85encode(credentials[0])}
+			},
+		)
+	}
+	zmqAuthUsers++
+	zmqAuthDomains++
+	domain := fmt.Sprintf("dfscache-%d", zmqAuthDomains)
+	zmq.AuthCurveAdd(domain, keys...)
+
+	return domain, nil
+}
+
+func stopZmqAuth(domain string) {
+	zmqAuthMu.Lock()
+	defer zmqAuthMu.Unlock()
+
+	zmq.AuthCurveRemoveAll(domain)
+	if zmqAuthUsers--; zmqAuthUsers == 0 {
+		zmq.AuthStop()
+	}
+}
+
+// Start ZMQ authentication for instance tenants, returns ZAP domain of instance sockets
+func (srv *Server) startZmqAuth() (string, error) {
+	srv.zmqMu.Lock()
+	defer srv.zmqMu.Unlock()
+
+	if srv.zmqDomain == "" {
+		domain, err := startZmqAuth(srv.tenants.CurveKeys())
+		if err != nil {
+			return "", err
+		}
+		srv.zmqDomain = domain
+	}
+
+	return srv.zmqDomain, nil
+}
+
+// Stop ZMQ authentication of instance if started
+func (srv *Server) stopZmqAuth() {
+	srv.zmqMu.Lock()
+	defer srv.zmqMu.Unlock()
+
+	if srv.zmqDomain != "" {
+		stopZmqAuth(srv.zmqDomain)
+		srv.zmqDomain = ""
+	}
+}
@@ -1,74 +1,138 @@
 package server
 
 import (
-	"github.com/GrvHldr/dfscache/cephutils"
-	"github.com/GrvHldr/dfscache/config"
+	"encoding/json"
 	"github.com/GrvHldr/dfscache/logger"
 	zmq "github.com/pebbe/zmq4"
 	"github.com/satori/go.uuid"
 	"strconv"
 )
 
-func BindZMqDownloader() {
+const (
+	// Objects listing request: identity, command, optional JSON encoded listRequest
+	zmqListCommand = "LIST"
+	// Lookup by file name or metadata: identity, command, JSON encoded lookupRequest
+	zmqLookupCommand = "LOOKUP"
+)
+
+// Bind ZMQ downloader, returns loop serving download, listing and lookup requests
+func (srv *Server) bindZmqDownloader() (func(), error) {
 	// Start Authentication process
-	zmq.AuthSetVerbose(true)
-	zmq.AuthStart()
-	zmq.AuthCurveAdd("*", config.Config.ZMQ_OPTIONS.Z85_PUBLIC_CLIENT_KEY)
+	domain, err := srv.startZmqAuth()
+	if err != nil {
+		return nil, err
+	}
+	opts := srv.cfg.ZMQ_OPTIONS
 
 	router, err := zmq.NewSocket(zmq.ROUTER)
 	if err != nil {
-		logger.Log.Fatal(err)
-		return
+		return nil, err
 	}
-	defer router.Close()
 
-	router.ServerAuthCurve("*", config.Config.ZMQ_OPTIONS.Z85_PRIVATE_KEY)
-	router.SetRcvhwm(config.Config.ZMQ_OPTIONS.DOWNLOAD_PIPELINE * 2)
-	router.SetSndhwm(config.Config.ZMQ_OPTIONS.DOWNLOAD_PIPELINE * 2)
+	router.ServerAuthCurve(domain, opts.Z85_PRIVATE_KEY)
+	router.SetRcvhwm(opts.DOWNLOAD_PIPELINE * 2)
+	router.SetSndhwm(opts.DOWNLOAD_PIPELINE * 2)
+	router.SetLinger(srv.shutdownTimeout())
 
-	err = router.Bind(config.Config.ZMQ_OPTIONS.LISTEN_DOWNLOAD)
-	if err != nil {
-		logger.Log.Fatal(err)
-		return
+	if err = router.Bind(opts.LISTEN_DOWNLOAD); err != nil {
+		router.Close()
+		return nil, err
 	}
 
-	logger.Log.Infof("Started ZMQ downloader on %s", config.Config.ZMQ_OPTIONS.LISTEN_DOWNLOAD)
+	logger.Log.Infof("Started ZMQ downloader on %s", opts.LISTEN_DOWNLOAD)
+
+	return func() {
+		defer router.Close()
+		srv.serveZmqDownloads(router)
+		logger.Log.Info("Stopped ZMQ downloader")
+	}, nil
+}
+
+// Serve requests until shutdown. Requests are served one by one, so nothing is in flight once loop stops.
+// Replies still queued are sent within linger period of socket
+func (srv *Server) serveZmqDownloads(router *zmq.Socket) {
+	poller := zmq.NewPoller()
+	poller.Add(router, zmq.POLLIN)
+	for !srv.shuttingDown() {
+		polled, err := pollZmq(poller)
+		if err != nil {
+			logger.Log.Error(err)
+			break
+		}
+		if len(polled) == 0 {
+			continue
+		}
 
-	for {
-		msg, err := router.RecvMessage(0)
+		msg, props, err := router.RecvMessageWithMetadata(0, zmqUserIdProperty)
 		if err != nil {
 			logger.Log.Error(err)
 			break
 		}
+		if len(msg) >= 2 && msg[1] == zmqListCommand {
+			srv.serveZmqList(router, msg, props[zmqUserIdProperty])
+			continue
+		}
+		if len(msg) >= 2 && msg[1] == zmqLookupCommand {
+			srv.serveZmqLookup(router, msg, props[zmqUserIdProperty])
+			continue
+		}
+		if len(msg) < 4 {
+			logger.Log.Error("Invalid download request")
+			srv.metrics.observeZmqDownload("download", true)
+			continue
+		}
 		identity, stroid, stroffset, strchunksize := msg[0], msg[1], msg[2], msg[3]
+		reject := func() {
+			srv.metrics.observeZmqDownload("download", true)
+			router.SendMessage(identity, []byte{})
+		}
+
+		client := srv.zmqPrincipal(props[zmqUserIdProperty])
+		if client == nil {
+			logger.Log.Error("Unknown ZMQ client key")
+			reject()
+			continue
+		}
 
 		var oid uuid.UUID
 		err = oid.Scan(stroid)
 		if err != nil {
 			logger.Log.Error("Invalid OID: ", err)
-			router.SendMessage(identity, []byte{})
+			reject()
 			continue
 		}
 
 		offset, err := strconv.ParseInt(stroffset, 10, 64)
 		if err != nil {
 			logger.Log.Error("Invalid offset: ", err)
-			router.SendMessage(identity, []byte{})
+			reject()
 			continue
 		}
 
 		chunksize, err := strconv.Atoi(strchunksize)
 		if err != nil {
 			logger.Log.Error("Invalid offset: ", err)
-			router.SendMessage(identity, []byte{})
+			reject()
 			continue
 		}
 
-		pool := config.Config.CEPH_OPTIONS.POOL_NAMES_PREFIX + string(stroid[:2])
-		obj, err := cephutils.ExistingRadosObj(pool, oid)
+		obj, err := srv.storage.FindRadosObj(client.Tenant.Namespace, oid)
 		if err != nil {
 			logger.Log.Errorf("Rados object (%s) fetch error: %s", stroid, err)
-			router.SendMessage(identity, []byte{})
+			reject()
+			continue
+		}
+
+		if obj.IsPartial() {
+			logger.Log.Errorf("Rados object (%s) upload is not finished", stroid)
+			obj.Destroy()
+			reject()
+			continue
+		}
+		if !client.canRead(&obj.BaseRadosObj) {
+			logger.Log.Errorf("Rados object (%s) access denied", stroid)
+			obj.Destroy()
+			reject()
 			continue
 		}
 
@@ -79,7 +143,68 @@ func BindZMqDownloader() {
 		_, err = router.SendMessage(identity, chunk[:n])
 		if err != nil {
 			logger.Log.Errorf("ZMQ send message error: %s", err)
+			srv.metrics.observeZmqDownload("download", true)
 			continue
 		}
+		srv.metrics.observeZmqDownload("download", false)
+		srv.metrics.zmqDownloadBytes.Add(float64(n))
+	}
+}
+
+// Reply to objects listing request w/ JSON encoded listResponse
+func (srv *Server) serveZmqList(router *zmq.Socket, msg []string, key string) {
+	identity := msg[0]
+	resp := new(listResponse)
+	req := new(listRequest)
+
+	client := srv.zmqPrincipal(key)
+	if client == nil {
+		resp.Error = "Unknown client key"
+	} else if len(msg) > 2 && msg[2] != "" && json.Unmarshal([]byte(msg[2]), req) != nil {
+		resp.Error = "Invalid list request"
+	} else if page, err, _ := srv.listObjects(client, req); err != nil {
+		logger.Log.Error(err)
+		resp.Error = err.Error()
+	} else {
+		resp = page
+	}
+
+	srv.metrics.observeZmqDownload("list", resp.Error != "")
+
+	result, err := json.Marshal(resp)
+	if err != nil {
+		logger.Log.Error(err)
+		return
+	}
+	if _, err = router.SendMessage(identity, result); err != nil {
+		logger.Log.Errorf("ZMQ send message error: %s", err)
+	}
+}
+
+// Reply to lookup request w/ JSON encoded listResponse
+func (srv *Server) serveZmqLookup(router *zmq.Socket, msg []string, key string) {
+	identity := msg[0]
+	resp := new(listResponse)
+	req := new(lookupRequest)
+
+	client := srv.zmqPrincipal(key)
+	if client == nil {
+		resp.Error = "Unknown client key"
+	} else if len(msg) < 3 || json.Unmarshal([]byte(msg[2]), req) != nil {
+		resp.Error = "Invalid lookup request"
+	} else if objs, err, _ := srv.lookupObjects(client, req); err != nil {
+		resp.Error = err.Error()
+	} else {
+		resp.Objects = objs
+	}
+	srv.metrics.observeZmqDownload("lookup", resp.Error != "")
+
+	result, err := json.Marshal(resp)
+	if err != nil {
+		logger.Log.Error(err)
+		return
+	}
+	if _, err = router.SendMessage(identity, result); err != nil {
+		logger.Log.Errorf("ZMQ send message error: %s", err)
 	}
 }
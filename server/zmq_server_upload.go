@@ -3,162 +3,342 @@ package server
 import (
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"github.com/GrvHldr/dfscache/cephutils"
-	"github.com/GrvHldr/dfscache/config"
 	"github.com/GrvHldr/dfscache/logger"
 	zmq "github.com/pebbe/zmq4"
 	"sync"
+	"time"
 )
 
-var mu sync.Mutex
-var zClientsMap = make(zClients)
+// Upload session of ZMQ client, nil if client is not registered
+func (srv *Server) uploadSession(zid string) *cephutils.LockRadosObj {
+	srv.uploadsMu.Lock()
+	defer srv.uploadsMu.Unlock()
 
-type zClients map[string]*cephutils.LockRadosObj
-
-func (z zClients) IsRegistered(zid string) bool {
-	_, ok := z[zid]
-	return ok
+	return srv.uploads[zid]
 }
 
-func (z zClients) RegisterNew(zid, filename string, filesize uint64) error {
-	mu.Lock()
-	defer mu.Unlock()
+func (srv *Server) registerUpload(zid string, client *principal, filename string, filesize uint64, placement, acl string) error {
+	srv.uploadsMu.Lock()
+	defer srv.uploadsMu.Unlock()
 
-	if b := z.IsRegistered(zid); b {
+	if _, ok := srv.uploads[zid]; ok {
 		return errors.New("ZMQ client already registered")
 	}
 
-	obj, err := cephutils.NewRadosObj(filename)
+	if err := cephutils.ValidateACL(acl); err != nil {
+		return err
+	}
+
+	tenant := client.Tenant
+	limit := tenant.UploadLimit(srv.cfg.ZMQ_OPTIONS.MAX_UPLOAD_SIZE)
+	if limit > 0 && filesize > limit {
+		return errors.New("Upload size exceeds limit")
+	}
+
+	obj, err := srv.storage.NewRadosObj(cephutils.ObjOptions{
+		FileName:  filename,
+		Size:      filesize,
+		Placement: placement,
+		Namespace: tenant.Namespace,
+		TTL:       tenant.ObjectTTL,
+		Owner:     client.ID,
+		ACL:       acl,
+	})
 	if err != nil {
 		return err
 	}
+	if err = obj.CheckQuota(filesize, tenant.QuotaBytes, tenant.QuotaObjects); err != nil {
+		obj.Destroy()
+		return err
+	}
 	obj.Size = filesize // set total file size
 
-	z[zid] = &cephutils.LockRadosObj{RadosObj: *obj}
+	srv.uploads[zid] = &cephutils.LockRadosObj{RadosObj: *obj}
 
-	logger.Log.Debugf("Registered ZMQ client %s; filename: %s, file size: %d", z[zid].Oid, filename, filesize)
+	logger.Log.Debugf("Registered ZMQ client %s; filename: %s, file size: %d", obj.Oid, filename, filesize)
 
 	return nil
 }
 
-func (z zClients) Unregister(zid string) error {
-	mu.Lock()
-	defer mu.Unlock()
+func (srv *Server) unregisterUpload(zid string) error {
+	srv.uploadsMu.Lock()
+	defer srv.uploadsMu.Unlock()
 
-	if b := z.IsRegistered(zid); !b {
+	obj, ok := srv.uploads[zid]
+	if !ok {
 		return errors.New("ZMQ client is not registered")
 	}
 
-	obj := z[zid]
 	obj.Destroy()
-	logger.Log.Debugf("Unregistered ZMQ client %s", z[zid].Oid)
-	delete(z, zid)
+	logger.Log.Debugf("Unregistered ZMQ client %s", obj.Oid)
+	delete(srv.uploads, zid)
 
 	return nil
 }
 
-func BindZMqUploader() {
+// Number of upload sessions in progress
+func (srv *Server) uploadsCount() int {
+	srv.uploadsMu.Lock()
+	defer srv.uploadsMu.Unlock()
+
+	return len(srv.uploads)
+}
+
+// Abort upload sessions unfinished on shutdown. Sessions are marked aborted, so workers holding them
+// don't write to aborted objects
+func (srv *Server) abortUploads() {
+	srv.uploadsMu.Lock()
+	defer srv.uploadsMu.Unlock()
+
+	for zid, obj := range srv.uploads {
+		obj.Lock()
+		if obj.WriteProgress() < obj.Size {
+			logger.Log.Warningf("Aborting unfinished upload of %s", obj.Oid)
+			obj.Abort()
+			srv.metrics.zmqUploadSessions.WithLabelValues("aborted").Inc()
+		}
+		obj.Aborted = true
+		obj.Destroy()
+		obj.Unlock()
+		delete(srv.uploads, zid)
+	}
+}
+
+// Bind ZMQ uploader, returns proxy loop forwarding client messages to upload workers
+func (srv *Server) bindZmqUploader() (func(), error) {
 	// Start Authentication process
-	zmq.AuthSetVerbose(true)
-	zmq.AuthStart()
-	zmq.AuthCurveAdd("*", config.Config.ZMQ_OPTIONS.Z85_PUBLIC_CLIENT_KEY)
+	domain, err := srv.startZmqAuth()
+	if err != nil {
+		return nil, err
+	}
+	opts := srv.cfg.ZMQ_OPTIONS
 
 	// Listen frontend
 	frontend, err := zmq.NewSocket(zmq.ROUTER)
 	if err != nil {
-		logger.Log.Fatal(err)
+		return nil, err
 	}
-	defer frontend.Close()
 
-	frontend.ServerAuthCurve("*", config.Config.ZMQ_OPTIONS.Z85_PRIVATE_KEY)
+	frontend.ServerAuthCurve(domain, opts.Z85_PRIVATE_KEY)
 	frontend.SetRcvhwm(1)
 	frontend.SetSndhwm(1)
-	err = frontend.Bind(config.Config.ZMQ_OPTIONS.LISTEN_UPLOAD)
-	if err != nil {
-		logger.Log.Fatal(err)
+	frontend.SetLinger(srv.shutdownTimeout())
+	if err = frontend.Bind(opts.LISTEN_UPLOAD); err != nil {
+		frontend.Close()
+		return nil, err
 	}
 
-	// Listen backend
+	// Listen backend, endpoint is unique per instance
 	backend, err := zmq.NewSocket(zmq.DEALER)
 	if err != nil {
-		logger.Log.Fatal(err)
+		frontend.Close()
+		return nil, err
 	}
-	defer backend.Close()
-	err = backend.Bind("inproc://backend")
-	if err != nil {
-		logger.Log.Fatal(err)
+	endpoint := fmt.Sprintf("inproc://backend-%p", srv)
+	if err = backend.Bind(endpoint); err != nil {
+		frontend.Close()
+		backend.Close()
+		return nil, err
 	}
 
-	// Start backend workers
-	for i := 0; i < config.Config.ZMQ_OPTIONS.NUM_UPLOAD_WORKERS; i++ {
-		z := i
-		go backendWorker(z)
-	}
+	logger.Log.Infof("Started ZMQ uploader on %s", opts.LISTEN_UPLOAD)
+
+	return func() {
+		defer frontend.Close()
+		defer backend.Close()
+
+		// Start backend workers, they stop once proxy is stopped
+		stopped := make(chan struct{})
+		var workers sync.WaitGroup
+		for i := 0; i < opts.NUM_UPLOAD_WORKERS; i++ {
+			workers.Add(1)
+			go func(i int) {
+				defer workers.Done()
+				srv.backendWorker(i, endpoint, stopped)
+			}(i)
+		}
+
+		srv.proxyUploads(frontend, backend)
+		close(stopped)
+		workers.Wait()
+
+		logger.Log.Info("Stopped ZMQ uploader")
+	}, nil
+}
 
-	logger.Log.Infof("Started ZMQ uploader on %s", config.Config.ZMQ_OPTIONS.LISTEN_UPLOAD)
+// Forward messages between frontend and backend. Client public key is prepended to client
+// messages as ZMQ proxy would drop message properties.
+// On shutdown new sessions are refused, ones in progress are given shutdown timeout to finish
+func (srv *Server) proxyUploads(frontend, backend *zmq.Socket) {
+	poller := zmq.NewPoller()
+	poller.Add(frontend, zmq.POLLIN)
+	poller.Add(backend, zmq.POLLIN)
+	var deadline time.Time
+	for {
+		if srv.shuttingDown() {
+			if deadline.IsZero() {
+				deadline = time.Now().Add(srv.shutdownTimeout())
+				logger.Log.Infof("Draining %d ZMQ upload sessions", srv.uploadsCount())
+			}
+			if srv.uploadsCount() == 0 {
+				return
+			}
+			if time.Now().After(deadline) {
+				srv.abortUploads()
+				return
+			}
+		}
+
+		polled, err := pollZmq(poller)
+		if err != nil {
+			logger.Log.Error(err)
+			srv.abortUploads()
+			return
+		}
 
-	// Start ZMQ proxy between backend and frontend
-	err = zmq.Proxy(frontend, backend, nil)
-	logger.Log.Fatal(err)
+		for _, p := range polled {
+			switch p.Socket {
+			case frontend:
+				msg, props, err := frontend.RecvMessageBytesWithMetadata(0, zmqUserIdProperty)
+				if err != nil {
+					logger.Log.Error(err)
+					continue
+				}
+				backend.SendMessage(msg[0], props[zmqUserIdProperty], msg[1:])
+			case backend:
+				msg, err := backend.RecvMessageBytes(0)
+				if err != nil {
+					logger.Log.Error(err)
+					continue
+				}
+				frontend.SendMessage(msg)
+			}
+		}
+	}
 }
 
-func backendWorker(i int) {
+func (srv *Server) backendWorker(i int, endpoint string, stopped <-chan struct{}) {
 	intbuf := make([]byte, 8)
 	sock, err := zmq.NewSocket(zmq.DEALER)
 	if err != nil {
-		logger.Log.Fatal(err)
+		logger.Log.Error(err)
+		return
 	}
 	defer sock.Close()
-	err = sock.Connect("inproc://backend")
+	err = sock.Connect(endpoint)
 	if err != nil {
-		logger.Log.Fatal(err)
+		logger.Log.Error(err)
 		return
 	}
 
+	poller := zmq.NewPoller()
+	poller.Add(sock, zmq.POLLIN)
 	for {
+		polled, err := pollZmq(poller)
+		if err != nil {
+			logger.Log.Error(err)
+			return
+		}
+		if len(polled) == 0 {
+			select {
+			case <-stopped:
+				return
+			default:
+				continue
+			}
+		}
+
 		parts, err := sock.RecvMessageBytes(0)
 		if err != nil {
 			logger.Log.Error(err)
 			return
 		}
 
+		// Message: client identity, client public key, payload
 		identity := string(parts[0])
-		if !zClientsMap.IsRegistered(identity) {
-			// Client is not registered. Header received
-			size := binary.LittleEndian.Uint64(parts[2])
-			if err = zClientsMap.RegisterNew(identity, string(parts[1]), size); err == nil {
-				sock.SendMessage(identity, "ACK", zClientsMap[identity].Oid.String())
+		o := srv.uploadSession(identity)
+		if o == nil {
+			// Client is not registered. Header received: file name, size, optional placement class and ACL
+			if srv.shuttingDown() {
+				sock.SendMessage(identity, "NAK", "Server is shutting down")
+				continue
+			}
+			client := srv.zmqPrincipal(string(parts[1]))
+			if client == nil {
+				sock.SendMessage(identity, "NAK", "Unknown client key")
+				continue
+			}
+			if len(parts) < 4 || len(parts[3]) != 8 {
+				sock.SendMessage(identity, "NAK", "Invalid header")
+				continue
+			}
+			size := binary.LittleEndian.Uint64(parts[3])
+			placement, acl := "", ""
+			if len(parts) > 4 {
+				placement = string(parts[4])
+			}
+			if len(parts) > 5 {
+				acl = string(parts[5])
+			}
+			if err = srv.registerUpload(identity, client, string(parts[2]), size, placement, acl); err == nil {
+				sock.SendMessage(identity, "ACK", srv.uploadSession(identity).Oid.String())
 			} else {
-				sock.SendMessage(identity, "NAK", "")
+				srv.metrics.zmqUploadSessions.WithLabelValues("rejected").Inc()
+				sock.SendMessage(identity, "NAK", err.Error())
 			}
 			continue
 		}
 
 		// Client is registered. Data chunks
-		chunk := parts[1]
+		chunk := parts[2]
 		// In current implementation chunks go one by one in series
-		o := zClientsMap[identity]
 		o.Lock()
+		if o.Aborted {
+			o.Unlock()
+			sock.SendMessage(identity, "NAK", "Upload aborted")
+			continue
+		}
+		if o.WriteProgress()+uint64(len(chunk)) > o.Size {
+			logger.Log.Errorf("Upload of %s exceeds declared size", o.Oid)
+			o.Abort()
+			o.Unlock()
+			srv.metrics.zmqUploadSessions.WithLabelValues("failed").Inc()
+			sock.SendMessage(identity, "NAK", "Data exceeds declared size")
+			srv.unregisterUpload(identity)
+			continue
+		}
 		_, err = o.Write(chunk)
 		if err != nil {
 			logger.Log.Error("Can't write chunk to Ceph", err)
+			o.Abort()
 			o.Unlock()
-			sock.SendMessage(identity, "NAK")
-			zClientsMap.Unregister(identity)
+			srv.metrics.zmqUploadSessions.WithLabelValues("failed").Inc()
+			sock.SendMessage(identity, "NAK", "Storage error")
+			srv.unregisterUpload(identity)
 			continue
 		}
+		srv.metrics.zmqUploadChunks.Inc()
+		srv.metrics.zmqUploadBytes.Add(float64(len(chunk)))
 		progress := o.WriteProgress()
-		binary.LittleEndian.PutUint64(intbuf, progress)
-		sock.SendMessage(identity, intbuf)
-		o.Unlock()
-
+		// Commit under session lock, shutdown won't abort finished upload
 		if progress == o.Size {
 			logger.Log.Infof("Transfer finished for %s", o.Oid)
-			err = o.SyncAttributes()
+			err = o.Commit()
 			if err != nil {
 				logger.Log.Error("Can't sync Rados attrs:", err)
+				srv.metrics.zmqUploadSessions.WithLabelValues("failed").Inc()
+			} else {
+				srv.metrics.zmqUploadSessions.WithLabelValues("completed").Inc()
 			}
-			zClientsMap.Unregister(identity)
+		}
+		binary.LittleEndian.PutUint64(intbuf, progress)
+		sock.SendMessage(identity, intbuf)
+		o.Unlock()
+
+		if progress == o.Size {
+			srv.unregisterUpload(identity)
 		}
 	}
 }
@@ -1,9 +1,12 @@
+// +build ignore
+
 package main
 
 import (
 	"flag"
 	"github.com/GrvHldr/dfscache/server"
 	"github.com/GrvHldr/dfscache/config"
+	"github.com/GrvHldr/dfscache/logger"
 )
 
 func init() {
@@ -21,5 +24,9 @@ func init() {
 }
 
 func main() {
-	server.GarbageCollector()
+	srv, err := server.New(config.Config, nil)
+	if err != nil {
+		logger.Log.Fatal(err)
+	}
+	srv.Serve(server.GC)
 }
@@ -0,0 +1,120 @@
+package tenants
+
+import (
+	"crypto/subtle"
+	"github.com/GrvHldr/dfscache/config"
+	"time"
+)
+
+type Tenant struct {
+	Name          string
+	Namespace     string        // RADOS namespace tenant objects are stored within
+	ObjectTTL     time.Duration // Objects lifetime, 0 for CEPH_OPTIONS.OBJECT_TTL
+	MaxObjectSize uint64        // 0 if not limited
+	QuotaBytes    uint64        // Total objects size quota, 0 if not limited
+	QuotaObjects  uint64        // Objects count quota, 0 if not limited
+}
+
+// Tenants of server configuration
+type Registry struct {
+	tenants       []config.TenantConfig
+	defaultTenant string
+	legacyKey     string // Shared ZMQ client key of default tenant
+}
+
+// Anonymous tenant when no tenants configured: objects are stored within default namespace
+var anonymous = &Tenant{}
+
+func NewRegistry(cfg *config.ServerConfig) *Registry {
+	return &Registry{
+		tenants:       cfg.TENANTS,
+		defaultTenant: cfg.DEFAULT_TENANT,
+		legacyKey:     cfg.ZMQ_OPTIONS.Z85_PUBLIC_CLIENT_KEY,
+	}
+}
+
+func newTenant(t config.TenantConfig) *Tenant {
+	return &Tenant{
+		Name:          t.NAME,
+		Namespace:     t.NAMESPACE,
+		ObjectTTL:     time.Duration(t.OBJECT_TTL) * time.Second,
+		MaxObjectSize: t.MAX_OBJECT_SIZE,
+		QuotaBytes:    t.QUOTA_BYTES,
+		QuotaObjects:  t.QUOTA_OBJECTS,
+	}
+}
+
+// Tenant by name
+func (r *Registry) ByName(name string) *Tenant {
+	for _, t := range r.tenants {
+		if t.NAME == name {
+			return newTenant(t)
+		}
+	}
+
+	return nil
+}
+
+// Tenant used for requests w/o credentials. Nil if anonymous access is not allowed
+func (r *Registry) Default() *Tenant {
+	if len(r.tenants) == 0 {
+		return anonymous
+	}
+	if r.defaultTenant == "" {
+		return nil
+	}
+
+	return r.ByName(r.defaultTenant)
+}
+
+// Tenant identified by HTTP basic auth credentials
+func (r *Registry) ByHTTPCredentials(user, password string) *Tenant {
+	for _, t := range r.tenants {
+		expected, ok := t.HTTP_USERS[user]
+		if ok && subtle.ConstantTimeCompare([]byte(expected), []byte(password)) == 1 {
+			return newTenant(t)
+		}
+	}
+
+	return nil
+}
+
+// Tenant identified by ZMQ CURVE client public key (Z85 encoded)
+func (r *Registry) ByCurveKey(key string) *Tenant {
+	for _, t := range r.tenants {
+		for _, k := range t.ZMQ_CLIENT_KEYS {
+			if k == key {
+				return newTenant(t)
+			}
+		}
+	}
+
+	// Legacy shared client key
+	if key == r.legacyKey {
+		return r.Default()
+	}
+
+	return nil
+}
+
+// All ZMQ CURVE client public keys allowed to connect
+func (r *Registry) CurveKeys() []string {
+	var keys []string
+	if r.Default() != nil && r.legacyKey != "" {
+		keys = append(keys, r.legacyKey)
+	}
+	for _, t := range r.tenants {
+		keys = append(keys, t.ZMQ_CLIENT_KEYS...)
+	}
+
+	return keys
+}
+
+// Max upload size of tenant over protocol with given limit, 0 if not limited
+func (t *Tenant) UploadLimit(protoLimit uint64) uint64 {
+	if t.MaxObjectSize > 0 && (protoLimit == 0 || t.MaxObjectSize < protoLimit) {
+		return t.MaxObjectSize
+	}
+
+	return protoLimit
+}